@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// importedUser represents a row of imported CSV file in the form expected by ImportUsers method.
+type importedUser struct {
+	User struct {
+		Nickname string `json:"nickname"`
+		Email    string `json:"email"`
+		Language string `json:"language,omitempty"`
+	} `json:"user"`
+	Consent bool  `json:"consent,omitempty"`
+	Row     int32 `json:"row"`
+}
+
+// readImportFile reads CSV file with "nickname", "email" and optional "language" columns (in any order) and
+// validates its rows. Valid rows are returned as importedUser slice, errors of invalid
+// ones are returned as messages with row numbers.
+func readImportFile(path string, consent bool) ([]importedUser, []string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = -1
+	header, err := csvReader.Read()
+	if err != nil {
+		return nil, nil, err
+	}
+	nicknameIdx, emailIdx, languageIdx := -1, -1, -1
+	for i := range header {
+		switch strings.ToLower(strings.TrimSpace(header[i])) {
+		case "nickname":
+			nicknameIdx = i
+		case "email":
+			emailIdx = i
+		case "language":
+			languageIdx = i
+		}
+	}
+	if nicknameIdx < 0 || emailIdx < 0 {
+		return nil, nil, fmt.Errorf("Invalid file %q: expected \"nickname\" and \"email\" columns.", path)
+	}
+	var users []importedUser
+	var rowErrors []string
+	for row := int32(2); ; row++ {
+		record, err := csvReader.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, err
+		}
+		if nicknameIdx >= len(record) || emailIdx >= len(record) {
+			rowErrors = append(rowErrors, fmt.Sprintf("Row %d: not enough fields.", row))
+			continue
+		}
+		var user importedUser
+		user.User.Nickname = strings.TrimSpace(record[nicknameIdx])
+		user.User.Email = strings.TrimSpace(record[emailIdx])
+		if languageIdx >= 0 && languageIdx < len(record) {
+			user.User.Language = strings.TrimSpace(record[languageIdx])
+		}
+		user.Consent, user.Row = consent, row
+		if user.User.Nickname == "" {
+			rowErrors = append(rowErrors, fmt.Sprintf("Row %d: empty nickname.", row))
+			continue
+		}
+		if _, err := mail.ParseAddress(user.User.Email); err != nil {
+			rowErrors = append(rowErrors, fmt.Sprintf("Row %d: invalid email.", row))
+			continue
+		}
+		users = append(users, user)
+	}
+	return users, rowErrors, nil
+}
@@ -12,19 +12,39 @@ var (
 	method              = flag.String("method", "ListUsers", "gRPC method to be executed")
 	nickname            = flag.String("nickname", "", "Nickname of the user")
 	email               = flag.String("email", "", "Email address of the user")
+	language            = flag.String("language", "", "Preferred language of the user's emails (Accept-Language of the client if empty)")
+	adminToken          = flag.String("admin-token", "", "Token for administrative methods")
+	paused              = flag.Bool("paused", true, "Pause (true) or resume (false) daily delivery")
+	consent             = flag.Bool("consent", false, "Imported users gave consent (admin only, no confirmation emails)")
+	runID               = flag.String("run-id", "", "ID of the delivery run (scheduled time in 20060102T150405Z format)")
 )
 
 func main() {
 	flag.Parse()
 	var err error
 	var resp string
+	if flag.Arg(0) == "import" {
+		*method = "ImportUsers"
+	}
 	switch *method {
 	case "AddUser":
-		resp, err = addUserCall(*nickname, *email, *mainServiceLocation)
+		resp, err = addUserCall(*nickname, *email, *language, *mainServiceLocation)
 	case "DeleteUser":
 		resp, err = deleteUserCall(*nickname, *mainServiceLocation)
 	case "ListUsers":
 		resp, err = listUsersCall(*mainServiceLocation)
+	case "ExportMyData":
+		resp, err = exportMyDataCall(*nickname, *mainServiceLocation)
+	case "ChangeEmail":
+		resp, err = changeEmailCall(*nickname, *email, *mainServiceLocation)
+	case "PauseUser":
+		resp, err = pauseUserCall(*nickname, *paused, *mainServiceLocation)
+	case "EraseUser":
+		resp, err = eraseUserCall(*nickname, *adminToken, *mainServiceLocation)
+	case "ImportUsers":
+		resp, err = importUsersCall(flag.Arg(1), *consent, *adminToken, *mainServiceLocation)
+	case "GetDeliveryRun":
+		resp, err = getDeliveryRunCall(*runID, *adminToken, *mainServiceLocation)
 	default:
 		err = fmt.Errorf("Unknown method.")
 	}
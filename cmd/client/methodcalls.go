@@ -6,16 +6,18 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 )
 
 // addUserCall is used to call (through gRPC) AddUser method on main service.
-func addUserCall(nickname, email, mainServiceLocation string) (string, error) {
+func addUserCall(nickname, email, language, mainServiceLocation string) (string, error) {
 	user := struct {
 		Nickname string `json:"nickname,omitempty"`
 		Email    string `json:"email,omitempty"`
+		Language string `json:"language,omitempty"`
 	}{}
-	user.Nickname, user.Email = nickname, email
+	user.Nickname, user.Email, user.Language = nickname, email, language
 	jsonData, err := json.Marshal(&user)
 	if err != nil {
 		return "", err
@@ -82,3 +84,161 @@ func listUsersCall(mainServiceLocation string) (string, error) {
 	}
 	return bodyStr, nil
 }
+
+// exportMyDataCall is used to call (through gRPC) ExportMyData method on main service.
+func exportMyDataCall(nickname, mainServiceLocation string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, mainServiceLocation+"/v1/users/"+nickname+"/export", nil)
+	if err != nil {
+		return "", err
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bodyData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	bodyStr := string(bodyData)
+	if resp.StatusCode > 399 {
+		return "", fmt.Errorf("Got response status %q with body %q", resp.Status, bodyStr)
+	}
+	return bodyStr, nil
+}
+
+// changeEmailCall is used to call (through gRPC) ChangeEmail method on main service.
+func changeEmailCall(nickname, newEmail, mainServiceLocation string) (string, error) {
+	change := struct {
+		NewEmail string `json:"newEmail,omitempty"`
+	}{newEmail}
+	jsonData, err := json.Marshal(&change)
+	if err != nil {
+		return "", err
+	}
+	return putCall(mainServiceLocation+"/v1/users/"+nickname+"/email", jsonData)
+}
+
+// pauseUserCall is used to call (through gRPC) PauseUser method on main service.
+func pauseUserCall(nickname string, paused bool, mainServiceLocation string) (string, error) {
+	pause := struct {
+		Paused bool `json:"paused"`
+	}{paused}
+	jsonData, err := json.Marshal(&pause)
+	if err != nil {
+		return "", err
+	}
+	return putCall(mainServiceLocation+"/v1/users/"+nickname+"/pause", jsonData)
+}
+
+// putCall sends PUT request with given JSON body to main service.
+func putCall(url string, jsonData []byte) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(jsonData))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bodyData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	bodyStr := string(bodyData)
+	if resp.StatusCode > 399 {
+		return "", fmt.Errorf("Got response status %q with body %q", resp.Status, bodyStr)
+	}
+	return bodyStr, nil
+}
+
+// eraseUserCall is used to call (through gRPC) administrative EraseUser method on main service.
+func eraseUserCall(nickname, adminToken, mainServiceLocation string) (string, error) {
+	req, err := http.NewRequest(http.MethodDelete, mainServiceLocation+"/v1/admin/users/"+nickname, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bodyData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	bodyStr := string(bodyData)
+	if resp.StatusCode > 399 {
+		return "", fmt.Errorf("Got response status %q with body %q", resp.Status, bodyStr)
+	}
+	return bodyStr, nil
+}
+
+// getDeliveryRunCall is used to call (through gRPC) administrative GetDeliveryRun method on main service.
+func getDeliveryRunCall(runID, adminToken, mainServiceLocation string) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, mainServiceLocation+"/v1/admin/runs/"+runID, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bodyData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	bodyStr := string(bodyData)
+	if resp.StatusCode > 399 {
+		return "", fmt.Errorf("Got response status %q with body %q", resp.Status, bodyStr)
+	}
+	return bodyStr, nil
+}
+
+// importUsersCall is used to call (through gRPC) client-streaming ImportUsers method on main service.
+// The rows of CSV file are validated locally first, then valid ones are sent as newline-delimited JSON.
+func importUsersCall(path string, consent bool, adminToken, mainServiceLocation string) (string, error) {
+	users, rowErrors, err := readImportFile(path, consent)
+	if err != nil {
+		return "", err
+	}
+	body := new(bytes.Buffer)
+	encoder := json.NewEncoder(body)
+	for i := range users {
+		if err := encoder.Encode(&users[i]); err != nil {
+			return "", err
+		}
+	}
+	req, err := http.NewRequest(http.MethodPost, mainServiceLocation+"/v1/users/import", body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+	client := http.Client{Timeout: 10 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	bodyData, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	bodyStr := string(bodyData)
+	if resp.StatusCode > 399 {
+		return "", fmt.Errorf("Got response status %q with body %q", resp.Status, bodyStr)
+	}
+	return strings.Join(append(rowErrors, bodyStr), "\n"), nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/rs/zerolog/log"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/kafkaconfig"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
+)
+
+const (
+	// producerName is the name of this tool in headers of replayed messages.
+	producerName = "deadletters"
+
+	// readTimeout is the time of waiting for the next message of a partition. The last offsets of a partition
+	// may have no messages (e.g. they are taken by transaction markers), so the reading stops after timeout.
+	readTimeout = 5 * time.Second
+)
+
+var (
+	messageBrokersAddrs = flag.String("brokers-addresses", "localhost:9092", "Message brokers addresses")
+	topic               = flag.String("topic", "", "Show or replay only dead letters of this topic (auth or daily)")
+	replayAll           = flag.Bool("all", false, "Replay all dead letters instead of given IDs")
+	kafkaConf           = kafkaconfig.RegisterFlags(flag.CommandLine)
+)
+
+// deadLetterRecord is a dead letter with its' position in dead letter topic.
+type deadLetterRecord struct {
+	*messages.DeadLetter
+	partition   int32
+	offset      int64
+	key         string
+	traceParent string
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: deadletters [flags] list | deadletters [-all] [flags] replay [ID...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	conf, err := kafkaConf.NewSaramaConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid message broker settings.")
+	}
+	conf.Producer.Return.Successes = true
+	conf.Producer.Return.Errors = true
+
+	client, err := sarama.NewClient(strings.Split(*messageBrokersAddrs, ","), conf)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect to message brokers.")
+	}
+	defer client.Close()
+
+	topics, err := kafkaConf.Topics()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid topic names.")
+	}
+
+	records, err := readDeadLetters(client, topics.Name(sc.DeadLetterTopic))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to read dead letters.")
+	}
+
+	switch flag.Arg(0) {
+	case "list":
+		for _, record := range records {
+			fmt.Printf("%d:%d\t%s\t%s\t%s\t%d attempts\t%s\n", record.partition, record.offset, record.ID,
+				record.CreatedAt.Format(time.RFC3339), record.Topic, record.Attempts, record.Error)
+		}
+	case "replay":
+		ids := flag.Args()[1:]
+		if len(ids) == 0 && !*replayAll {
+			log.Fatal().Msg("No dead letter IDs are given. Use -all flag to replay all dead letters.")
+		}
+		replayed, err := replay(client, topics, records, ids)
+		if err != nil {
+			log.Fatal().Err(err).Msgf("Failed to replay dead letters (%d are replayed).", replayed)
+		}
+		fmt.Printf("Replayed %d dead letters.\n", replayed)
+	default:
+		flag.Usage()
+	}
+}
+
+// readDeadLetters reads all messages currently stored in dead letter topic with given name. Messages which
+// can't be decoded or don't match topic flag are skipped.
+func readDeadLetters(client sarama.Client, deadLetterTopic string) ([]deadLetterRecord, error) {
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, err
+	}
+	defer consumer.Close()
+	partitions, err := consumer.Partitions(deadLetterTopic)
+	if err != nil {
+		return nil, err
+	}
+	var records []deadLetterRecord
+	for _, partition := range partitions {
+		newest, err := client.GetOffset(deadLetterTopic, partition, sarama.OffsetNewest)
+		if err != nil {
+			return nil, err
+		}
+		oldest, err := client.GetOffset(deadLetterTopic, partition, sarama.OffsetOldest)
+		if err != nil {
+			return nil, err
+		} else if oldest >= newest {
+			continue
+		}
+		partitionConsumer, err := consumer.ConsumePartition(deadLetterTopic, partition, oldest)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, readPartition(partitionConsumer, partition, newest)...)
+		partitionConsumer.Close()
+	}
+	return records, nil
+}
+
+// readPartition reads dead letters from the partition consumer until the message before newest offset is read
+// or no message is received during readTimeout.
+func readPartition(partitionConsumer sarama.PartitionConsumer, partition int32, newest int64) []deadLetterRecord {
+	var records []deadLetterRecord
+	for {
+		select {
+		case message, ok := <-partitionConsumer.Messages():
+			if !ok {
+				return records
+			}
+			deadLetter, err := messages.DecodeDeadLetter(message.Value)
+			if err != nil {
+				log.Error().Err(err).Msgf("Skipped invalid dead letter at %d:%d.", partition, message.Offset)
+			} else if *topic == "" || deadLetter.Topic == *topic {
+				msg := broker.FromConsumerMessage(message)
+				records = append(records, deadLetterRecord{deadLetter, partition, msg.Offset, msg.Key, msg.Headers[messages.HeaderTraceParent]})
+			}
+			if message.Offset >= newest-1 {
+				return records
+			}
+		case <-time.After(readTimeout):
+			log.Warn().Msgf("No more dead letters in partition %d after %s, stopped reading before offset %d.",
+				partition, readTimeout, newest)
+			return records
+		}
+	}
+}
+
+// replay publishes original payloads of dead letters with given IDs (or all dead letters
+// if ids are empty) back into their topics, mapped to cluster names by topics. Returns the number of replayed dead letters.
+func replay(client sarama.Client, topics broker.Topics, records []deadLetterRecord, ids []string) (int, error) {
+	producer, err := sarama.NewSyncProducerFromClient(client)
+	if err != nil {
+		return 0, err
+	}
+	publisher := broker.NewKafkaPublisher(producer, broker.WithTopics(topics))
+	defer publisher.Close()
+	selected := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		selected[id] = true
+	}
+	replayed := 0
+	for _, record := range records {
+		if len(ids) != 0 && !selected[record.ID] {
+			continue
+		} else if record.Topic != sc.AuthTopic && record.Topic != sc.DailyDeliveryTopic {
+			log.Error().Msgf("Skipped dead letter %s with unknown topic %q.", record.ID, record.Topic)
+			continue
+		}
+		var header messages.Header
+		if err := json.Unmarshal(record.Payload, &header); err != nil {
+			log.Error().Err(err).Msgf("Skipped dead letter %s with invalid payload.", record.ID)
+			continue
+		}
+		msg := &broker.Message{
+			Topic:   record.Topic,
+			Key:     record.key,
+			Value:   record.Payload,
+			Headers: header.Headers(producerName, messages.ChildTraceParent(record.traceParent)),
+		}
+		if err := publisher.Publish(msg); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
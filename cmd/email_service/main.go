@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"flag"
+	"os"
 	"strings"
 	"time"
 
@@ -11,19 +12,45 @@ import (
 
 	"github.com/Shopify/sarama"
 
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
 	es "github.com/KSpaceer/go_watermelon/internal/email/server"
+	"github.com/KSpaceer/go_watermelon/internal/kafkaconfig"
+	"github.com/KSpaceer/go_watermelon/internal/kafkawriter"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
 )
 
 const (
-	timeoutStep     time.Duration = 500 * time.Millisecond
-	connectAttempts               = 4
+	timeoutStep        time.Duration = 500 * time.Millisecond
+	connectAttempts                  = 4
+	logFlushFrequency  time.Duration = 500 * time.Millisecond
+	logFlushMessages                 = 100
+	emailConsumerGroup               = "emailsend"
 )
 
 var (
-	emailInfoFilePath   = flag.String("email-info-file", "./emailinfo.csv", "Email info file")
+	mailTransport       = flag.String("mail-transport", es.TransportSMTP, "How emails are sent: smtp, maildir, eml or http")
+	emailInfoFilePath   = flag.String("email-info-file", "./emailinfo.csv", "Email info file (smtp transport)")
+	smtpEncryption      = flag.String("smtp-encryption", "starttls", "Encryption of SMTP connections: starttls, tls (implicit TLS) or none")
+	smtpCAFile          = flag.String("smtp-ca-cert", "", "CA certificate of SMTP server (system ones are used if empty)")
+	smtpServerName      = flag.String("smtp-server-name", "", "Name in SMTP server's certificate (host from email info file if empty)")
+	smtpAuth            = flag.String("smtp-auth", "plain", "SMTP authentication mechanism: plain, login, cram-md5 or none")
+	mailDirectory       = flag.String("mail-directory", "./mail", "Directory where emails are written (maildir and eml transports)")
+	mailAPIURL          = flag.String("mail-api-url", "", "Endpoint of mail provider's HTTP API (http transport)")
+	mailAPITokenFile    = flag.String("mail-api-token-file", "", "File with bearer token of mail HTTP API (http transport, no token if empty)")
+	mailAPITimeout      = flag.Duration("mail-api-timeout", 10*time.Second, "Timeout of a request to mail HTTP API (http transport)")
 	mainServiceLocation = flag.String("main-service-location", "localhost:8081", "Main service URL")
 	imageDirectory      = flag.String("image-directory", "./img", "Image directory")
+	templateDirectory   = flag.String("template-directory", "./templates", "Directory with message templates")
+	templatesReload     = flag.Duration("templates-reload-interval", 5*time.Second, "How often template files are checked for changes (no reload if zero)")
 	messageBrokersAddrs = flag.String("brokers-addresses", "kafka-1:9092,kafka-2:9092", "Message brokers addresses")
+	redisAddr           = flag.String("redis-address", "", "Redis DB address for the ledger of sent daily messages (disabled if empty)")
+	asyncLogs           = flag.Bool("async-logs", false, "Send logs to message broker asynchronously in batches")
+	logBufferSize       = flag.Int("log-buffer-size", 1024, "Number of log lines buffered in memory by asynchronous writer")
+	logOverflowPolicy   = flag.String("log-overflow-policy", "drop", "What to do with log lines when buffer is full: drop or block")
+	logSpillDir         = flag.String("log-spill-dir", "", "Directory to spill undelivered log lines (disabled if empty)")
+	logSpillMaxSize     = flag.Int64("log-spill-max-size", 64<<20, "Maximal size of spill file in bytes")
+	kafkaConf           = kafkaconfig.RegisterFlags(flag.CommandLine)
 )
 
 func createConsumerGroup(addrs []string, conf *sarama.Config) (sarama.ConsumerGroup, error) {
@@ -32,7 +59,7 @@ func createConsumerGroup(addrs []string, conf *sarama.Config) (sarama.ConsumerGr
 	for i := 0; i < connectAttempts; i++ {
 		log.Info().Msg("Creating a consumer group in message broker...")
 		var consumerGroup sarama.ConsumerGroup
-		consumerGroup, err = sarama.NewConsumerGroup(addrs, "emailsend", conf)
+		consumerGroup, err = sarama.NewConsumerGroup(addrs, kafkaConf.ConsumerGroup(emailConsumerGroup), conf)
 		if err == nil {
 			log.Info().Msg("Successfully created a consumer group.")
 			return consumerGroup, nil
@@ -62,6 +89,54 @@ func createLogProducer(addrs []string, conf *sarama.Config) (sarama.SyncProducer
 	return nil, err
 }
 
+func createLedger(addr string) (data.Cache, error) {
+	var err error
+	timeout := timeoutStep
+	for i := 0; i < connectAttempts; i++ {
+		log.Info().Msg("Connecting to ledger cache...")
+		var cache data.Cache
+		cache, err = data.NewRedisCache(addr)
+		if err == nil {
+			log.Info().Msg("Successfully connected to ledger cache.")
+			return cache, nil
+		}
+		log.Error().Err(err).Msg("Occured while attempting to connect to ledger cache.")
+		time.Sleep(timeout)
+		timeout += timeoutStep
+	}
+	return nil, err
+}
+
+func createAsyncLogWriter(addrs []string, topics broker.Topics) (*kafkawriter.AsyncWriter, error) {
+	policy, err := kafkawriter.ParseOverflowPolicy(*logOverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := kafkaConf.NewSaramaConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.Producer.Return.Successes = true
+	conf.Producer.Return.Errors = true
+	conf.Producer.Flush.Frequency = logFlushFrequency
+	conf.Producer.Flush.Messages = logFlushMessages
+	producer, err := sarama.NewAsyncProducer(addrs, conf)
+	if err != nil {
+		return nil, err
+	}
+	opts := []kafkawriter.AsyncOption{kafkawriter.WithBufferSize(*logBufferSize), kafkawriter.WithOverflowPolicy(policy),
+		kafkawriter.WithTopics(topics)}
+	if *logSpillDir != "" {
+		opts = append(opts, kafkawriter.WithSpillDir(*logSpillDir, *logSpillMaxSize))
+	}
+	writer, err := kafkawriter.NewAsync(producer, sc.EmailServiceName, opts...)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
 func main() {
 	flag.Parse()
 
@@ -69,28 +144,79 @@ func main() {
 
 	addrs := strings.Split(*messageBrokersAddrs, ",")
 
-	conf := sarama.NewConfig()
+	conf, err := kafkaConf.NewSaramaConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid message broker settings.")
+	}
 	conf.Producer.Return.Successes = true
 	conf.Producer.Return.Errors = true
-	conf.Version = sarama.V3_2_0_0
+	topics, err := kafkaConf.Topics()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid topic names.")
+	}
+	if err := kafkaConf.Provision(addrs, conf, sc.AuthTopic, sc.DailyDeliveryTopic, sc.LogsTopic, sc.DeadLetterTopic,
+		sc.ReceiptsTopic); err != nil {
+		log.Fatal().Err(err).Msg("Topics provisioning has failed.")
+	}
 
 	consumerGroup, err := createConsumerGroup(addrs, conf)
 	if err != nil {
 		log.Fatal().Err(err).Msg("All attempts to create a consumer group have failed.")
 	}
-	defer consumerGroup.Close()
+	subscriber := broker.NewKafkaSubscriber(consumerGroup, broker.WithTopics(topics))
+	defer subscriber.Close()
 
 	logProducer, err := createLogProducer(addrs, conf)
 	if err != nil {
 		log.Fatal().Err(err).Msg("All attempts to create a sync producer have failed.")
 	}
-	defer logProducer.Close()
+	publisher := broker.NewKafkaPublisher(logProducer, broker.WithTopics(topics))
+	defer publisher.Close()
 
-	eServer, err := es.NewEmailServer(*emailInfoFilePath, *mainServiceLocation, *imageDirectory, consumerGroup, logProducer)
+	transport, err := es.NewTransport(es.TransportConfig{
+		Kind:           *mailTransport,
+		EmailInfoFile:  *emailInfoFilePath,
+		SMTPEncryption: *smtpEncryption,
+		SMTPCAFile:     *smtpCAFile,
+		SMTPServerName: *smtpServerName,
+		SMTPAuth:       *smtpAuth,
+		Directory:      *mailDirectory,
+		APIURL:         *mailAPIURL,
+		APITokenFile:   *mailAPITokenFile,
+		APITimeout:     *mailAPITimeout,
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Couldn't create mail transport.")
+	}
+	defer transport.Close()
+
+	eServer, err := es.NewEmailServer(transport, *mainServiceLocation, *imageDirectory, *templateDirectory, subscriber, publisher)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Occured while creating a new EmailServer instance")
 	}
+	closeLogWriter := func() {}
+	if *asyncLogs {
+		logWriter, err := createAsyncLogWriter(addrs, topics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Couldn't create asynchronous log writer.")
+		}
+		eServer.SetLogWriter(logWriter)
+		closeLogWriter = func() { logWriter.Close() }
+	}
+	if *redisAddr != "" {
+		ledger, err := createLedger(*redisAddr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("All attempts to connect to ledger cache have failed.")
+		}
+		defer ledger.Close()
+		eServer.SetLedger(ledger)
+	}
+	if *templatesReload > 0 {
+		go eServer.WatchTemplates(context.Background(), *templatesReload)
+	}
 	err = eServer.SubscribeToTopics(context.Background())
 	eServer.Wait()
-	eServer.Fatal().Msgf("Failed to consume messages: %v", err)
+	eServer.Error().Msgf("Failed to consume messages: %v", err)
+	closeLogWriter()
+	os.Exit(1)
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"flag"
@@ -15,7 +16,11 @@ import (
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/credentials/insecure"
 
+	"github.com/KSpaceer/go_watermelon/internal/broker"
 	"github.com/KSpaceer/go_watermelon/internal/data"
+	"github.com/KSpaceer/go_watermelon/internal/kafkaconfig"
+	"github.com/KSpaceer/go_watermelon/internal/kafkawriter"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
 	pb "github.com/KSpaceer/go_watermelon/internal/user_handling/proto"
 	uhs "github.com/KSpaceer/go_watermelon/internal/user_handling/server"
 	"github.com/Shopify/sarama"
@@ -27,8 +32,11 @@ import (
 const (
 	timeoutStep            time.Duration = 500 * time.Millisecond
 	connectAttempts                      = 4
+	logFlushFrequency      time.Duration = 500 * time.Millisecond
+	logFlushMessages                     = 100
 	deliveryTimeEnvVar                   = "GWM_DELIVERY_TIME"
 	deliveryIntervalEnvVar               = "GWM_DELIVERY_INTERVAL"
+	receiptsConsumerGroup                = "user_handling_service"
 )
 
 var (
@@ -40,6 +48,23 @@ var (
 	privateKeyPath      = flag.String("key", "./cert/key.pem", "Private key for TLS")
 	certPath            = flag.String("cert", "./cert/cert.pem", "x509 Certificate for TLS")
 	caCertPath          = flag.String("ca", "./cert/ca-cert.pem", "CA certificate trusted by the service")
+	adminTokenFilePath  = flag.String("admin-token-file", "", "File with token for administrative methods")
+	confirmationRate    = flag.Int("import-confirmation-rate", 10, "Confirmation emails per second requested by import")
+	cacheRebuildLock    = flag.Bool("cache-rebuild-lock", false, "Lock in cache for rebuilding users list, serving stale list meanwhile")
+	emailKeyFilePath    = flag.String("email-key-file", "", "Key file for encryption of emails at rest")
+	nicknameKeyFilePath = flag.String("nickname-key-file", "", "File with secret key for hashes of erased users' nicknames (required with admin token)")
+	asyncLogs           = flag.Bool("async-logs", false, "Send logs to message broker asynchronously in batches")
+	logBufferSize       = flag.Int("log-buffer-size", 1024, "Number of log lines buffered in memory by asynchronous writer")
+	logOverflowPolicy   = flag.String("log-overflow-policy", "drop", "What to do with log lines when buffer is full: drop or block")
+	logSpillDir         = flag.String("log-spill-dir", "", "Directory to spill undelivered log lines (disabled if empty)")
+	logSpillMaxSize     = flag.Int64("log-spill-max-size", 64<<20, "Maximal size of spill file in bytes")
+	deliveryWorkers     = flag.Int("delivery-workers", 8, "Number of workers publishing daily messages")
+	deliveryBatchSize   = flag.Int("delivery-batch-size", 50, "Number of daily messages published in one batch")
+	deliveryRate        = flag.Int("delivery-rate", 0, "Daily messages per second published during delivery run (unlimited if zero)")
+	leaderElection      = flag.Bool("leader-election", true, "Send daily messages and relay outbox events only from the replica holding leader lock in database")
+	leaderCheckInterval = flag.Duration("leader-check-interval", 5*time.Second, "Interval of acquiring or checking leader lock")
+	replicaID           = flag.String("replica-id", "", "ID of the replica in leadership logs (host name if empty)")
+	kafkaConf           = kafkaconfig.RegisterFlags(flag.CommandLine)
 )
 
 func createRedisCache() (data.Cache, error) {
@@ -60,13 +85,13 @@ func createRedisCache() (data.Cache, error) {
 	return nil, err
 }
 
-func createPgsDB() (data.DB, error) {
+func createPgsDB(keyring *data.Keyring, nicknameHasher *data.NicknameHasher) (*data.PgsDB, error) {
 	var err error
 	timeout := timeoutStep
 	for i := 0; i < connectAttempts; i++ {
 		log.Info().Msg("Connecting to database...")
-		var db data.DB
-		db, err = data.NewPgsDB(*pgsInfoFilePath)
+		var db *data.PgsDB
+		db, err = data.NewPgsDB(*pgsInfoFilePath, keyring, nicknameHasher)
 		if err == nil {
 			log.Info().Msg("Successfully connected to database.")
 			return db, nil
@@ -96,6 +121,24 @@ func createMBProducer(addrs []string, conf *sarama.Config) (sarama.SyncProducer,
 	return nil, err
 }
 
+func createReceiptsConsumerGroup(addrs []string, conf *sarama.Config) (sarama.ConsumerGroup, error) {
+	var err error
+	timeout := timeoutStep
+	for i := 0; i < connectAttempts; i++ {
+		log.Info().Msg("Creating a consumer group in message broker...")
+		var consumerGroup sarama.ConsumerGroup
+		consumerGroup, err = sarama.NewConsumerGroup(addrs, kafkaConf.ConsumerGroup(receiptsConsumerGroup), conf)
+		if err == nil {
+			log.Info().Msg("Successfully created a consumer group.")
+			return consumerGroup, nil
+		}
+		log.Error().Err(err).Msg("Occured while attempting to create a consumer group.")
+		time.Sleep(timeout)
+		timeout += timeoutStep
+	}
+	return nil, err
+}
+
 func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	caCertPEM, err := os.ReadFile(*caCertPath)
 	if err != nil {
@@ -119,33 +162,115 @@ func loadTLSCredentials() (credentials.TransportCredentials, error) {
 	return credentials.NewTLS(conf), nil
 }
 
+func createAsyncLogWriter(addrs []string, topics broker.Topics) (*kafkawriter.AsyncWriter, error) {
+	policy, err := kafkawriter.ParseOverflowPolicy(*logOverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	conf, err := kafkaConf.NewSaramaConfig()
+	if err != nil {
+		return nil, err
+	}
+	conf.Producer.Return.Successes = true
+	conf.Producer.Return.Errors = true
+	conf.Producer.Flush.Frequency = logFlushFrequency
+	conf.Producer.Flush.Messages = logFlushMessages
+	producer, err := sarama.NewAsyncProducer(addrs, conf)
+	if err != nil {
+		return nil, err
+	}
+	opts := []kafkawriter.AsyncOption{kafkawriter.WithBufferSize(*logBufferSize), kafkawriter.WithOverflowPolicy(policy),
+		kafkawriter.WithTopics(topics)}
+	if *logSpillDir != "" {
+		opts = append(opts, kafkawriter.WithSpillDir(*logSpillDir, *logSpillMaxSize))
+	}
+	writer, err := kafkawriter.NewAsync(producer, sc.MainServiceName, opts...)
+	if err != nil {
+		producer.Close()
+		return nil, err
+	}
+	return writer, nil
+}
+
 func main() {
 	flag.Parse()
 
 	zerolog.TimeFieldFormat = zerolog.TimeFormatUnix
 
+	var keyring *data.Keyring
+	var err error
+	if *emailKeyFilePath != "" {
+		keyring, err = data.NewKeyringFromFile(*emailKeyFilePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Couldn't load email encryption keys.")
+		}
+	} else {
+		log.Warn().Msg("No email key file is given: emails will be stored unencrypted.")
+	}
+
+	var nicknameHasher *data.NicknameHasher
+	if *nicknameKeyFilePath != "" {
+		nicknameHasher, err = data.NewNicknameHasherFromFile(*nicknameKeyFilePath)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Couldn't load nickname key.")
+		}
+	} else if *adminTokenFilePath != "" {
+		log.Fatal().Msg("Administrative methods require nickname key file.")
+	}
+
 	cache, err := createRedisCache()
 	if err != nil {
 		log.Fatal().Err(err).Msg("All attempts to connect to cache have failed.")
 	}
 
-	db, err := createPgsDB()
+	db, err := createPgsDB(keyring, nicknameHasher)
 	if err != nil {
 		cache.Close()
 		log.Fatal().Err(err).Msg("All attempts to connect to database have failed.")
 	}
 
-	dataHandler := data.NewData(cache, db)
+	var dataOpts []data.Option
+	if *cacheRebuildLock {
+		dataOpts = append(dataOpts, data.WithRebuildLock())
+	}
+	if keyring != nil {
+		dataOpts = append(dataOpts, data.WithKeyring(keyring))
+	}
+	dataHandler := data.NewData(cache, db, dataOpts...)
 	defer dataHandler.Disconnect()
 
-	producerConf := sarama.NewConfig()
+	producerConf, err := kafkaConf.NewSaramaConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid message broker settings.")
+	}
 	producerConf.Producer.Return.Successes = true
-	producerConf.Version = sarama.V3_2_0_0
-	mbProducer, err := createMBProducer(strings.Split(*messageBrokersAddrs, ","), producerConf)
+	addrs := strings.Split(*messageBrokersAddrs, ",")
+	topics, err := kafkaConf.Topics()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid topic names.")
+	}
+	mbProducer, err := createMBProducer(addrs, producerConf)
 	if err != nil {
 		log.Fatal().Err(err).Msg("All attempts to connect to message broker have failed.")
 	}
-	defer mbProducer.Close()
+	err = kafkaConf.Provision(addrs, producerConf, sc.AuthTopic, sc.DailyDeliveryTopic, sc.LogsTopic, sc.ErasureTopic, sc.UserEventsTopic,
+		sc.ReceiptsTopic)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Topics provisioning has failed.")
+	}
+	publisher := broker.NewKafkaPublisher(mbProducer, broker.WithTopics(topics))
+	defer publisher.Close()
+
+	consumerConf, err := kafkaConf.NewSaramaConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid message broker settings.")
+	}
+	consumerGroup, err := createReceiptsConsumerGroup(addrs, consumerConf)
+	if err != nil {
+		log.Fatal().Err(err).Msg("All attempts to create a consumer group have failed.")
+	}
+	subscriber := broker.NewKafkaSubscriber(consumerGroup, broker.WithTopics(topics))
+	defer subscriber.Close()
 
 	deliveryTime := os.Getenv(deliveryTimeEnvVar)
 	if err := uhs.SetDeliveryTime(deliveryTime); err != nil {
@@ -160,9 +285,35 @@ func main() {
 	}
 	log.Info().Msgf("Set delivery interval: %s", uhs.GetDeliveryInterval())
 
-	uhServer := uhs.NewUserHandlingServer(dataHandler, mbProducer)
+	uhServer := uhs.NewUserHandlingServer(dataHandler, publisher)
+	closeLogWriter := func() {}
+	if *asyncLogs {
+		logWriter, err := createAsyncLogWriter(addrs, topics)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Couldn't create asynchronous log writer.")
+		}
+		uhServer.SetLogWriter(logWriter)
+		closeLogWriter = func() { logWriter.Close() }
+	}
 	uhServer.Info().Msg("Created a new UserHandlingServer instance.")
 
+	if *adminTokenFilePath != "" {
+		adminToken, err := os.ReadFile(*adminTokenFilePath)
+		if err != nil {
+			uhServer.Fatal().Msgf("Failed to read admin token file: %v", err)
+		}
+		uhServer.SetAdminToken(strings.TrimSpace(string(adminToken)))
+	}
+	if err := uhServer.SetConfirmationRate(*confirmationRate); err != nil {
+		uhServer.Fatal().Msgf("Couldn't set confirmation rate: %v", err)
+	}
+	if err := uhServer.SetDeliveryWorkers(*deliveryWorkers, *deliveryBatchSize); err != nil {
+		uhServer.Fatal().Msgf("Couldn't set delivery workers: %v", err)
+	}
+	if err := uhServer.SetDeliveryRate(*deliveryRate); err != nil {
+		uhServer.Fatal().Msgf("Couldn't set delivery rate: %v", err)
+	}
+
 	lis, err := net.Listen("tcp", *grpcServerEndpoint)
 	if err != nil {
 		uhServer.Error().Msgf("Occured while creating a listener: %v", err)
@@ -182,11 +333,30 @@ func main() {
 
 	cancelChan := make(chan struct{})
 	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go uhServer.DailyDelivery(wg, cancelChan)
+	if *leaderElection {
+		if *replicaID == "" {
+			*replicaID, _ = os.Hostname()
+		}
+		wg.Add(1)
+		go uhServer.LeadDailyDelivery(wg, cancelChan, db.NewAdvisoryLock(data.DeliveryLeaderLockKey), *replicaID,
+			*leaderCheckInterval)
+	} else {
+		wg.Add(2)
+		go uhServer.DailyDelivery(wg, cancelChan)
+		go uhServer.RelayOutboxEvents(wg, cancelChan)
+	}
+	receiptsCtx, cancelReceipts := context.WithCancel(context.Background())
+	go func() {
+		if err := uhServer.ConsumeReceipts(receiptsCtx, subscriber); err != nil {
+			uhServer.Error().Msgf("Failed to consume delivery receipts: %v", err)
+		}
+	}()
 
 	err = grpcServer.Serve(lis)
+	cancelReceipts()
 	close(cancelChan)
 	wg.Wait()
-	uhServer.Fatal().Msgf("Occured while serving grpc connection: %v", err)
+	uhServer.Error().Msgf("Occured while serving grpc connection: %v", err)
+	closeLogWriter()
+	os.Exit(1)
 }
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -36,6 +37,17 @@ var (
 	caCertPath         = flag.String("ca", "./cert/ca-cert.pem", "CA certificate trusted by the server")
 )
 
+// headerMatcher forwards W3C trace context and Accept-Language headers to the main service in addition
+// to default headers.
+func headerMatcher(key string) (string, bool) {
+	if strings.EqualFold(key, "traceparent") {
+		return "traceparent", true
+	} else if strings.EqualFold(key, "accept-language") {
+		return "accept-language", true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
 func registerGRPCHandler(ctx context.Context, mux *runtime.ServeMux, opts []grpc.DialOption) error {
 	var err error
 	timeout := timeoutStep
@@ -94,7 +106,7 @@ func main() {
 		}
 	}
 	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
-	mux := runtime.NewServeMux()
+	mux := runtime.NewServeMux(runtime.WithIncomingHeaderMatcher(headerMatcher))
 	err = registerGRPCHandler(ctx, mux, opts)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Can't register handler from gRPC endpoint - all attempts have failed.")
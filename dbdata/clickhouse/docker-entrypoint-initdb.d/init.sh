@@ -0,0 +1,34 @@
+#!/bin/bash
+# Creates the tables storing logs of services. The topic with logs and the consumer group are
+# set by CLICKHOUSE_LOGS_TOPIC and CLICKHOUSE_LOGS_GROUP, so they can follow "-topic-prefix"
+# and "-topic-names" of the services.
+set -e
+
+clickhouse client -n <<-EOSQL
+CREATE TABLE IF NOT EXISTS queue (
+    level String,
+    time UInt64,
+    message String
+) ENGINE = Kafka SETTINGS
+            kafka_broker_list = '${CLICKHOUSE_KAFKA_BROKERS:-kafka-1:9092,kafka-2:9092}',
+            kafka_topic_list = '${CLICKHOUSE_LOGS_TOPIC:-logs}',
+            kafka_group_name = '${CLICKHOUSE_LOGS_GROUP:-logconsumers}',
+            kafka_format = 'JSONEachRow',
+            kafka_num_consumers = 2;
+
+CREATE TABLE IF NOT EXISTS logs (
+    level String,
+    day Date,
+    message String,
+    service String,
+    message_id String
+) ENGINE = MergeTree()
+ORDER BY day
+TTL day + INTERVAL 30 DAY;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS consumer to logs
+AS SELECT level, toDateTime(time) AS day, message,
+    arrayElement(_headers.value, indexOf(_headers.name, 'producer')) AS service,
+    arrayElement(_headers.value, indexOf(_headers.name, 'message-id')) AS message_id
+FROM queue;
+EOSQL
@@ -0,0 +1,87 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ErrClosed is returned by Publish and Subscribe after the broker is closed.
+var ErrClosed = fmt.Errorf("broker: closed")
+
+// Message is a message passed between services through the message broker.
+type Message struct {
+	Topic string
+
+	// Key defines the partition of message, so messages with the same key keep their order.
+	// Empty key means the message has no key.
+	Key string
+
+	Value []byte
+
+	// Headers contains metadata of message (see Header* consts of messages package).
+	Headers map[string]string
+
+	// Partition and Offset define the position of consumed message in its' topic.
+	Partition int32
+	Offset    int64
+}
+
+// clone returns a copy of the message which doesn't share value and headers with the original.
+func (m *Message) clone() *Message {
+	c := *m
+	c.Value = append([]byte(nil), m.Value...)
+	if m.Headers != nil {
+		c.Headers = make(map[string]string, len(m.Headers))
+		for key, value := range m.Headers {
+			c.Headers[key] = value
+		}
+	}
+	return &c
+}
+
+// BatchError is returned by Publish when only some messages of a batch are not accepted by the broker.
+type BatchError struct {
+	// Errors contains errors of failed messages by their indexes in the batch.
+	Errors map[int]error
+}
+
+// Error returns errors of all failed messages.
+func (e *BatchError) Error() string {
+	indexes := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	descriptions := make([]string, len(indexes))
+	for j, i := range indexes {
+		descriptions[j] = fmt.Sprintf("message %d: %v", i, e.Errors[i])
+	}
+	return fmt.Sprintf("broker: %d of messages failed: %s", len(indexes), strings.Join(descriptions, "; "))
+}
+
+// Publisher sends messages to the message broker.
+type Publisher interface {
+	// Publish sends given messages and returns after all of them are accepted by the broker.
+	// If only some of the messages failed, the error may be *BatchError.
+	Publish(msgs ...*Message) error
+
+	Close() error
+}
+
+// Handler processes a consumed message. The processing may continue after Handler returns
+// (e.g. in another goroutine), but done must be called exactly once when the outcome is known.
+// If commit is false, the message and all messages after it are not committed and will be
+// delivered again to the next subscription. ctx is done when the subscription (or the session
+// of the claimed partition) ends, then the processing should be abandoned with done(false).
+type Handler func(ctx context.Context, msg *Message, done func(commit bool))
+
+// Subscriber receives messages from the message broker.
+type Subscriber interface {
+	// Subscribe passes messages of given topics to handler until ctx is done or an error occurs.
+	// It returns after all passed messages are done.
+	Subscribe(ctx context.Context, topics []string, handler Handler) error
+
+	Close() error
+}
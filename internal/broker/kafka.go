@@ -0,0 +1,242 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/Shopify/sarama"
+)
+
+// NewProducerMessage converts the message to Kafka producer message. Headers are sorted by name.
+func NewProducerMessage(msg *Message) *sarama.ProducerMessage {
+	producerMsg := &sarama.ProducerMessage{
+		Topic: msg.Topic,
+		Value: sarama.ByteEncoder(msg.Value),
+	}
+	if msg.Key != "" {
+		producerMsg.Key = sarama.StringEncoder(msg.Key)
+	}
+	if len(msg.Headers) != 0 {
+		names := make([]string, 0, len(msg.Headers))
+		for name := range msg.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		producerMsg.Headers = make([]sarama.RecordHeader, len(names))
+		for i, name := range names {
+			producerMsg.Headers[i] = sarama.RecordHeader{Key: []byte(name), Value: []byte(msg.Headers[name])}
+		}
+	}
+	return producerMsg
+}
+
+// FromConsumerMessage converts consumed Kafka message to Message.
+func FromConsumerMessage(consumerMsg *sarama.ConsumerMessage) *Message {
+	msg := &Message{
+		Topic:     consumerMsg.Topic,
+		Key:       string(consumerMsg.Key),
+		Value:     consumerMsg.Value,
+		Headers:   make(map[string]string, len(consumerMsg.Headers)),
+		Partition: consumerMsg.Partition,
+		Offset:    consumerMsg.Offset,
+	}
+	for _, header := range consumerMsg.Headers {
+		if header != nil {
+			msg.Headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	return msg
+}
+
+// DefaultMaxInFlight is the default maximum number of messages of one claimed partition, which are
+// passed to handler but not done yet.
+const DefaultMaxInFlight = 64
+
+// kafkaOptions contains settings shared by KafkaPublisher and KafkaSubscriber.
+type kafkaOptions struct {
+	topics      Topics
+	maxInFlight int
+}
+
+// KafkaOption configures KafkaPublisher or KafkaSubscriber.
+type KafkaOption func(*kafkaOptions)
+
+// WithTopics sets the mapping of logical topic names to names of topics in the cluster.
+func WithTopics(topics Topics) KafkaOption {
+	return func(o *kafkaOptions) {
+		o.topics = topics
+	}
+}
+
+// WithMaxInFlight sets the maximum number of messages of one claimed partition, which are passed to
+// handler but not done yet. Non-positive values are replaced with DefaultMaxInFlight.
+func WithMaxInFlight(maxInFlight int) KafkaOption {
+	return func(o *kafkaOptions) {
+		if maxInFlight > 0 {
+			o.maxInFlight = maxInFlight
+		}
+	}
+}
+
+// newKafkaOptions applies given options to default settings.
+func newKafkaOptions(opts []KafkaOption) kafkaOptions {
+	o := kafkaOptions{maxInFlight: DefaultMaxInFlight}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// KafkaPublisher implements Publisher with Kafka sync producer.
+type KafkaPublisher struct {
+	producer sarama.SyncProducer
+	kafkaOptions
+}
+
+// NewKafkaPublisher creates a new KafkaPublisher which sends messages with given producer.
+func NewKafkaPublisher(producer sarama.SyncProducer, opts ...KafkaOption) *KafkaPublisher {
+	return &KafkaPublisher{producer: producer, kafkaOptions: newKafkaOptions(opts)}
+}
+
+// Publish sends the messages, several messages are sent in one batch. Errors of separate messages
+// of the batch are returned as *BatchError.
+func (kp *KafkaPublisher) Publish(msgs ...*Message) error {
+	producerMsgs := make([]*sarama.ProducerMessage, len(msgs))
+	indexes := make(map[*sarama.ProducerMessage]int, len(msgs))
+	for i := range msgs {
+		producerMsgs[i] = NewProducerMessage(msgs[i])
+		producerMsgs[i].Topic = kp.topics.Name(msgs[i].Topic)
+		indexes[producerMsgs[i]] = i
+	}
+	if len(producerMsgs) == 1 {
+		_, _, err := kp.producer.SendMessage(producerMsgs[0])
+		return err
+	}
+	err := kp.producer.SendMessages(producerMsgs)
+	var producerErrs sarama.ProducerErrors
+	if !errors.As(err, &producerErrs) {
+		return err
+	}
+	batchErr := &BatchError{Errors: make(map[int]error, len(producerErrs))}
+	for _, producerErr := range producerErrs {
+		if i, ok := indexes[producerErr.Msg]; ok {
+			batchErr.Errors[i] = producerErr.Err
+		}
+	}
+	if len(batchErr.Errors) == 0 {
+		return err
+	}
+	return batchErr
+}
+
+// Close closes the producer.
+func (kp *KafkaPublisher) Close() error {
+	return kp.producer.Close()
+}
+
+// KafkaSubscriber implements Subscriber with Kafka consumer group.
+type KafkaSubscriber struct {
+	group sarama.ConsumerGroup
+	kafkaOptions
+}
+
+// NewKafkaSubscriber creates a new KafkaSubscriber which consumes messages as a member of given group.
+func NewKafkaSubscriber(group sarama.ConsumerGroup, opts ...KafkaOption) *KafkaSubscriber {
+	return &KafkaSubscriber{group: group, kafkaOptions: newKafkaOptions(opts)}
+}
+
+// Subscribe joins the consumer group and passes messages of claimed partitions to handler. After
+// rebalance it joins the group again. Messages passed to handler have logical topic names.
+func (ks *KafkaSubscriber) Subscribe(ctx context.Context, topics []string, handler Handler) error {
+	for {
+		if err := ks.group.Consume(ctx, ks.topics.Names(topics), groupHandler{handler: handler, topics: ks.topics, maxInFlight: ks.maxInFlight}); err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// Close leaves the consumer group.
+func (ks *KafkaSubscriber) Close() error {
+	return ks.group.Close()
+}
+
+// groupHandler implements sarama.ConsumerGroupHandler and passes messages to Handler.
+type groupHandler struct {
+	handler     Handler
+	topics      Topics
+	maxInFlight int
+}
+
+// Setup is defined to implement sarama.ConsumerGroupHandler
+func (gh groupHandler) Setup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// Cleanup is defined to implement sarama.ConsumerGroupHandler
+func (gh groupHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	return nil
+}
+
+// ConsumeClaim is defined to implement sarama.ConsumerGroupHandler. Messages may be processed concurrently,
+// but no more than maxInFlight of them at a time, and the offset of a message is marked only after it is
+// done with commit, and all offsets before it are marked too. Handler gets the context of the session,
+// so on rebalance it can abandon the processing. ConsumeClaim stops passing messages when the session
+// ends or a message is done without commit, and returns after all passed messages are done. Returning
+// ends the whole session, so the group is joined again and the message is redelivered at once instead
+// of being followed by messages whose offsets can't be marked.
+func (gh groupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	ctx := session.Context()
+	tracker := newOffsetTracker()
+	inFlight := make(chan struct{}, gh.maxInFlight)
+	rejected := make(chan struct{})
+	var rejectOnce sync.Once
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+	for {
+		select {
+		case inFlight <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		case <-rejected:
+			return nil
+		}
+		var consumerMsg *sarama.ConsumerMessage
+		var ok bool
+		select {
+		case consumerMsg, ok = <-claim.Messages():
+		case <-ctx.Done():
+		case <-rejected:
+		}
+		if !ok {
+			return nil
+		}
+		select {
+		case <-rejected:
+			return nil
+		default:
+		}
+		tracker.add(consumerMsg.Offset)
+		wg.Add(1)
+		msg := FromConsumerMessage(consumerMsg)
+		msg.Topic = gh.topics.Logical(msg.Topic)
+		var once sync.Once
+		gh.handler(ctx, msg, func(commit bool) {
+			once.Do(func() {
+				defer wg.Done()
+				defer func() { <-inFlight }()
+				if !commit {
+					rejectOnce.Do(func() { close(rejected) })
+					return
+				}
+				if next, ok := tracker.complete(msg.Offset); ok {
+					session.MarkOffset(claim.Topic(), claim.Partition(), next, "")
+				}
+			})
+		})
+	}
+}
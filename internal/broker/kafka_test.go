@@ -0,0 +1,194 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKafkaMessageRoundTrip(t *testing.T) {
+	msg := &Message{Topic: "auth", Key: "arbuz", Value: []byte("value"),
+		Headers: map[string]string{"producer": "email_service", "message-id": "abc"}}
+	producerMsg := NewProducerMessage(msg)
+	assert.Equal(t, []sarama.RecordHeader{
+		{Key: []byte("message-id"), Value: []byte("abc")},
+		{Key: []byte("producer"), Value: []byte("email_service")},
+	}, producerMsg.Headers)
+	key, _ := producerMsg.Key.Encode()
+	value, _ := producerMsg.Value.Encode()
+	consumerMsg := &sarama.ConsumerMessage{Topic: producerMsg.Topic, Key: key, Value: value, Partition: 1, Offset: 5}
+	for i := range producerMsg.Headers {
+		consumerMsg.Headers = append(consumerMsg.Headers, &producerMsg.Headers[i])
+	}
+	msg.Partition, msg.Offset = 1, 5
+	assert.Equal(t, msg, FromConsumerMessage(consumerMsg))
+}
+
+func TestProducerMessageWithoutKey(t *testing.T) {
+	assert.Nil(t, NewProducerMessage(&Message{Topic: "erasure"}).Key)
+}
+
+func TestKafkaPublisherBatch(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	for _, key := range []string{"pupa", "lupa"} {
+		expectedKey := key
+		producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+			if key, _ := msg.Key.Encode(); string(key) != expectedKey {
+				return fmt.Errorf("Wrong key: expected %q but got %q", expectedKey, key)
+			}
+			return nil
+		})
+	}
+	publisher := NewKafkaPublisher(producer)
+	assert.Nil(t, publisher.Publish(&Message{Topic: "daily", Key: "pupa"}, &Message{Topic: "daily", Key: "lupa"}))
+	assert.Nil(t, publisher.Close())
+}
+
+func TestKafkaPublisherTopics(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if msg.Topic != "test_auth" {
+			return fmt.Errorf("Wrong topic: expected %q but got %q", "test_auth", msg.Topic)
+		}
+		return nil
+	})
+	publisher := NewKafkaPublisher(producer, WithTopics(Topics{Prefix: "test_"}))
+	assert.Nil(t, publisher.Publish(&Message{Topic: "auth"}))
+	assert.Nil(t, publisher.Close())
+}
+
+// failingProducer fails every second message of a batch.
+type failingProducer struct {
+	sarama.SyncProducer
+}
+
+func (producer failingProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	var errs sarama.ProducerErrors
+	for i := 1; i < len(msgs); i += 2 {
+		errs = append(errs, &sarama.ProducerError{Msg: msgs[i], Err: sarama.ErrMessageSizeTooLarge})
+	}
+	return errs
+}
+
+func TestKafkaPublisherBatchError(t *testing.T) {
+	publisher := NewKafkaPublisher(failingProducer{})
+	err := publisher.Publish(&Message{Topic: "daily"}, &Message{Topic: "daily"}, &Message{Topic: "daily"}, &Message{Topic: "daily"})
+	var batchErr *BatchError
+	if assert.ErrorAs(t, err, &batchErr) {
+		assert.Equal(t, map[int]error{1: sarama.ErrMessageSizeTooLarge, 3: sarama.ErrMessageSizeTooLarge}, batchErr.Errors)
+	}
+}
+
+type fakeSession struct {
+	sarama.ConsumerGroupSession
+	ctx    context.Context
+	marked []int64
+}
+
+func (session *fakeSession) Context() context.Context {
+	if session.ctx == nil {
+		return context.Background()
+	}
+	return session.ctx
+}
+
+func (session *fakeSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	session.marked = append(session.marked, offset)
+}
+
+type fakeClaim struct {
+	sarama.ConsumerGroupClaim
+	topic    string
+	messages chan *sarama.ConsumerMessage
+}
+
+func (claim *fakeClaim) Topic() string {
+	return claim.topic
+}
+
+func (claim *fakeClaim) Partition() int32 {
+	return 0
+}
+
+func (claim *fakeClaim) Messages() <-chan *sarama.ConsumerMessage {
+	return claim.messages
+}
+
+func TestConsumeClaimMarksCommittedOffsets(t *testing.T) {
+	session := &fakeSession{}
+	claim := &fakeClaim{topic: "test_daily", messages: make(chan *sarama.ConsumerMessage, 4)}
+	for offset := int64(1); offset <= 4; offset++ {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "test_daily", Offset: offset}
+	}
+	close(claim.messages)
+	var dones []func(bool)
+	handler := groupHandler{topics: Topics{Prefix: "test_"}, maxInFlight: 4, handler: func(ctx context.Context, msg *Message, done func(commit bool)) {
+		assert.Equal(t, "daily", msg.Topic)
+		dones = append(dones, done)
+		if len(dones) == 4 {
+			dones[1](true)
+			dones[0](true)
+			dones[3](true)
+			dones[2](false)
+		}
+	}}
+	assert.Nil(t, handler.ConsumeClaim(session, claim))
+	assert.Equal(t, []int64{3}, session.marked)
+}
+
+func TestConsumeClaimLimitsInFlightMessages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	session := &fakeSession{ctx: ctx}
+	claim := &fakeClaim{topic: "daily", messages: make(chan *sarama.ConsumerMessage, 4)}
+	for offset := int64(1); offset <= 4; offset++ {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "daily", Offset: offset}
+	}
+	passed := make(chan int64, 4)
+	handler := groupHandler{maxInFlight: 2, handler: func(ctx context.Context, msg *Message, done func(commit bool)) {
+		passed <- msg.Offset
+		go func() {
+			<-ctx.Done()
+			done(false)
+		}()
+	}}
+	returned := make(chan error)
+	go func() {
+		returned <- handler.ConsumeClaim(session, claim)
+	}()
+	assert.Equal(t, int64(1), <-passed)
+	assert.Equal(t, int64(2), <-passed)
+	select {
+	case offset := <-passed:
+		t.Errorf("Message at offset %d is passed while the limit is reached", offset)
+	case <-time.After(50 * time.Millisecond):
+	}
+	cancel()
+	select {
+	case err := <-returned:
+		assert.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("ConsumeClaim has not returned after the session has ended")
+	}
+	assert.Empty(t, session.marked)
+}
+
+func TestConsumeClaimStopsAfterUncommittedMessage(t *testing.T) {
+	session := &fakeSession{}
+	claim := &fakeClaim{topic: "daily", messages: make(chan *sarama.ConsumerMessage, 4)}
+	for offset := int64(1); offset <= 4; offset++ {
+		claim.messages <- &sarama.ConsumerMessage{Topic: "daily", Offset: offset}
+	}
+	var passed []int64
+	handler := groupHandler{maxInFlight: 4, handler: func(ctx context.Context, msg *Message, done func(commit bool)) {
+		passed = append(passed, msg.Offset)
+		done(msg.Offset != 2)
+	}}
+	assert.Nil(t, handler.ConsumeClaim(session, claim))
+	assert.Equal(t, []int64{1, 2}, passed)
+	assert.Equal(t, []int64{2}, session.marked)
+}
@@ -0,0 +1,155 @@
+package broker
+
+import (
+	"context"
+	"sync"
+)
+
+// Memory is an in-process message broker which keeps all messages in memory. It implements both
+// Publisher and Subscriber, so services can be run in a single process or tested without Kafka.
+// Memory behaves like a consumer group with one member and a single partition per topic: messages
+// of every topic are delivered in order, and messages which are not committed are delivered again
+// to the next subscription.
+type Memory struct {
+	mu     sync.Mutex
+	topics map[string]*memoryTopic
+
+	// updated is closed (and replaced) when a message is published or the broker is closed.
+	updated chan struct{}
+	closed  bool
+}
+
+// memoryTopic contains all messages published to the topic.
+type memoryTopic struct {
+	messages []*Message
+
+	// committed is the offset of the first uncommitted message.
+	committed int64
+}
+
+// NewMemory creates a new empty Memory broker.
+func NewMemory() *Memory {
+	return &Memory{topics: make(map[string]*memoryTopic), updated: make(chan struct{})}
+}
+
+// topic returns the topic with given name, creating it if necessary. m.mu must be held.
+func (m *Memory) topic(name string) *memoryTopic {
+	t, ok := m.topics[name]
+	if !ok {
+		t = &memoryTopic{}
+		m.topics[name] = t
+	}
+	return t
+}
+
+// notify wakes up subscriptions. m.mu must be held.
+func (m *Memory) notify() {
+	close(m.updated)
+	m.updated = make(chan struct{})
+}
+
+// Publish stores copies of the messages in their topics.
+func (m *Memory) Publish(msgs ...*Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	for _, msg := range msgs {
+		t := m.topic(msg.Topic)
+		stored := msg.clone()
+		stored.Partition, stored.Offset = 0, int64(len(t.messages))
+		t.messages = append(t.messages, stored)
+	}
+	m.notify()
+	return nil
+}
+
+// Messages returns copies of all messages published to the topic.
+func (m *Memory) Messages(topic string) []*Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.topics[topic]
+	if !ok {
+		return nil
+	}
+	msgs := make([]*Message, len(t.messages))
+	for i := range t.messages {
+		msgs[i] = t.messages[i].clone()
+	}
+	return msgs
+}
+
+// Subscribe passes messages of given topics, starting from the first uncommitted ones, to handler.
+// Only one subscription should be active at a time.
+func (m *Memory) Subscribe(ctx context.Context, topics []string, handler Handler) error {
+	positions := make(map[string]int64, len(topics))
+	trackers := make(map[string]*offsetTracker, len(topics))
+	m.mu.Lock()
+	for _, topic := range topics {
+		positions[topic] = m.topic(topic).committed
+		trackers[topic] = newOffsetTracker()
+	}
+	m.mu.Unlock()
+	wg := new(sync.WaitGroup)
+	defer wg.Wait()
+	for {
+		m.mu.Lock()
+		if m.closed {
+			m.mu.Unlock()
+			return ErrClosed
+		}
+		var pending []*Message
+		for _, topic := range topics {
+			t := m.topics[topic]
+			for ; positions[topic] < int64(len(t.messages)); positions[topic]++ {
+				pending = append(pending, t.messages[positions[topic]].clone())
+			}
+		}
+		updated := m.updated
+		m.mu.Unlock()
+		for _, msg := range pending {
+			tracker := trackers[msg.Topic]
+			tracker.add(msg.Offset)
+			wg.Add(1)
+			topic, offset := msg.Topic, msg.Offset
+			var once sync.Once
+			handler(ctx, msg, func(commit bool) {
+				once.Do(func() {
+					defer wg.Done()
+					if !commit {
+						return
+					}
+					if next, ok := tracker.complete(offset); ok {
+						m.commit(topic, next)
+					}
+				})
+			})
+		}
+		select {
+		case <-updated:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// commit moves the committed offset of the topic forward.
+func (m *Memory) commit(topic string, next int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t := m.topic(topic); next > t.committed {
+		t.committed = next
+	}
+}
+
+// Close closes the broker. Active subscriptions return ErrClosed after their messages are done.
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.closed {
+		m.closed = true
+		m.notify()
+	}
+	return nil
+}
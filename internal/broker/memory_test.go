@@ -0,0 +1,54 @@
+package broker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryDeliversInOrder(t *testing.T) {
+	memory := NewMemory()
+	assert.Nil(t, memory.Publish(&Message{Topic: "auth", Value: []byte("first")}))
+	ctx, cancel := context.WithCancel(context.Background())
+	received := make(chan string, 3)
+	go func() {
+		assert.Nil(t, memory.Subscribe(ctx, []string{"auth"}, func(ctx context.Context, msg *Message, done func(bool)) {
+			received <- string(msg.Value)
+			done(true)
+		}))
+		close(received)
+	}()
+	assert.Nil(t, memory.Publish(&Message{Topic: "auth", Value: []byte("second")}, &Message{Topic: "logs", Value: []byte("skipped")}))
+	assert.Equal(t, "first", <-received)
+	assert.Equal(t, "second", <-received)
+	cancel()
+	_, ok := <-received
+	assert.False(t, ok)
+}
+
+func TestMemoryRedeliversUncommitted(t *testing.T) {
+	memory := NewMemory()
+	assert.Nil(t, memory.Publish(&Message{Topic: "daily", Value: []byte("first")}, &Message{Topic: "daily", Value: []byte("second")}))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, memory.Subscribe(ctx, []string{"daily"}, func(ctx context.Context, msg *Message, done func(bool)) {
+		done(msg.Offset == 0)
+	}))
+	var redelivered []int64
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, memory.Subscribe(ctx, []string{"daily"}, func(ctx context.Context, msg *Message, done func(bool)) {
+		redelivered = append(redelivered, msg.Offset)
+		done(true)
+	}))
+	assert.Equal(t, []int64{1}, redelivered)
+}
+
+func TestMemoryClosed(t *testing.T) {
+	memory := NewMemory()
+	assert.Nil(t, memory.Close())
+	assert.Equal(t, ErrClosed, memory.Publish(&Message{Topic: "auth"}))
+	assert.Equal(t, ErrClosed, memory.Subscribe(context.Background(), []string{"auth"}, nil))
+}
@@ -0,0 +1,49 @@
+package broker
+
+import "sync"
+
+// offsetTracker keeps track of messages of one partition which are processed concurrently.
+// Messages can complete in any order, but the offset is committed only up to the first
+// message whose processing is not finished yet, so no message is lost after a crash
+// or rebalance.
+type offsetTracker struct {
+	mu sync.Mutex
+
+	// pending contains offsets of unfinished messages (and finished ones after them)
+	// in order of arrival.
+	pending []int64
+
+	// completed is a set of finished offsets which are still in pending.
+	completed map[int64]bool
+}
+
+// newOffsetTracker creates a new empty offsetTracker.
+func newOffsetTracker() *offsetTracker {
+	return &offsetTracker{completed: make(map[int64]bool)}
+}
+
+// add registers a message with given offset which processing has started.
+// Offsets must be added in increasing order.
+func (t *offsetTracker) add(offset int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending = append(t.pending, offset)
+}
+
+// complete marks the message with given offset as finished. If this allows to move
+// the committed position forward, complete returns the next offset to be consumed
+// (i.e. the offset to commit) and true.
+func (t *offsetTracker) complete(offset int64) (int64, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.completed[offset] = true
+	var next int64
+	advanced := false
+	for len(t.pending) > 0 && t.completed[t.pending[0]] {
+		next = t.pending[0] + 1
+		delete(t.completed, t.pending[0])
+		t.pending = t.pending[1:]
+		advanced = true
+	}
+	return next, advanced
+}
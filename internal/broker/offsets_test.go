@@ -0,0 +1,49 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOffsetTrackerInOrder(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.add(10)
+	tracker.add(11)
+	next, ok := tracker.complete(10)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(11), next)
+	}
+	next, ok = tracker.complete(11)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(12), next)
+	}
+}
+
+func TestOffsetTrackerOutOfOrder(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.add(10)
+	tracker.add(11)
+	tracker.add(12)
+	_, ok := tracker.complete(12)
+	assert.False(t, ok)
+	_, ok = tracker.complete(11)
+	assert.False(t, ok)
+	next, ok := tracker.complete(10)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(13), next)
+	}
+}
+
+func TestOffsetTrackerUnfinishedBlocksCommit(t *testing.T) {
+	tracker := newOffsetTracker()
+	tracker.add(1)
+	tracker.add(2)
+	tracker.add(3)
+	next, ok := tracker.complete(1)
+	if assert.True(t, ok) {
+		assert.Equal(t, int64(2), next)
+	}
+	_, ok = tracker.complete(3)
+	assert.False(t, ok)
+}
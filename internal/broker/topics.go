@@ -0,0 +1,40 @@
+package broker
+
+import "strings"
+
+// Topics maps logical topic names used by services (see shared_consts package) to names of
+// topics in the cluster, so several environments can share one cluster. A name is the logical
+// one with environment prefix, unless it is overridden.
+type Topics struct {
+	Prefix string
+
+	// Overrides contains cluster names of topics by their logical names. The prefix is not added to them.
+	Overrides map[string]string
+}
+
+// Name returns the name of topic in the cluster.
+func (t Topics) Name(topic string) string {
+	if name, ok := t.Overrides[topic]; ok {
+		return name
+	}
+	return t.Prefix + topic
+}
+
+// Names returns cluster names of given topics.
+func (t Topics) Names(topics []string) []string {
+	names := make([]string, len(topics))
+	for i, topic := range topics {
+		names[i] = t.Name(topic)
+	}
+	return names
+}
+
+// Logical returns the logical name of topic with given name in the cluster.
+func (t Topics) Logical(name string) string {
+	for topic, overridden := range t.Overrides {
+		if overridden == name {
+			return topic
+		}
+	}
+	return strings.TrimPrefix(name, t.Prefix)
+}
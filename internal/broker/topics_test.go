@@ -0,0 +1,17 @@
+package broker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopics(t *testing.T) {
+	topics := Topics{Prefix: "staging_", Overrides: map[string]string{"logs": "shared_logs"}}
+	assert.Equal(t, "staging_auth", topics.Name("auth"))
+	assert.Equal(t, "shared_logs", topics.Name("logs"))
+	assert.Equal(t, []string{"staging_auth", "staging_daily"}, topics.Names([]string{"auth", "daily"}))
+	assert.Equal(t, "auth", topics.Logical("staging_auth"))
+	assert.Equal(t, "logs", topics.Logical("shared_logs"))
+	assert.Equal(t, "daily", Topics{}.Logical("daily"))
+}
@@ -26,9 +26,25 @@ type Cache interface {
 	// Set creates a key-value pair in the cache with given expiration time.
 	Set(ctx context.Context, key, value string, expiration time.Duration) error
 
+	// SetNX creates a key-value pair in the cache with given expiration time
+	// only if the key does not exist. Returns true if the pair was created.
+	SetNX(ctx context.Context, key, value string, expiration time.Duration) (bool, error)
+
 	// Del deletes a key-value pair from the cache by given key.
 	Del(ctx context.Context, key string) error
 
+	// DelIfEqual atomically deletes a key-value pair from the cache only if the key has given value.
+	// Returns true if the pair was deleted.
+	DelIfEqual(ctx context.Context, key, value string) (bool, error)
+
+	// AddToSet atomically adds the member to the set stored by given key and sets
+	// expiration time of the whole set.
+	AddToSet(ctx context.Context, key, member string, expiration time.Duration) error
+
+	// SetMembers returns all members of the set stored by given key. If there is no set,
+	// an empty slice should be returned.
+	SetMembers(ctx context.Context, key string) ([]string, error)
+
 	// Close closes connection with the cache, releasing resources.
 	Close()
 }
@@ -74,11 +90,44 @@ func (rc *RedisCache) Set(ctx context.Context, key, value string, expiration tim
 	return rc.cache.Set(ctx, key, value, expiration).Err()
 }
 
+// SetNX creates a key-value pair in the cache if the key does not exist yet.
+func (rc *RedisCache) SetNX(ctx context.Context, key, value string, expiration time.Duration) (bool, error) {
+	return rc.cache.SetNX(ctx, key, value, expiration).Result()
+}
+
 // Del deletes a key-value pair from the Redis cache.
 func (rc *RedisCache) Del(ctx context.Context, key string) error {
 	return rc.cache.Del(ctx, key).Err()
 }
 
+// delIfEqualScript deletes the key only if it has the value, so e.g. a lock is released only by its' owner.
+const delIfEqualScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+
+// DelIfEqual deletes a key-value pair from the Redis cache if the key has given value.
+func (rc *RedisCache) DelIfEqual(ctx context.Context, key, value string) (bool, error) {
+	deleted, err := rc.cache.Eval(ctx, delIfEqualScript, []string{key}, value).Int()
+	if err != nil {
+		return false, err
+	}
+	return deleted == 1, nil
+}
+
+// AddToSet adds the member to the Redis set with SADD and renews its' expiration in one transaction,
+// so concurrent additions don't overwrite each other.
+func (rc *RedisCache) AddToSet(ctx context.Context, key, member string, expiration time.Duration) error {
+	_, err := rc.cache.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, key, member)
+		pipe.Expire(ctx, key, expiration)
+		return nil
+	})
+	return err
+}
+
+// SetMembers returns all members of the Redis set.
+func (rc *RedisCache) SetMembers(ctx context.Context, key string) ([]string, error) {
+	return rc.cache.SMembers(ctx, key).Result()
+}
+
 // Close closes connection with Redis cache.
 func (rc *RedisCache) Close() {
 	rc.cache.Close()
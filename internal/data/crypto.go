@@ -0,0 +1,219 @@
+package data
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedPrefix marks values encrypted by Keyring. Values without it are treated as plaintext
+	// written before the encryption was enabled.
+	encryptedPrefix = "enc:v1:"
+
+	// encryptionKeySize is the size of AES-256 keys (both key encryption and data keys).
+	encryptionKeySize = 32
+)
+
+// Keyring holds keys for envelope encryption of personal data. Every value is encrypted
+// with its own random data key, which is wrapped by one of keyring's key encryption keys.
+// The ID of the wrapping key is saved with the value, so after rotation old values are
+// still decrypted with the retired keys while new ones use the active key. Besides, keyring
+// computes deterministic blind indexes to look up encrypted values.
+type Keyring struct {
+	keys     map[string]cipher.AEAD
+	activeID string
+	indexKey []byte
+}
+
+// NewKeyringFromFile reads a key file and creates a Keyring. The file consists of lines:
+//
+//	index <base64 key>        - a key for blind indexes, must never change
+//	key <id> <base64 key>     - a key encryption key with given ID
+//	active <id>               - ID of the key used to encrypt new values
+//
+// All keys must be 32 bytes long. Empty lines and lines starting with '#' are ignored.
+func NewKeyringFromFile(keyFile string) (*Keyring, error) {
+	file, err := os.Open(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch {
+		case fields[0] == "index" && len(fields) == 2:
+			if k.indexKey, err = decodeKey(fields[1]); err != nil {
+				return nil, fmt.Errorf("Invalid index key at line %d: %v", lineNum, err)
+			}
+		case fields[0] == "key" && len(fields) == 3:
+			key, err := decodeKey(fields[2])
+			if err != nil {
+				return nil, fmt.Errorf("Invalid key %q at line %d: %v", fields[1], lineNum, err)
+			}
+			if k.keys[fields[1]], err = newGCM(key); err != nil {
+				return nil, err
+			}
+		case fields[0] == "active" && len(fields) == 2:
+			k.activeID = fields[1]
+		default:
+			return nil, fmt.Errorf("Invalid line %d in key file %q.", lineNum, keyFile)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.indexKey == nil {
+		return nil, fmt.Errorf("No index key in key file %q.", keyFile)
+	} else if _, ok := k.keys[k.activeID]; !ok {
+		return nil, fmt.Errorf("Active key %q is not defined in key file %q.", k.activeID, keyFile)
+	}
+	return k, nil
+}
+
+// decodeKey decodes base64 key and checks its' size.
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	} else if len(key) != encryptionKeySize {
+		return nil, fmt.Errorf("expected %d bytes key, got %d", encryptionKeySize, len(key))
+	}
+	return key, nil
+}
+
+// newGCM creates AES-GCM cipher with given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with AES-GCM, prepending random nonce to the result.
+func seal(aead cipher.AEAD, data []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, data, nil), nil
+}
+
+// open decrypts data sealed with seal.
+func open(aead cipher.AEAD, data []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("Encrypted value is too short.")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+}
+
+// Encrypt encrypts the value with a new data key and wraps the data key with the active key.
+// The result has format "enc:v1:<key ID>:<wrapped data key>:<ciphertext>".
+func (k *Keyring) Encrypt(value string) (string, error) {
+	dataKey := make([]byte, encryptionKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataAEAD, []byte(value))
+	if err != nil {
+		return "", err
+	}
+	wrappedKey, err := seal(k.keys[k.activeID], dataKey)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + k.activeID + ":" + base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt unwraps the data key of the value with the key referenced by ID and decrypts the value.
+// Values without encryption prefix are returned as is.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("Malformed encrypted value.")
+	}
+	keyAEAD, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("Unknown encryption key %q.", parts[0])
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := open(keyAEAD, wrappedKey)
+	if err != nil {
+		return "", err
+	}
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataAEAD, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// BlindIndex returns a deterministic keyed hash (HMAC-SHA256) of normalized email, which
+// allows to find the encrypted email by equality without decrypting it.
+func (k *Keyring) BlindIndex(email string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NicknameHasher computes keyed hashes (HMAC-SHA256) of nicknames, which refer to erased users
+// in tombstones and audit records. Nicknames are easy to guess, so without the secret key
+// the hashes can't be reversed by hashing known nicknames.
+type NicknameHasher struct {
+	key []byte
+}
+
+// NewNicknameHasherFromFile reads a base64 encoded 32 bytes key from the file and creates a NicknameHasher.
+// The key must never change, otherwise new hashes don't match the stored ones.
+func NewNicknameHasherFromFile(keyFile string) (*NicknameHasher, error) {
+	content, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := decodeKey(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid nickname key in key file %q: %v", keyFile, err)
+	}
+	return &NicknameHasher{key: key}, nil
+}
+
+// Hash returns hex-encoded keyed hash of the nickname.
+func (h *NicknameHasher) Hash(nickname string) string {
+	mac := hmac.New(sha256.New, h.key)
+	mac.Write([]byte(nickname))
+	return hex.EncodeToString(mac.Sum(nil))
+}
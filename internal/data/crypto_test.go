@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func testKey(b byte) string {
+	return base64.StdEncoding.EncodeToString([]byte(strings.Repeat(string(b), encryptionKeySize)))
+}
+
+func writeKeyFile(t *testing.T, lines ...string) string {
+	path := filepath.Join(t.TempDir(), "keys.txt")
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatalf("Unexpected error while writing key file: %v", err)
+	}
+	return path
+}
+
+func TestKeyringEncryptDecrypt(t *testing.T) {
+	keyring, err := NewKeyringFromFile(writeKeyFile(t, "# test keys", "index "+testKey('i'), "key k1 "+testKey('a'), "active k1"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	testEmail := "arbuz@gmail.com"
+	encrypted, err := keyring.Encrypt(testEmail)
+	if assert.Nil(t, err) {
+		assert.True(t, strings.HasPrefix(encrypted, encryptedPrefix+"k1:"))
+		assert.NotContains(t, encrypted, testEmail)
+		decrypted, err := keyring.Decrypt(encrypted)
+		if assert.Nil(t, err) {
+			assert.Equal(t, testEmail, decrypted)
+		}
+	}
+	plaintext, err := keyring.Decrypt(testEmail)
+	if assert.Nil(t, err) {
+		assert.Equal(t, testEmail, plaintext)
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+	oldKeyring, err := NewKeyringFromFile(writeKeyFile(t, "index "+testKey('i'), "key k1 "+testKey('a'), "active k1"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	newKeyring, err := NewKeyringFromFile(writeKeyFile(t, "index "+testKey('i'), "key k1 "+testKey('a'),
+		"key k2 "+testKey('b'), "active k2"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	encrypted, err := oldKeyring.Encrypt("old@example.com")
+	if assert.Nil(t, err) {
+		decrypted, err := newKeyring.Decrypt(encrypted)
+		if assert.Nil(t, err) {
+			assert.Equal(t, "old@example.com", decrypted)
+		}
+	}
+	encrypted, err = newKeyring.Encrypt("new@example.com")
+	if assert.Nil(t, err) {
+		assert.True(t, strings.HasPrefix(encrypted, encryptedPrefix+"k2:"))
+		_, err = oldKeyring.Decrypt(encrypted)
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, oldKeyring.BlindIndex("Old@Example.com"), newKeyring.BlindIndex("old@example.com"))
+}
+
+func TestNewKeyringFromFileInvalid(t *testing.T) {
+	_, err := NewKeyringFromFile(writeKeyFile(t, "index "+testKey('i'), "key k1 "+testKey('a'), "active k2"))
+	assert.NotNil(t, err)
+	_, err = NewKeyringFromFile(writeKeyFile(t, "key k1 "+testKey('a'), "active k1"))
+	assert.NotNil(t, err)
+	_, err = NewKeyringFromFile(writeKeyFile(t, "index "+testKey('i'), "key k1 c2hvcnQ=", "active k1"))
+	assert.NotNil(t, err)
+}
+
+// testNicknameHasher hashes nicknames in tests of erasure.
+var testNicknameHasher = &NicknameHasher{key: []byte(strings.Repeat("n", encryptionKeySize))}
+
+func TestNicknameHasher(t *testing.T) {
+	hasher, err := NewNicknameHasherFromFile(writeKeyFile(t, testKey('n')+"\n"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	hash := hasher.Hash("arbuz")
+	assert.Equal(t, testNicknameHasher.Hash("arbuz"), hash)
+	assert.Len(t, hash, 64)
+	other, err := NewNicknameHasherFromFile(writeKeyFile(t, testKey('m')))
+	if assert.Nil(t, err) {
+		assert.NotEqual(t, hash, other.Hash("arbuz"))
+	}
+	_, err = NewNicknameHasherFromFile(writeKeyFile(t, "c2hvcnQ="))
+	assert.NotNil(t, err)
+}
+
+func TestEraseUserWithoutNicknameKey(t *testing.T) {
+	db, _, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	_, err = pdb.EraseUser(context.Background(), "arbuz")
+	assert.NotNil(t, err)
+	assert.NotNil(t, pdb.InsertAuditRecord(context.Background(), AuditRecord{Nickname: "arbuz"}))
+}
+
+func TestInsertUserEncrypted(t *testing.T) {
+	keyring, err := NewKeyringFromFile(writeKeyFile(t, "index "+testKey('i'), "key k1 "+testKey('a'), "active k1"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db, keyring: keyring}
+	testUser := User{Nickname: "Newbie", Email: "nwb@example.com"}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Users (nickname, email, email_index, language) VALUES ($1, $2, $3, $4)`)).
+		WithArgs(testUser.Nickname, sqlmock.AnyArg(), keyring.BlindIndex(testUser.Email), testUser.Language).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)`)).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectCommit()
+	affected, err := pdb.InsertUser(context.Background(), testUser)
+	if assert.Nil(t, err) {
+		assert.True(t, affected)
+		assert.Nil(t, dbMock.ExpectationsWereMet())
+	}
+}
+
+// encryptedArg matches values encrypted by Keyring.
+type encryptedArg struct{}
+
+func (encryptedArg) Match(v driver.Value) bool {
+	value, ok := v.(string)
+	return ok && strings.HasPrefix(value, encryptedPrefix)
+}
+
+func TestMigrateEmailsEncrypted(t *testing.T) {
+	keyring, err := NewKeyringFromFile(writeKeyFile(t, "index "+testKey('i'), "key k1 "+testKey('a'), "active k1"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db, keyring: keyring}
+	encrypted, err := keyring.Encrypt("old@example.com")
+	if !assert.Nil(t, err) {
+		return
+	}
+	rows := sqlmock.NewRows([]string{"nickname", "email"}).AddRow("plain", "plain@example.com").AddRow("old", encrypted)
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT nickname, email FROM Users WHERE email_index IS NULL OR email NOT LIKE 'enc:v1:%'`)).
+		WillReturnRows(rows)
+	dbMock.ExpectExec(regexp.QuoteMeta(`UPDATE Users SET email=$1, email_index=$2 WHERE nickname=$3`)).
+		WithArgs(encryptedArg{}, keyring.BlindIndex("plain@example.com"), "plain").WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`UPDATE Users SET email=$1, email_index=$2 WHERE nickname=$3`)).
+		WithArgs(encryptedArg{}, keyring.BlindIndex("old@example.com"), "old").WillReturnResult(sqlmock.NewResult(0, 1))
+	if assert.Nil(t, pdb.migrateEmails(context.Background())) {
+		assert.Nil(t, dbMock.ExpectationsWereMet())
+	}
+}
@@ -6,18 +6,38 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"strings"
+	"sync"
 	"time"
 
 	_ "github.com/lib/pq"
+	"golang.org/x/sync/singleflight"
 )
 
 const (
-	keySize                       = 128              // authentication key size
-	authExpiration  time.Duration = 15 * time.Minute // auth method info expiration time in cache
-	cacheExpiration time.Duration = time.Minute      // other info expiration time
-	connectTimeout  time.Duration = time.Second      // contextual timeout for connections to DB and cache
-	connectAttempts               = 4                // amount of attempts for connections
-	ListUsersKey                  = "UsersList"      // key for cache to get the list of users
+	keySize                             = 128                     // authentication key size
+	authExpiration        time.Duration = 15 * time.Minute        // auth method info expiration time in cache
+	cacheExpiration       time.Duration = time.Minute             // other info expiration time
+	connectTimeout        time.Duration = time.Second             // contextual timeout for connections to DB and cache
+	connectAttempts                     = 4                       // amount of attempts for connections
+	ListUsersKey                        = "UsersList"             // key for cache to get the list of users
+	operationsIndexPrefix               = "operations:"           // prefix of cache keys with user's pending operation keys
+	staleListUsersKey                   = ListUsersKey + ":stale" // key for cache to get the previous list of users
+	listUsersLockKey                    = ListUsersKey + ":lock"  // key for cache to lock rebuilding of the list of users
+	staleExpiration       time.Duration = 10 * cacheExpiration    // expiration time of the previous list of users
+	lockExpiration        time.Duration = 5 * time.Second         // expiration time of the rebuilding lock
+	lockWaitStep          time.Duration = 50 * time.Millisecond   // interval of checking cache while another caller rebuilds it
+	lockTokenSize                       = 16                      // size of random token identifying the holder of rebuilding lock
+	rebuildTimeout        time.Duration = 2 * lockExpiration      // contextual timeout for rebuilding the list of users
+)
+
+// Event* consts are the kinds of events saved in user's history.
+const (
+	EventSubscribed     = "SUBSCRIBED"
+	EventUnsubscribed   = "UNSUBSCRIBED"
+	EventDailyPublished = "DAILY_PUBLISHED"
+	EventEmailChanged   = "EMAIL_CHANGED"
+	EventPaused         = "PAUSED"
+	EventResumed        = "RESUMED"
 )
 
 // Data manipulates data in both database in cache, allowing to add,
@@ -34,10 +54,10 @@ type Data interface {
 	// executed.
 	GetOperation(ctx context.Context, key string) (*Operation, error)
 
-	// SetOperation creates an Operation instance using passed user and method values,
-	// then generates a key which is used to write the operation into cache.
+	// SetOperation creates an Operation instance of current version using passed user, method
+	// and method's parameters, then generates a key which is used to write the operation into cache.
 	// If SetOperation succeeds, it will return generated key.
-	SetOperation(ctx context.Context, user User, method string) (string, error)
+	SetOperation(ctx context.Context, user User, method OperationKind, params map[string]string) (string, error)
 
 	// CheckNicknameInDatabase selects all rows from database with given nickname and
 	// returns true if there are any records.
@@ -47,6 +67,10 @@ type Data interface {
 	// no nickname in database, returns empty string.
 	GetEmailByNickname(ctx context.Context, nickname string) (string, error)
 
+	// GetLanguageByNickname returns the preferred language of emails of user with given nickname.
+	// If the language isn't set or there is no such nickname, returns empty string.
+	GetLanguageByNickname(ctx context.Context, nickname string) (string, error)
+
 	// AddUserToDatabase adds new record to database using given user.
 	AddUserToDatabase(ctx context.Context, user User) error
 
@@ -56,31 +80,188 @@ type Data interface {
 	// GetUsersFromDatabase transforms all records from database to slice of User structs
 	// and returns it.
 	GetUsersFromDatabase(ctx context.Context) ([]User, error)
+
+	// LogDelivery saves the fact of publishing a daily message for user with given nickname
+	// into the user's history.
+	LogDelivery(ctx context.Context, nickname string) error
+
+	// GetUserData collects everything stored about the user with given nickname.
+	// If there is no such user, returns nil UserData.
+	GetUserData(ctx context.Context, nickname string) (*UserData, error)
+
+	// EraseUser removes all data of the user with given nickname from database and cache,
+	// including pending operations, and leaves a tombstone instead. Returns true if
+	// the user existed.
+	EraseUser(ctx context.Context, nickname string) (bool, error)
+
+	// GetUnpublishedEvents returns up to limit outbox events which are waiting to be published
+	// to message broker, in order of their creation.
+	GetUnpublishedEvents(ctx context.Context, limit int) ([]OutboxEvent, error)
+
+	// MarkEventsPublished marks outbox events with given IDs as published.
+	MarkEventsPublished(ctx context.Context, ids []int64) error
+
+	// AddAuditRecord saves a record about administrative action upon a user.
+	AddAuditRecord(ctx context.Context, record AuditRecord) error
+
+	// ChangeUserEmail replaces the email of user with given nickname.
+	ChangeUserEmail(ctx context.Context, nickname, newEmail string) error
+
+	// SetUserPaused pauses (or resumes) daily delivery for user with given nickname.
+	SetUserPaused(ctx context.Context, nickname string, paused bool) error
+
+	// StartDeliveryRun saves the start of delivery run with given ID for total amount of users and returns
+	// the set of nicknames, for whom the run's message is already published (if the run is resumed).
+	StartDeliveryRun(ctx context.Context, runID string, total int) (map[string]bool, error)
+
+	// CheckpointDelivery saves whether the daily message of delivery run was published for user
+	// with given nickname.
+	CheckpointDelivery(ctx context.Context, runID, nickname string, published bool) error
+
+	// FinishDeliveryRun saves the end of delivery run.
+	FinishDeliveryRun(ctx context.Context, runID string) error
+
+	// GetDeliveryRun returns the progress of delivery run with given ID. If there is no such run,
+	// returns nil DeliveryRun.
+	GetDeliveryRun(ctx context.Context, runID string) (*DeliveryRun, error)
+
+	// GetUnfinishedDeliveryRuns returns IDs of delivery runs, which were interrupted, in order of their start.
+	GetUnfinishedDeliveryRuns(ctx context.Context) ([]string, error)
+
+	// RecordDeliveryReceipt saves the receipt into the user's delivery history and updates the user's
+	// delivery status. Returns false if the receipt was already recorded or the user doesn't exist.
+	RecordDeliveryReceipt(ctx context.Context, receipt DeliveryReceipt) (bool, error)
 }
 
 // dataHandler implements Data interface and used as its basic implementation.
 type dataHandler struct {
 	cache Cache
 	db    DB
+
+	// usersListGroup coalesces concurrent rebuilds of the cached users list in this process.
+	usersListGroup singleflight.Group
+
+	// rebuildLock enables distributed lock in cache for rebuilding the users list, so
+	// only one process queries database while others serve the previous list.
+	rebuildLock bool
+
+	// lockToken is the token of the rebuilding lock held by this process, or empty string if the lock
+	// is not held. It is guarded by lockTokenMu.
+	lockToken   string
+	lockTokenMu sync.Mutex
+
+	// keyring encrypts cached values containing emails. If it is nil, values are cached as plaintext.
+	keyring *Keyring
+}
+
+// Option configures optional behaviour of Data created by NewData.
+type Option func(*dataHandler)
+
+// WithRebuildLock makes Data use a lock in cache when the users list is rebuilt after
+// expiration. While one caller rebuilds the list, others get the previous (stale) value.
+func WithRebuildLock() Option {
+	return func(d *dataHandler) {
+		d.rebuildLock = true
+	}
 }
 
 // User represents a user with certain nickname and email.
 type User struct {
 	Nickname string `json:"nickname"`
 	Email    string `json:"email"`
+
+	// Language is the preferred language of user's emails (e.g. "ru"). Empty means the default one.
+	Language string `json:"language,omitempty"`
+}
+
+// HistoryRecord represents an event from user's history.
+type HistoryRecord struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
 }
 
+// UserData is a bundle of all data stored about a user.
+type UserData struct {
+	User           User              `json:"user"`
+	History        []HistoryRecord   `json:"history"`
+	Deliveries     []HistoryRecord   `json:"deliveries"`
+	DeliveryStatus DeliveryStatus    `json:"delivery_status"`
+	Receipts       []DeliveryReceipt `json:"receipts"`
+}
+
+// AuditActionImportWithConsent is the audit action of adding a user by administrator
+// without confirmation email, because the user's consent was given beforehand.
+const AuditActionImportWithConsent = "IMPORT_WITH_CONSENT"
+
+// AuditRecord represents an administrative action upon a user.
+type AuditRecord struct {
+	Actor    string
+	Action   string
+	Nickname string
+}
+
+// OperationKind defines a kind of confirmable method which is executed upon user.
+type OperationKind string
+
+// Operation* consts are the kinds of operations.
+const (
+	OperationAdd         OperationKind = "ADD"
+	OperationDelete      OperationKind = "DELETE"
+	OperationChangeEmail OperationKind = "CHANGE_EMAIL"
+	OperationPause       OperationKind = "PAUSE"
+	OperationExport      OperationKind = "EXPORT"
+)
+
+// OperationVersion is the current version of Operation structure. Operations cached
+// before versioning have zero version.
+const OperationVersion = 1
+
 // Operation represents a method which will be executed
 // upon user
 type Operation struct {
-	User   User   `json:"user"`
-	Method string `json:"method"`
+	User      User              `json:"user"`
+	Method    OperationKind     `json:"method"`
+	Params    map[string]string `json:"params,omitempty"`
+	Version   int               `json:"version"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// WithKeyring makes Data encrypt cached values which contain emails (nickname entries, users
+// list and pending operations) with given keyring.
+func WithKeyring(keyring *Keyring) Option {
+	return func(d *dataHandler) {
+		d.keyring = keyring
+	}
 }
 
 // NewData creates a new Data instance using given Cache
 // and DB.
-func NewData(cache Cache, db DB) Data {
-	return &dataHandler{cache, db}
+func NewData(cache Cache, db DB, opts ...Option) Data {
+	d := &dataHandler{cache: cache, db: db}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// getSealed gets a value from cache and decrypts it, if the keyring is set.
+func (d *dataHandler) getSealed(ctx context.Context, key string) (string, error) {
+	value, err := d.cache.Get(ctx, key)
+	if err != nil || d.keyring == nil {
+		return value, err
+	}
+	return d.keyring.Decrypt(value)
+}
+
+// setSealed encrypts a value, if the keyring is set, and puts it into cache.
+func (d *dataHandler) setSealed(ctx context.Context, key, value string, expiration time.Duration) error {
+	if d.keyring != nil {
+		var err error
+		if value, err = d.keyring.Encrypt(value); err != nil {
+			return err
+		}
+	}
+	return d.cache.Set(ctx, key, value, expiration)
 }
 
 // Disconnect closes connections to database and cache.
@@ -92,7 +273,7 @@ func (d *dataHandler) Disconnect() {
 // GetOperation gets JSON formatted value from cache by given key and returns decoded
 // data as Operation struct. If there is no such key in cache, return empty Operation struct.
 func (d *dataHandler) GetOperation(ctx context.Context, key string) (*Operation, error) {
-	jsonData, err := d.cache.Get(ctx, key)
+	jsonData, err := d.getSealed(ctx, key)
 	if err != nil {
 		if err == CacheNil {
 			return &Operation{}, nil
@@ -108,11 +289,11 @@ func (d *dataHandler) GetOperation(ctx context.Context, key string) (*Operation,
 	return &opn, nil
 }
 
-// SetOperation composes given User and method into Operation, then encodes it into JSON formatted
+// SetOperation composes given User, method and parameters into Operation, then encodes it into JSON formatted
 // string. After this a base64-encoded key is generated randomly. Then JSON string is inserted
 // into cache by the key.
-func (d *dataHandler) SetOperation(ctx context.Context, user User, method string) (string, error) {
-	opn := Operation{user, method}
+func (d *dataHandler) SetOperation(ctx context.Context, user User, method OperationKind, params map[string]string) (string, error) {
+	opn := Operation{User: user, Method: method, Params: params, Version: OperationVersion, CreatedAt: time.Now().UTC()}
 	buf := new(strings.Builder)
 	err := json.NewEncoder(buf).Encode(&opn)
 	if err != nil {
@@ -124,13 +305,22 @@ func (d *dataHandler) SetOperation(ctx context.Context, user User, method string
 		return "", err
 	}
 	key := base64.URLEncoding.EncodeToString(keyBuf)
-	err = d.cache.Set(ctx, key, buf.String(), authExpiration)
+	err = d.setSealed(ctx, key, buf.String(), authExpiration)
 	if err != nil {
 		return "", err
 	}
+	if err = d.indexOperation(ctx, user.Nickname, key); err != nil {
+		return "", err
+	}
 	return key, nil
 }
 
+// indexOperation adds the key of a pending operation to the set of user's operation keys,
+// so the operations can be found and removed on the user's erasure.
+func (d *dataHandler) indexOperation(ctx context.Context, nickname, key string) error {
+	return d.cache.AddToSet(ctx, operationsIndexPrefix+nickname, key, authExpiration)
+}
+
 // CheckNicknameInDatabase checks whether the nickname in database or no. In first place, it
 // checks cache. If there is no nickname in cache, the search continues in database. The database
 // result is cached and returned.
@@ -146,13 +336,13 @@ func (d *dataHandler) CheckNicknameInDatabase(ctx context.Context, nickname stri
 // If there is no nickname in cache, the search continues in database. The database is cached.
 // If no such nickname found in database or cache, returns empty string.
 func (d *dataHandler) GetEmailByNickname(ctx context.Context, nickname string) (string, error) {
-	email, err := d.cache.Get(ctx, nickname)
+	email, err := d.getSealed(ctx, nickname)
 	if err == CacheNil {
 		email, err := d.db.GetEmailByNickname(ctx, nickname)
 		if err != nil {
 			return "", err
 		}
-		d.cache.Set(ctx, nickname, email, cacheExpiration)
+		d.setSealed(ctx, nickname, email, cacheExpiration)
 		return email, nil
 	} else if err != nil {
 		return "", err
@@ -160,48 +350,146 @@ func (d *dataHandler) GetEmailByNickname(ctx context.Context, nickname string) (
 	return email, nil
 }
 
-// AddUserToDatabase adds new user record into database. It also deletes record with ListUsersKey
-// from cache because its' value is outdated (if the insertion succeeds).
+// GetLanguageByNickname gets the language of user with given nickname from database.
+func (d *dataHandler) GetLanguageByNickname(ctx context.Context, nickname string) (string, error) {
+	return d.db.GetLanguageByNickname(ctx, nickname)
+}
+
+// AddUserToDatabase adds new user record into database. It also deletes the cached users list
+// because its' value is outdated (if the insertion succeeds).
 func (d *dataHandler) AddUserToDatabase(ctx context.Context, user User) error {
 	var affectedRows bool
 	var err error
 	if affectedRows, err = d.db.InsertUser(ctx, user); err == nil && affectedRows {
-		d.cache.Del(ctx, ListUsersKey)
+		d.invalidateUsersList(ctx)
+		err = d.db.InsertHistoryRecord(ctx, user.Nickname, EventSubscribed)
 	}
 	return err
 }
 
 // DeleteUserFromDatabase deletes records of user from database. In case of success, it also
-// deletes record with ListUsersKey from cache because its' value is outdated.
+// deletes the cached users list because its' value is outdated.
 func (d *dataHandler) DeleteUserFromDatabase(ctx context.Context, user User) error {
 	var affectedRows bool
 	var err error
 	if affectedRows, err = d.db.DeleteUser(ctx, user); err == nil && affectedRows {
-		d.cache.Del(ctx, ListUsersKey)
+		d.invalidateUsersList(ctx)
+		err = d.db.InsertHistoryRecord(ctx, user.Nickname, EventUnsubscribed)
 	}
 	return err
 }
 
 // GetUsersFromDatabase gets all users records from database or cache and returns them as
-// User slice
+// User slice. Concurrent calls, which didn't find the list in cache, share one rebuild of it.
+// The rebuild runs with its' own timeout, so a cancelled caller doesn't fail the others.
 func (d *dataHandler) GetUsersFromDatabase(ctx context.Context) ([]User, error) {
-	var usersList []User
-	jsonData, err := d.cache.Get(ctx, ListUsersKey)
+	jsonData, err := d.getSealed(ctx, ListUsersKey)
 	if err == CacheNil {
-		if usersList, err = d.cacheMiss(ctx); err != nil {
-			return nil, err
+		resultChan := d.usersListGroup.DoChan(ListUsersKey, func() (interface{}, error) {
+			rebuildCtx, cancel := context.WithTimeout(context.Background(), rebuildTimeout)
+			defer cancel()
+			if d.rebuildLock {
+				return d.lockedCacheMiss(rebuildCtx)
+			}
+			return d.cacheMiss(rebuildCtx)
+		})
+		select {
+		case result := <-resultChan:
+			if result.Err != nil {
+				return nil, result.Err
+			}
+			return result.Val.([]User), nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	} else if err != nil {
 		return nil, err
-	} else if err := json.NewDecoder(strings.NewReader(jsonData)).Decode(&usersList); err != nil {
+	}
+	return decodeUsersList(jsonData)
+}
+
+// decodeUsersList decodes JSON formatted users list.
+func decodeUsersList(jsonData string) ([]User, error) {
+	var usersList []User
+	if err := json.NewDecoder(strings.NewReader(jsonData)).Decode(&usersList); err != nil {
 		return nil, err
 	}
 	return usersList, nil
 }
 
+// lockedCacheMiss is called instead of cacheMiss if the rebuild lock is enabled. It tries to take the lock
+// in cache and rebuild the list. The lock holds a random token, so it is released only by its' holder, even if
+// it has expired and was taken by another caller. If the lock is taken by another caller, it returns the stale
+// list. If there is no stale list, it waits for the list to be rebuilt and, if the lock expires, queries
+// database itself.
+func (d *dataHandler) lockedCacheMiss(ctx context.Context) ([]User, error) {
+	tokenBuf := make([]byte, lockTokenSize)
+	if _, err := rand.Read(tokenBuf); err != nil {
+		return nil, err
+	}
+	token := base64.URLEncoding.EncodeToString(tokenBuf)
+	locked, err := d.cache.SetNX(ctx, listUsersLockKey, token, lockExpiration)
+	if err != nil {
+		return nil, err
+	}
+	if locked {
+		d.setLockToken(token)
+		defer func() {
+			d.setLockToken("")
+			d.cache.DelIfEqual(ctx, listUsersLockKey, token)
+		}()
+		return d.cacheMiss(ctx)
+	}
+	if jsonData, err := d.getSealed(ctx, staleListUsersKey); err == nil {
+		return decodeUsersList(jsonData)
+	} else if err != CacheNil {
+		return nil, err
+	}
+	for waited := time.Duration(0); waited < lockExpiration; waited += lockWaitStep {
+		select {
+		case <-time.After(lockWaitStep):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if jsonData, err := d.getSealed(ctx, ListUsersKey); err == nil {
+			return decodeUsersList(jsonData)
+		} else if err != CacheNil {
+			return nil, err
+		}
+	}
+	return d.cacheMiss(ctx)
+}
+
+// setLockToken remembers the token of the rebuilding lock held by this process.
+func (d *dataHandler) setLockToken(token string) {
+	d.lockTokenMu.Lock()
+	defer d.lockTokenMu.Unlock()
+	d.lockToken = token
+}
+
+// invalidateUsersList deletes the cached list of users together with its' stale copy after the list was
+// changed in database, so outdated list (e.g. with unsubscribed users) is never returned. The rebuilding
+// lock is released too, but only if it is held by this process, so a lock of another caller is kept.
+func (d *dataHandler) invalidateUsersList(ctx context.Context) error {
+	for _, key := range []string{ListUsersKey, staleListUsersKey} {
+		if err := d.cache.Del(ctx, key); err != nil {
+			return err
+		}
+	}
+	d.lockTokenMu.Lock()
+	token := d.lockToken
+	d.lockTokenMu.Unlock()
+	if token == "" {
+		return nil
+	}
+	_, err := d.cache.DelIfEqual(ctx, listUsersLockKey, token)
+	return err
+}
+
 // cacheMiss is called when GetUsersFromDatabase didn't found record with ListUsersKey in cache.
 // It selects all rows from database and inserts them into User slice, then encodes the slice
-// into JSON string and adds it into cache. After this cacheMiss returns created User slice.
+// into JSON string and adds it into cache, also saving a longer living stale copy. After this
+// cacheMiss returns created User slice.
 func (d *dataHandler) cacheMiss(ctx context.Context) ([]User, error) {
 	usersList, err := d.db.SelectAllUsers(ctx)
 	if err != nil {
@@ -211,8 +499,166 @@ func (d *dataHandler) cacheMiss(ctx context.Context) ([]User, error) {
 	if err := json.NewEncoder(buf).Encode(&usersList); err != nil {
 		return nil, err
 	}
-	if err := d.cache.Set(ctx, ListUsersKey, buf.String(), cacheExpiration); err != nil {
+	if err := d.setSealed(ctx, ListUsersKey, buf.String(), cacheExpiration); err != nil {
+		return nil, err
+	}
+	if err := d.setSealed(ctx, staleListUsersKey, buf.String(), staleExpiration); err != nil {
 		return nil, err
 	}
 	return usersList, nil
 }
+
+// LogDelivery inserts a record about published daily message into user's history.
+func (d *dataHandler) LogDelivery(ctx context.Context, nickname string) error {
+	return d.db.InsertHistoryRecord(ctx, nickname, EventDailyPublished)
+}
+
+// GetUserData gets user's record, history and delivery receipts from database and composes them into UserData.
+// The records about daily messages are separated from other history into deliveries log.
+func (d *dataHandler) GetUserData(ctx context.Context, nickname string) (*UserData, error) {
+	email, err := d.db.GetEmailByNickname(ctx, nickname)
+	if err != nil {
+		return nil, err
+	} else if email == "" {
+		return nil, nil
+	}
+	history, err := d.db.SelectHistory(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+	status, err := d.db.SelectDeliveryStatus(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := d.db.SelectDeliveryReceipts(ctx, nickname)
+	if err != nil {
+		return nil, err
+	}
+	if receipts == nil {
+		receipts = []DeliveryReceipt{}
+	}
+	userData := &UserData{User: User{Nickname: nickname, Email: email}, History: []HistoryRecord{},
+		Deliveries: []HistoryRecord{}, DeliveryStatus: status, Receipts: receipts}
+	for _, record := range history {
+		if record.Event == EventDailyPublished {
+			userData.Deliveries = append(userData.Deliveries, record)
+		} else {
+			userData.History = append(userData.History, record)
+		}
+	}
+	return userData, nil
+}
+
+// EraseUser removes user's records from database, then deletes all cached data related to the user:
+// nickname entry, users list and pending operations.
+func (d *dataHandler) EraseUser(ctx context.Context, nickname string) (bool, error) {
+	existed, err := d.db.EraseUser(ctx, nickname)
+	if err != nil {
+		return false, err
+	}
+	indexKey := operationsIndexPrefix + nickname
+	keys, err := d.cache.SetMembers(ctx, indexKey)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		if err := d.cache.Del(ctx, key); err != nil {
+			return false, err
+		}
+	}
+	for _, key := range []string{indexKey, nickname} {
+		if err := d.cache.Del(ctx, key); err != nil {
+			return false, err
+		}
+	}
+	if err := d.invalidateUsersList(ctx); err != nil {
+		return false, err
+	}
+	return existed, nil
+}
+
+// GetUnpublishedEvents selects unpublished outbox events from database.
+func (d *dataHandler) GetUnpublishedEvents(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	return d.db.SelectUnpublishedEvents(ctx, limit)
+}
+
+// MarkEventsPublished marks outbox events as published in database.
+func (d *dataHandler) MarkEventsPublished(ctx context.Context, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	return d.db.MarkEventsPublished(ctx, ids)
+}
+
+// AddAuditRecord inserts audit record into database.
+func (d *dataHandler) AddAuditRecord(ctx context.Context, record AuditRecord) error {
+	return d.db.InsertAuditRecord(ctx, record)
+}
+
+// ChangeUserEmail updates user's email in database. In case of success, it also deletes outdated
+// cached nickname entry and users list.
+func (d *dataHandler) ChangeUserEmail(ctx context.Context, nickname, newEmail string) error {
+	affectedRows, err := d.db.UpdateEmail(ctx, nickname, newEmail)
+	if err != nil || !affectedRows {
+		return err
+	}
+	d.cache.Del(ctx, nickname)
+	d.invalidateUsersList(ctx)
+	return d.db.InsertHistoryRecord(ctx, nickname, EventEmailChanged)
+}
+
+// SetUserPaused updates user's pause flag in database. In case of success, it also deletes outdated
+// users list from cache.
+func (d *dataHandler) SetUserPaused(ctx context.Context, nickname string, paused bool) error {
+	affectedRows, err := d.db.SetPaused(ctx, nickname, paused)
+	if err != nil || !affectedRows {
+		return err
+	}
+	d.invalidateUsersList(ctx)
+	event := EventResumed
+	if paused {
+		event = EventPaused
+	}
+	return d.db.InsertHistoryRecord(ctx, nickname, event)
+}
+
+// StartDeliveryRun inserts delivery run into database, then selects users with already published messages.
+func (d *dataHandler) StartDeliveryRun(ctx context.Context, runID string, total int) (map[string]bool, error) {
+	if err := d.db.InsertDeliveryRun(ctx, runID, total); err != nil {
+		return nil, err
+	}
+	nicknames, err := d.db.SelectPublishedNicknames(ctx, runID)
+	if err != nil {
+		return nil, err
+	}
+	published := make(map[string]bool, len(nicknames))
+	for _, nickname := range nicknames {
+		published[nickname] = true
+	}
+	return published, nil
+}
+
+// CheckpointDelivery saves the user's checkpoint of delivery run in database.
+func (d *dataHandler) CheckpointDelivery(ctx context.Context, runID, nickname string, published bool) error {
+	return d.db.UpsertDeliveryCheckpoint(ctx, runID, nickname, published)
+}
+
+// FinishDeliveryRun saves the end time of delivery run in database.
+func (d *dataHandler) FinishDeliveryRun(ctx context.Context, runID string) error {
+	return d.db.FinishDeliveryRun(ctx, runID)
+}
+
+// GetDeliveryRun selects delivery run from database.
+func (d *dataHandler) GetDeliveryRun(ctx context.Context, runID string) (*DeliveryRun, error) {
+	return d.db.SelectDeliveryRun(ctx, runID)
+}
+
+// GetUnfinishedDeliveryRuns selects IDs of unfinished delivery runs from database.
+func (d *dataHandler) GetUnfinishedDeliveryRuns(ctx context.Context) ([]string, error) {
+	return d.db.SelectUnfinishedDeliveryRuns(ctx)
+}
+
+// RecordDeliveryReceipt inserts the receipt into database.
+func (d *dataHandler) RecordDeliveryReceipt(ctx context.Context, receipt DeliveryReceipt) (bool, error) {
+	return d.db.InsertDeliveryReceipt(ctx, receipt)
+}
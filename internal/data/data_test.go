@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -24,7 +26,7 @@ func TestGetOperationExistingKey(t *testing.T) {
 	defer cancel()
 	operation, err := d.GetOperation(ctx, key)
 	if assert.Nil(t, err) {
-		assert.Equal(t, Operation{User{"arbuz", "arbuz@gmail.com"}, "DELETE"}, *operation)
+		assert.Equal(t, Operation{User: User{Nickname: "arbuz", Email: "arbuz@gmail.com"}, Method: OperationDelete}, *operation)
 	}
 }
 
@@ -45,31 +47,36 @@ func TestGetOperationNonexistingKey(t *testing.T) {
 func TestSetOperationSuccess(t *testing.T) {
 	cache, cacheMock := redismock.NewClientMock()
 	cacheMock = cacheMock.Regexp()
-	user := User{"arbuzich", "myemail@example.com"}
-	method := "ADD"
-	opn := Operation{user, method}
-	buf := new(strings.Builder)
-	err := json.NewEncoder(buf).Encode(&opn)
-	jsonData := buf.String()
-	if err != nil {
-		t.Fatalf("Unexpected error while encoding Operation struct: %v", err)
-	}
+	user := User{Nickname: "arbuzich", Email: "myemail@example.com"}
+	method := OperationAdd
+	params := map[string]string{"foo": "bar"}
+	jsonPattern := regexp.QuoteMeta(`{"user":{"nickname":"arbuzich","email":"myemail@example.com"},"method":"ADD",`+
+		`"params":{"foo":"bar"},"version":1,"created_at":"`) + `[^"]+"\}`
 	regexpStr := fmt.Sprintf(`.[%d]`, keySize)
-	cacheMock.ExpectSet(regexpStr, jsonData, authExpiration).SetVal("Success")
+	cacheMock.ExpectSet(regexpStr, jsonPattern, authExpiration).SetVal("Success")
+	cacheMock.ExpectTxPipeline()
+	cacheMock.ExpectSAdd(operationsIndexPrefix+user.Nickname, regexpStr).SetVal(1)
+	cacheMock.ExpectExpire(operationsIndexPrefix+user.Nickname, authExpiration).SetVal(true)
+	cacheMock.ExpectTxPipelineExec()
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	key, err := d.SetOperation(ctx, user, method)
+	key, err := d.SetOperation(ctx, user, method, params)
 	pattern := regexp.MustCompile(regexpStr)
 	if assert.Nil(t, err) {
 		assert.True(t, pattern.MatchString(key))
 	}
-	cacheMock.ExpectGet(key).SetVal(jsonData)
-	resultString, err := d.cache.Get(ctx, key)
+	cacheMock.ExpectGet(key).SetVal(`{"user":{"nickname":"arbuzich","email":"myemail@example.com"},"method":"ADD",` +
+		`"params":{"foo":"bar"},"version":1,"created_at":"2022-10-01T12:00:00Z"}`)
+	opn, err := d.GetOperation(ctx, key)
 	if assert.Nil(t, err) {
-		assert.Equal(t, jsonData, resultString)
+		assert.Equal(t, user, opn.User)
+		assert.Equal(t, method, opn.Method)
+		assert.Equal(t, params, opn.Params)
+		assert.Equal(t, OperationVersion, opn.Version)
+		assert.Equal(t, time.Date(2022, time.October, 1, 12, 0, 0, 0, time.UTC), opn.CreatedAt)
 	}
 }
 
@@ -96,7 +103,7 @@ func TestGetEmailByNicknameCacheMiss(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
+	d.db = &PgsDB{db: db}
 	testNickname := "PatrickBateman"
 	testEmail := "americanpsycho@gmail.com"
 	cacheMock.ExpectGet(testNickname).RedisNil()
@@ -119,7 +126,7 @@ func TestGetEmailByNicknameNotExists(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
+	d.db = &PgsDB{db: db}
 	testNickname := "Moon"
 	cacheMock.ExpectGet(testNickname).RedisNil()
 	rows := sqlmock.NewRows([]string{"email"})
@@ -154,7 +161,7 @@ func TestCheckNicknameInDatabaseCacheMiss(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
+	d.db = &PgsDB{db: db}
 	testNickname := "ThomasShelby"
 	testEmail := "peakyblinders@example.com"
 	cacheMock.ExpectGet(testNickname).RedisNil()
@@ -177,7 +184,7 @@ func TestCheckNicknameInDatabaseNotExists(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
+	d.db = &PgsDB{db: db}
 	testNickname := "WatermelonHater"
 	cacheMock.ExpectGet(testNickname).RedisNil()
 	rows := sqlmock.NewRows([]string{"email"})
@@ -199,10 +206,15 @@ func TestAddUserToDatabase(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
-	testUser := User{"Newbie", "nwb@example.com"}
-	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Users VALUES ($1, $2)`)).WithArgs(testUser.Nickname, testUser.Email).WillReturnResult(sqlmock.NewResult(1, 1))
+	d.db = &PgsDB{db: db}
+	testUser := User{Nickname: "Newbie", Email: "nwb@example.com"}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Users (nickname, email, email_index, language) VALUES ($1, $2, $3, $4)`)).WithArgs(testUser.Nickname, testUser.Email, testUser.Email, testUser.Language).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)`)).WithArgs(testUser.Nickname, EventTypeUserSubscribed, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectCommit()
 	cacheMock.ExpectDel(ListUsersKey).SetVal(1)
+	cacheMock.ExpectDel(staleListUsersKey).SetVal(1)
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO History (nickname, event) VALUES ($1, $2)`)).WithArgs(testUser.Nickname, EventSubscribed).WillReturnResult(sqlmock.NewResult(1, 1))
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	err = d.AddUserToDatabase(ctx, testUser)
@@ -217,23 +229,75 @@ func TestDeleteUserFromDatabase(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
-	testUser := User{"Old", "old@example.com"}
-	dbMock.ExpectExec(regexp.QuoteMeta(`DELETE FROM Users WHERE nickname=$1 AND email=$2`)).WithArgs(testUser.Nickname, testUser.Email).WillReturnResult(sqlmock.NewResult(1, 1))
+	d.db = &PgsDB{db: db}
+	testUser := User{Nickname: "Old", Email: "old@example.com"}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`DELETE FROM Users WHERE nickname=$1 AND email_index=$2`)).WithArgs(testUser.Nickname, testUser.Email).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)`)).WithArgs(testUser.Nickname, EventTypeUserUnsubscribed, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectCommit()
 	cacheMock.ExpectDel(ListUsersKey).SetVal(0)
+	cacheMock.ExpectDel(staleListUsersKey).SetVal(1)
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO History (nickname, event) VALUES ($1, $2)`)).WithArgs(testUser.Nickname, EventUnsubscribed).WillReturnResult(sqlmock.NewResult(1, 1))
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	err = d.DeleteUserFromDatabase(ctx, testUser)
 	assert.Nil(t, err)
 }
 
+func TestChangeUserEmail(t *testing.T) {
+	cache, cacheMock := redismock.NewClientMock()
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	d := &dataHandler{}
+	d.cache = &RedisCache{cache}
+	d.db = &PgsDB{db: db}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`UPDATE Users SET email=$1, email_index=$2 WHERE nickname=$3`)).WithArgs("new@example.com", "new@example.com", "arbuz").WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)`)).WithArgs("arbuz", EventTypeUserEmailChanged, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectCommit()
+	cacheMock.ExpectDel("arbuz").SetVal(1)
+	cacheMock.ExpectDel(ListUsersKey).SetVal(0)
+	cacheMock.ExpectDel(staleListUsersKey).SetVal(1)
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO History (nickname, event) VALUES ($1, $2)`)).WithArgs("arbuz", EventEmailChanged).WillReturnResult(sqlmock.NewResult(1, 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err = d.ChangeUserEmail(ctx, "arbuz", "new@example.com")
+	assert.Nil(t, err)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestSetUserPaused(t *testing.T) {
+	cache, cacheMock := redismock.NewClientMock()
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	d := &dataHandler{}
+	d.cache = &RedisCache{cache}
+	d.db = &PgsDB{db: db}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`UPDATE Users SET paused=$1 WHERE nickname=$2`)).WithArgs(true, "arbuz").WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)`)).WithArgs("arbuz", EventTypeUserPaused, sqlmock.AnyArg()).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectCommit()
+	cacheMock.ExpectDel(ListUsersKey).SetVal(0)
+	cacheMock.ExpectDel(staleListUsersKey).SetVal(1)
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO History (nickname, event) VALUES ($1, $2)`)).WithArgs("arbuz", EventPaused).WillReturnResult(sqlmock.NewResult(1, 1))
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	err = d.SetUserPaused(ctx, "arbuz", true)
+	assert.Nil(t, err)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
 func TestGetUsersFromDatabaseCacheHit(t *testing.T) {
 	cache, cacheMock := redismock.NewClientMock()
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
 	cacheMock.ExpectGet(ListUsersKey).SetVal(`[{"nickname":"pupa","email":"buhga@gmail.com"},
                                                {"nickname":"lupa","email":"lteria@gmail.com"}]`)
-	testUsers := []User{{"pupa", "buhga@gmail.com"}, {"lupa", "lteria@gmail.com"}}
+	testUsers := []User{{Nickname: "pupa", Email: "buhga@gmail.com"}, {Nickname: "lupa", Email: "lteria@gmail.com"}}
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	result, err := d.GetUsersFromDatabase(ctx)
@@ -252,17 +316,18 @@ func TestGetUsersFromDatabaseCacheMiss(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
+	d.db = &PgsDB{db: db}
 	cacheMock.ExpectGet(ListUsersKey).RedisNil()
-	rows := sqlmock.NewRows([]string{"nickname", "email"})
-	rows.AddRow("pupa", "buhga@gmail.com").AddRow("lupa", "lteria@gmail.com")
-	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT nickname, email FROM Users`)).WillReturnRows(rows).RowsWillBeClosed()
-	testUsers := []User{{"pupa", "buhga@gmail.com"}, {"lupa", "lteria@gmail.com"}}
+	rows := sqlmock.NewRows([]string{"nickname", "email", "language"})
+	rows.AddRow("pupa", "buhga@gmail.com", "ru").AddRow("lupa", "lteria@gmail.com", "")
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT nickname, email, COALESCE(language, '') FROM Users`)).WillReturnRows(rows).RowsWillBeClosed()
+	testUsers := []User{{Nickname: "pupa", Email: "buhga@gmail.com", Language: "ru"}, {Nickname: "lupa", Email: "lteria@gmail.com"}}
 	buf := new(strings.Builder)
 	if err = json.NewEncoder(buf).Encode(&testUsers); err != nil {
 		t.Fatalf("Unexpected error while encoding Users slice: %v", err)
 	}
 	cacheMock.ExpectSet(ListUsersKey, buf.String(), cacheExpiration).SetVal("success")
+	cacheMock.ExpectSet(staleListUsersKey, buf.String(), staleExpiration).SetVal("success")
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	result, err := d.GetUsersFromDatabase(ctx)
@@ -281,11 +346,12 @@ func TestGetUsersFromDatabaseEmpty(t *testing.T) {
 	}
 	d := &dataHandler{}
 	d.cache = &RedisCache{cache}
-	d.db = &PgsDB{db}
+	d.db = &PgsDB{db: db}
 	cacheMock.ExpectGet(ListUsersKey).RedisNil()
-	rows := sqlmock.NewRows([]string{"nickname", "email"})
-	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT nickname, email FROM Users`)).WillReturnRows(rows).RowsWillBeClosed()
+	rows := sqlmock.NewRows([]string{"nickname", "email", "language"})
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT nickname, email, COALESCE(language, '') FROM Users`)).WillReturnRows(rows).RowsWillBeClosed()
 	cacheMock.ExpectSet(ListUsersKey, "null\n", cacheExpiration).SetVal("success")
+	cacheMock.ExpectSet(staleListUsersKey, "null\n", staleExpiration).SetVal("success")
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	result, err := d.GetUsersFromDatabase(ctx)
@@ -293,3 +359,197 @@ func TestGetUsersFromDatabaseEmpty(t *testing.T) {
 		assert.Zero(t, len(result))
 	}
 }
+
+func TestGetUserData(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	d := &dataHandler{}
+	d.db = &PgsDB{db: db}
+	testUser := User{Nickname: "arbuz", Email: "arbuz@gmail.com"}
+	subscribedAt := time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)
+	deliveredAt := time.Date(2022, 10, 2, 12, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT email FROM Users WHERE nickname = $1`)).WithArgs(testUser.Nickname).WillReturnRows(sqlmock.NewRows([]string{"email"}).AddRow(testUser.Email))
+	rows := sqlmock.NewRows([]string{"event", "created_at"}).AddRow(EventSubscribed, subscribedAt).AddRow(EventDailyPublished, deliveredAt)
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT event, created_at FROM History WHERE nickname = $1 ORDER BY created_at`)).WithArgs(testUser.Nickname).WillReturnRows(rows)
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT last_delivered_at, consecutive_failures FROM Users WHERE nickname = $1`)).WithArgs(testUser.Nickname).
+		WillReturnRows(sqlmock.NewRows([]string{"last_delivered_at", "consecutive_failures"}).AddRow(deliveredAt, 1))
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT receipt_id, request_id, request_topic, sent, smtp_response, attempts, created_at FROM DeliveryReceipts WHERE nickname = $1`)).WithArgs(testUser.Nickname).
+		WillReturnRows(sqlmock.NewRows([]string{"receipt_id", "request_id", "request_topic", "sent", "smtp_response", "attempts", "created_at"}).
+			AddRow("r1", "m1", "daily", false, "550 Mailbox unavailable", 5, deliveredAt.Add(time.Hour)))
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	userData, err := d.GetUserData(ctx, testUser.Nickname)
+	if assert.Nil(t, err) {
+		assert.Equal(t, &UserData{
+			User:           testUser,
+			History:        []HistoryRecord{{EventSubscribed, subscribedAt}},
+			Deliveries:     []HistoryRecord{{EventDailyPublished, deliveredAt}},
+			DeliveryStatus: DeliveryStatus{LastDeliveredAt: &deliveredAt, ConsecutiveFailures: 1},
+			Receipts: []DeliveryReceipt{{ID: "r1", RequestID: "m1", RequestTopic: "daily", Nickname: testUser.Nickname,
+				SMTPResponse: "550 Mailbox unavailable", Attempts: 5, Time: deliveredAt.Add(time.Hour)}},
+		}, userData)
+	}
+}
+
+func TestEraseUser(t *testing.T) {
+	cache, cacheMock := redismock.NewClientMock()
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	d := &dataHandler{}
+	d.cache = &RedisCache{cache}
+	d.db = &PgsDB{db: db, nicknameHasher: testNicknameHasher}
+	testNickname := "Old"
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`DELETE FROM Users WHERE nickname=$1`)).WithArgs(testNickname).WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`DELETE FROM History WHERE nickname=$1`)).WithArgs(testNickname).WillReturnResult(sqlmock.NewResult(0, 2))
+	dbMock.ExpectExec(regexp.QuoteMeta(`DELETE FROM DeliveryCheckpoints WHERE nickname=$1`)).WithArgs(testNickname).WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`DELETE FROM DeliveryReceipts WHERE nickname=$1`)).WithArgs(testNickname).WillReturnResult(sqlmock.NewResult(0, 0))
+	dbMock.ExpectExec(regexp.QuoteMeta(`DELETE FROM Outbox WHERE nickname=$1`)).WithArgs(testNickname).WillReturnResult(sqlmock.NewResult(0, 2))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Tombstones (nickname_hash) VALUES ($1)`)).WithArgs(testNicknameHasher.Hash(testNickname)).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)`)).WithArgs(testNicknameHasher.Hash(testNickname),
+		EventTypeUserErased, payloadWithout(testNickname)).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectCommit()
+	cacheMock.ExpectSMembers(operationsIndexPrefix + testNickname).SetVal([]string{"firstkey", "secondkey"})
+	cacheMock.ExpectDel("firstkey").SetVal(1)
+	cacheMock.ExpectDel("secondkey").SetVal(1)
+	cacheMock.ExpectDel(operationsIndexPrefix + testNickname).SetVal(1)
+	cacheMock.ExpectDel(testNickname).SetVal(1)
+	cacheMock.ExpectDel(ListUsersKey).SetVal(1)
+	cacheMock.ExpectDel(staleListUsersKey).SetVal(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	existed, err := d.EraseUser(ctx, testNickname)
+	if assert.Nil(t, err) {
+		assert.True(t, existed)
+		assert.Nil(t, dbMock.ExpectationsWereMet())
+		assert.Nil(t, cacheMock.ExpectationsWereMet())
+	}
+}
+
+func TestInvalidateUsersListReleasesOwnLock(t *testing.T) {
+	cache, cacheMock := redismock.NewClientMock()
+	d := &dataHandler{rebuildLock: true}
+	d.cache = &RedisCache{cache}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	cacheMock.ExpectDel(ListUsersKey).SetVal(1)
+	cacheMock.ExpectDel(staleListUsersKey).SetVal(1)
+	assert.Nil(t, d.invalidateUsersList(ctx))
+	d.setLockToken("owntoken")
+	cacheMock.ExpectDel(ListUsersKey).SetVal(1)
+	cacheMock.ExpectDel(staleListUsersKey).SetVal(1)
+	cacheMock.ExpectEval(delIfEqualScript, []string{listUsersLockKey}, "owntoken").SetVal(int64(1))
+	assert.Nil(t, d.invalidateUsersList(ctx))
+	assert.Nil(t, cacheMock.ExpectationsWereMet())
+}
+
+func TestGetUsersFromDatabaseLockTaken(t *testing.T) {
+	cache, cacheMock := redismock.NewClientMock()
+	d := &dataHandler{rebuildLock: true}
+	d.cache = &RedisCache{cache}
+	cacheMock.ExpectGet(ListUsersKey).RedisNil()
+	cacheMock.Regexp().ExpectSetNX(listUsersLockKey, `^[A-Za-z0-9_=-]{24}$`, lockExpiration).SetVal(false)
+	cacheMock.ExpectGet(staleListUsersKey).SetVal(`[{"nickname":"pupa","email":"buhga@gmail.com"}]`)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	result, err := d.GetUsersFromDatabase(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []User{{Nickname: "pupa", Email: "buhga@gmail.com"}}, result)
+		assert.Nil(t, cacheMock.ExpectationsWereMet())
+	}
+}
+
+func TestGetUsersFromDatabaseLockAcquired(t *testing.T) {
+	cache, cacheMock := redismock.NewClientMock()
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	d := &dataHandler{rebuildLock: true}
+	d.cache = &RedisCache{cache}
+	d.db = &PgsDB{db: db}
+	cacheMock.ExpectGet(ListUsersKey).RedisNil()
+	cacheMock.Regexp().ExpectSetNX(listUsersLockKey, `^[A-Za-z0-9_=-]{24}$`, lockExpiration).SetVal(true)
+	rows := sqlmock.NewRows([]string{"nickname", "email", "language"}).AddRow("pupa", "buhga@gmail.com", "")
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT nickname, email, COALESCE(language, '') FROM Users`)).WillReturnRows(rows).RowsWillBeClosed()
+	jsonData := `[{"nickname":"pupa","email":"buhga@gmail.com"}]` + "\n"
+	cacheMock.ExpectSet(ListUsersKey, jsonData, cacheExpiration).SetVal("success")
+	cacheMock.ExpectSet(staleListUsersKey, jsonData, staleExpiration).SetVal("success")
+	cacheMock.Regexp().ExpectEval(regexp.QuoteMeta(delIfEqualScript), []string{listUsersLockKey}, `^[A-Za-z0-9_=-]{24}$`).SetVal(int64(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	result, err := d.GetUsersFromDatabase(ctx)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []User{{Nickname: "pupa", Email: "buhga@gmail.com"}}, result)
+		assert.Nil(t, cacheMock.ExpectationsWereMet())
+	}
+}
+
+// missingCache is a Cache which never has any value.
+type missingCache struct {
+	Cache
+}
+
+func (c *missingCache) Get(ctx context.Context, key string) (string, error) {
+	return "", CacheNil
+}
+
+func (c *missingCache) Set(ctx context.Context, key, value string, expiration time.Duration) error {
+	return nil
+}
+
+// slowDB is a DB which counts calls of SelectAllUsers and answers them with delay.
+type slowDB struct {
+	DB
+	calls int32
+}
+
+func (db *slowDB) SelectAllUsers(ctx context.Context) ([]User, error) {
+	atomic.AddInt32(&db.calls, 1)
+	time.Sleep(100 * time.Millisecond)
+	return []User{{Nickname: "pupa", Email: "buhga@gmail.com"}}, nil
+}
+
+func TestGetUsersFromDatabaseCoalescing(t *testing.T) {
+	db := &slowDB{}
+	d := &dataHandler{cache: &missingCache{}, db: db}
+	wg := new(sync.WaitGroup)
+	callers := 10
+	wg.Add(callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			defer wg.Done()
+			result, err := d.GetUsersFromDatabase(context.Background())
+			if assert.Nil(t, err) {
+				assert.Equal(t, []User{{Nickname: "pupa", Email: "buhga@gmail.com"}}, result)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&db.calls))
+}
+
+func TestGetUsersFromDatabaseCancelledCaller(t *testing.T) {
+	db := &slowDB{}
+	d := &dataHandler{cache: &missingCache{}, db: db}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := d.GetUsersFromDatabase(ctx)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	}()
+	time.Sleep(5 * time.Millisecond)
+	result, err := d.GetUsersFromDatabase(context.Background())
+	if assert.Nil(t, err) {
+		assert.Equal(t, []User{{Nickname: "pupa", Email: "buhga@gmail.com"}}, result)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&db.calls))
+}
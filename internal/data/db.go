@@ -3,10 +3,13 @@ package data
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // DB interface represents a database with User scheme.
@@ -15,29 +18,169 @@ type DB interface {
 	// no such nickname, returns empty string.
 	GetEmailByNickname(ctx context.Context, nickname string) (string, error)
 
-	// InsertUser inserts a new record with given User data to database.
-	// Returns a boolean value if the insertion affected any rows in the DB.
+	// GetLanguageByNickname returns the preferred language of emails of user with given nickname.
+	// If the language isn't set or there is no such nickname, returns empty string.
+	GetLanguageByNickname(ctx context.Context, nickname string) (string, error)
+
+	// InsertUser inserts a new record with given User data to database together with
+	// a user.subscribed outbox event. Returns a boolean value if the insertion affected any rows in the DB.
 	InsertUser(ctx context.Context, user User) (bool, error)
 
-	// DeleteUser removes records for given User data from database.
+	// DeleteUser removes records for given User data from database together with
+	// inserting a user.unsubscribed outbox event.
 	// Return a boolean value if the insertion affected any rows in the DB.
 	DeleteUser(ctx context.Context, user User) (bool, error)
 
 	// SelectAllUsers returns a slice of User according to rows' data in the DB.
+	// Users with paused delivery are omitted.
 	SelectAllUsers(ctx context.Context) ([]User, error)
 
+	// UpdateEmail replaces the email of user with given nickname together with inserting
+	// a user.email_changed outbox event. Returns true if the user exists.
+	UpdateEmail(ctx context.Context, nickname, newEmail string) (bool, error)
+
+	// SetPaused sets the pause flag of user with given nickname together with inserting
+	// a user.paused or user.resumed outbox event. Returns true if the user exists.
+	SetPaused(ctx context.Context, nickname string, paused bool) (bool, error)
+
+	// InsertHistoryRecord adds an event to the history of user with given nickname.
+	InsertHistoryRecord(ctx context.Context, nickname, event string) error
+
+	// SelectHistory returns all events from the history of user with given nickname
+	// in chronological order.
+	SelectHistory(ctx context.Context, nickname string) ([]HistoryRecord, error)
+
+	// EraseUser removes the record and history of user with given nickname and
+	// saves a tombstone of the user. Returns true if there was anything to erase.
+	EraseUser(ctx context.Context, nickname string) (bool, error)
+
+	// SelectUnpublishedEvents returns up to limit outbox events, which are not published yet,
+	// in order of their creation.
+	SelectUnpublishedEvents(ctx context.Context, limit int) ([]OutboxEvent, error)
+
+	// MarkEventsPublished marks outbox events with given IDs as published.
+	MarkEventsPublished(ctx context.Context, ids []int64) error
+
+	// InsertAuditRecord saves a record about administrative action upon a user.
+	InsertAuditRecord(ctx context.Context, record AuditRecord) error
+
+	// InsertDeliveryRun saves the start of delivery run with given ID and total amount of users.
+	// If the run already exists (i.e. it is resumed), it is left unchanged.
+	InsertDeliveryRun(ctx context.Context, runID string, total int) error
+
+	// UpsertDeliveryCheckpoint saves whether the daily message of delivery run was published for user
+	// with given nickname.
+	UpsertDeliveryCheckpoint(ctx context.Context, runID, nickname string, published bool) error
+
+	// SelectPublishedNicknames returns nicknames of users, for whom the daily message of delivery run
+	// is already published.
+	SelectPublishedNicknames(ctx context.Context, runID string) ([]string, error)
+
+	// FinishDeliveryRun saves the end time of delivery run.
+	FinishDeliveryRun(ctx context.Context, runID string) error
+
+	// SelectDeliveryRun returns delivery run with given ID. If there is no such run, returns nil.
+	SelectDeliveryRun(ctx context.Context, runID string) (*DeliveryRun, error)
+
+	// SelectUnfinishedDeliveryRuns returns IDs of delivery runs without end time in order of their start.
+	SelectUnfinishedDeliveryRuns(ctx context.Context) ([]string, error)
+
+	// InsertDeliveryReceipt saves the receipt of existing user and updates the user's delivery status.
+	// Returns false if the receipt is already saved or there is no such user.
+	InsertDeliveryReceipt(ctx context.Context, receipt DeliveryReceipt) (bool, error)
+
+	// SelectDeliveryReceipts returns all receipts of user with given nickname in chronological order.
+	SelectDeliveryReceipts(ctx context.Context, nickname string) ([]DeliveryReceipt, error)
+
+	// SelectDeliveryStatus returns the delivery status of user with given nickname.
+	SelectDeliveryStatus(ctx context.Context, nickname string) (DeliveryStatus, error)
+
 	// Close closes connection with database, releasing resources.
 	Close()
 }
 
+// EventType* consts are the types of domain events written into the outbox.
+const (
+	EventTypeUserSubscribed   = "user.subscribed"
+	EventTypeUserUnsubscribed = "user.unsubscribed"
+	EventTypeUserEmailChanged = "user.email_changed"
+	EventTypeUserPaused       = "user.paused"
+	EventTypeUserResumed      = "user.resumed"
+	EventTypeUserErased       = "user.erased"
+)
+
+// OutboxEvent represents a domain event, which is saved in the same transaction
+// as the change it describes and is published to message broker later.
+type OutboxEvent struct {
+	ID       int64
+	Nickname string
+	Type     string
+	Payload  string
+}
+
+// userEventPayload is the published content of user.* outbox events. It doesn't contain the email,
+// so the outbox and the topic don't keep personal data in plaintext.
+type userEventPayload struct {
+	Type       string    `json:"type"`
+	Nickname   string    `json:"nickname"`
+	OccurredAt time.Time `json:"occurred_at"`
+}
+
+// tombstonePayload is the published content of user.erased outbox events. It identifies the erased user
+// only by the hash of the nickname, so neither the outbox nor the erasure topic keeps the erased data itself.
+type tombstonePayload struct {
+	NicknameHash string    `json:"nickname_hash"`
+	ErasedAt     time.Time `json:"erased_at"`
+}
+
+// DeliveryRun represents the progress of delivery run of daily messages. FinishedAt is zero
+// until the run is finished.
+type DeliveryRun struct {
+	ID         string
+	StartedAt  time.Time
+	FinishedAt time.Time
+	Total      int
+	Published  int
+	Failed     int
+}
+
+// DeliveryReceipt represents the result of sending an email to the user, which is reported by email service.
+type DeliveryReceipt struct {
+	ID           string    `json:"id"`
+	RequestID    string    `json:"request_id"`
+	RequestTopic string    `json:"request_topic"`
+	Nickname     string    `json:"-"`
+	Sent         bool      `json:"sent"`
+	SMTPResponse string    `json:"smtp_response,omitempty"`
+	Attempts     int       `json:"attempts"`
+	Time         time.Time `json:"time"`
+}
+
+// DeliveryStatus is the summary of user's delivery receipts: the time of last sent email and
+// the number of failed emails after it.
+type DeliveryStatus struct {
+	LastDeliveredAt     *time.Time `json:"last_delivered_at,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+}
+
 // PgsDB implements DB interface with PostgreSQL database.
 type PgsDB struct {
 	db *sql.DB
+
+	// keyring encrypts emails and computes their blind indexes. If it is nil,
+	// emails are stored as plaintext.
+	keyring *Keyring
+
+	// nicknameHasher computes hashes of nicknames in tombstones and audit records. If it is nil,
+	// users can't be erased and audit records can't be inserted.
+	nicknameHasher *NicknameHasher
 }
 
 // ConnectToPGS connects to PostgreSQL database, using given file.
+// If keyring is not nil, emails are stored encrypted with it. Nicknames in tombstones and audit
+// records are hashed with nicknameHasher.
 // If connection or initialization of tables were failed, returns error.
-func NewPgsDB(pgsInfoFile string) (*PgsDB, error) {
+func NewPgsDB(pgsInfoFile string, keyring *Keyring, nicknameHasher *NicknameHasher) (*PgsDB, error) {
 	var err error
 	if !filepath.IsAbs(pgsInfoFile) {
 		pgsInfoFile, err = filepath.Abs(pgsInfoFile)
@@ -57,11 +200,20 @@ func NewPgsDB(pgsInfoFile string) (*PgsDB, error) {
 		db.Close()
 		return nil, err
 	}
-	if err := createUsersTable(db); err != nil {
+	for _, createTable := range []func(*sql.DB) error{createUsersTable, addEmailIndexColumn, addPausedColumn, createHistoryTable,
+		createTombstonesTable, createOutboxTable, purgeOutboxEmails, createAuditTable, createDeliveryRunsTable, createDeliveryCheckpointsTable,
+		addDeliveryStatusColumns, createDeliveryReceiptsTable, addLanguageColumn} {
+		if err := createTable(db); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	pdb := &PgsDB{db: db, keyring: keyring, nicknameHasher: nicknameHasher}
+	if err := pdb.migrateEmails(context.Background()); err != nil {
 		db.Close()
 		return nil, err
 	}
-	return &PgsDB{db: db}, nil
+	return pdb, nil
 }
 
 // createUsersTable executes a CREATE TABLE query to create necessary Users table.
@@ -73,6 +225,196 @@ func createUsersTable(db *sql.DB) error {
 	return err
 }
 
+// addEmailIndexColumn adds a column with blind indexes of emails to Users table, which
+// is used to look up users by encrypted email.
+func addEmailIndexColumn(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE Users ADD COLUMN IF NOT EXISTS email_index TEXT;`)
+	return err
+}
+
+// addPausedColumn adds a column with flag of paused delivery to Users table.
+func addPausedColumn(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE Users ADD COLUMN IF NOT EXISTS paused BOOLEAN DEFAULT false;`)
+	return err
+}
+
+// migrateEmails fills blind indexes of users records which don't have them (i.e. written
+// before the column was added). If encryption is enabled, it also encrypts emails stored
+// as plaintext (i.e. written before the encryption was enabled) and recomputes their indexes.
+func (pdb *PgsDB) migrateEmails(ctx context.Context) error {
+	query := "SELECT nickname, email FROM Users WHERE email_index IS NULL"
+	if pdb.keyring != nil {
+		query += " OR email NOT LIKE '" + encryptedPrefix + "%'"
+	}
+	rows, err := pdb.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	var users []User
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.Nickname, &user.Email); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, user)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, user := range users {
+		// emails, which are already encrypted, are decrypted to compute the index without
+		// encrypting them twice
+		email, err := pdb.decryptEmail(user.Email)
+		if err != nil {
+			return err
+		}
+		storedEmail, emailIndex, err := pdb.encryptEmail(email)
+		if err != nil {
+			return err
+		}
+		_, err = pdb.db.ExecContext(ctx, "UPDATE Users SET email=$1, email_index=$2 WHERE nickname=$3",
+			storedEmail, emailIndex, user.Nickname)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encryptEmail returns the email in the form stored in database and its' blind index.
+// Without keyring both of them are the email itself.
+func (pdb *PgsDB) encryptEmail(email string) (string, string, error) {
+	if pdb.keyring == nil {
+		return email, email, nil
+	}
+	storedEmail, err := pdb.keyring.Encrypt(email)
+	if err != nil {
+		return "", "", err
+	}
+	return storedEmail, pdb.keyring.BlindIndex(email), nil
+}
+
+// emailIndex returns blind index of the email (or the email itself without keyring).
+func (pdb *PgsDB) emailIndex(email string) string {
+	if pdb.keyring == nil {
+		return email
+	}
+	return pdb.keyring.BlindIndex(email)
+}
+
+// decryptEmail returns the email from the form stored in database.
+func (pdb *PgsDB) decryptEmail(storedEmail string) (string, error) {
+	if pdb.keyring == nil {
+		return storedEmail, nil
+	}
+	return pdb.keyring.Decrypt(storedEmail)
+}
+
+// createHistoryTable executes a CREATE TABLE query to create History table with users' events.
+func createHistoryTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS History (` +
+		`nickname TEXT,` +
+		`event TEXT,` +
+		`created_at TIMESTAMPTZ DEFAULT now());`)
+	return err
+}
+
+// createTombstonesTable executes a CREATE TABLE query to create Tombstones table, which
+// keeps hashed nicknames of erased users.
+func createTombstonesTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS Tombstones (` +
+		`nickname_hash TEXT,` +
+		`erased_at TIMESTAMPTZ DEFAULT now());`)
+	return err
+}
+
+// createOutboxTable executes a CREATE TABLE query to create Outbox table with domain events.
+func createOutboxTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS Outbox (` +
+		`id BIGSERIAL PRIMARY KEY,` +
+		`nickname TEXT,` +
+		`event_type TEXT,` +
+		`payload TEXT,` +
+		`created_at TIMESTAMPTZ DEFAULT now(),` +
+		`published_at TIMESTAMPTZ);`)
+	return err
+}
+
+// purgeOutboxEmails removes emails from payloads of outbox events, which were written
+// before the emails were excluded from them.
+func purgeOutboxEmails(db *sql.DB) error {
+	_, err := db.Exec(`UPDATE Outbox SET payload = (payload::jsonb - 'email')::text WHERE payload::jsonb ? 'email';`)
+	return err
+}
+
+// createAuditTable executes a CREATE TABLE query to create Audit table with records about
+// administrative actions.
+func createAuditTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS Audit (` +
+		`actor TEXT,` +
+		`action TEXT,` +
+		`nickname_hash TEXT,` +
+		`created_at TIMESTAMPTZ DEFAULT now());`)
+	return err
+}
+
+// createDeliveryRunsTable executes a CREATE TABLE query to create DeliveryRuns table with
+// progress of daily messages delivery runs. Published and failed columns are left from earlier
+// versions: the counts are computed from DeliveryCheckpoints table.
+func createDeliveryRunsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS DeliveryRuns (` +
+		`run_id TEXT PRIMARY KEY,` +
+		`started_at TIMESTAMPTZ DEFAULT now(),` +
+		`finished_at TIMESTAMPTZ,` +
+		`total INTEGER DEFAULT 0,` +
+		`published INTEGER DEFAULT 0,` +
+		`failed INTEGER DEFAULT 0);`)
+	return err
+}
+
+// createDeliveryCheckpointsTable executes a CREATE TABLE query to create DeliveryCheckpoints table,
+// which keeps the result of publishing daily message for every user of delivery run.
+func createDeliveryCheckpointsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS DeliveryCheckpoints (` +
+		`run_id TEXT,` +
+		`nickname TEXT,` +
+		`published BOOLEAN,` +
+		`updated_at TIMESTAMPTZ DEFAULT now(),` +
+		`UNIQUE (run_id, nickname));`)
+	return err
+}
+
+// addDeliveryStatusColumns adds columns with the time of last delivered email and the number of
+// failed emails since then to Users table.
+func addDeliveryStatusColumns(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE Users ADD COLUMN IF NOT EXISTS last_delivered_at TIMESTAMPTZ, ` +
+		`ADD COLUMN IF NOT EXISTS consecutive_failures INTEGER DEFAULT 0;`)
+	return err
+}
+
+// addLanguageColumn adds a column with the preferred language of emails to Users table.
+func addLanguageColumn(db *sql.DB) error {
+	_, err := db.Exec(`ALTER TABLE Users ADD COLUMN IF NOT EXISTS language TEXT DEFAULT '';`)
+	return err
+}
+
+// createDeliveryReceiptsTable executes a CREATE TABLE query to create DeliveryReceipts table with
+// results of sending emails reported by email service.
+func createDeliveryReceiptsTable(db *sql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS DeliveryReceipts (` +
+		`receipt_id TEXT PRIMARY KEY,` +
+		`request_id TEXT,` +
+		`request_topic TEXT,` +
+		`nickname TEXT,` +
+		`sent BOOLEAN,` +
+		`smtp_response TEXT,` +
+		`attempts INTEGER,` +
+		`created_at TIMESTAMPTZ);`)
+	return err
+}
+
 // GetEmailByNickname returns email address responding to given nickname.
 // If there is no user with such nickname, returns empty string.
 func (pdb *PgsDB) GetEmailByNickname(ctx context.Context, nickname string) (string, error) {
@@ -80,52 +422,110 @@ func (pdb *PgsDB) GetEmailByNickname(ctx context.Context, nickname string) (stri
 	row := pdb.db.QueryRowContext(ctx, "SELECT email FROM Users WHERE nickname = $1", nickname)
 	err := row.Scan(&email)
 	if err == sql.ErrNoRows {
-		email = ""
+		return "", nil
 	} else if err != nil {
 		return "", err
 	}
-	return email, nil
+	return pdb.decryptEmail(email)
+}
+
+// GetLanguageByNickname returns the language of user with given nickname from database.
+func (pdb *PgsDB) GetLanguageByNickname(ctx context.Context, nickname string) (string, error) {
+	var language string
+	row := pdb.db.QueryRowContext(ctx, "SELECT COALESCE(language, '') FROM Users WHERE nickname = $1", nickname)
+	if err := row.Scan(&language); err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+	return language, nil
 }
 
 // InsertUser inserts a new record for given user to database and returns
-// true if the query affected any rows.
+// true if the query affected any rows. A user.subscribed event is written into
+// the outbox in the same transaction.
 func (pdb *PgsDB) InsertUser(ctx context.Context, user User) (bool, error) {
-	result, err := pdb.db.ExecContext(ctx, "INSERT INTO Users VALUES ($1, $2)", user.Nickname, user.Email)
+	storedEmail, emailIndex, err := pdb.encryptEmail(user.Email)
 	if err != nil {
 		return false, err
 	}
-	rows, err := result.RowsAffected()
+	return pdb.execWithEvent(ctx, EventTypeUserSubscribed, user,
+		"INSERT INTO Users (nickname, email, email_index, language) VALUES ($1, $2, $3, $4)", user.Nickname, storedEmail,
+		emailIndex, user.Language)
+}
+
+// DeleteUser deletes record for user from database and returns true
+// if the query affected any rows. A user.unsubscribed event is written into
+// the outbox in the same transaction.
+func (pdb *PgsDB) DeleteUser(ctx context.Context, user User) (bool, error) {
+	return pdb.execWithEvent(ctx, EventTypeUserUnsubscribed, user,
+		"DELETE FROM Users WHERE nickname=$1 AND email_index=$2", user.Nickname, pdb.emailIndex(user.Email))
+}
+
+// UpdateEmail replaces encrypted email and its' blind index of the user. A user.email_changed event
+// is written into the outbox in the same transaction.
+func (pdb *PgsDB) UpdateEmail(ctx context.Context, nickname, newEmail string) (bool, error) {
+	storedEmail, emailIndex, err := pdb.encryptEmail(newEmail)
 	if err != nil {
 		return false, err
 	}
-	return rows > 0, nil
+	return pdb.execWithEvent(ctx, EventTypeUserEmailChanged, User{Nickname: nickname, Email: newEmail},
+		"UPDATE Users SET email=$1, email_index=$2 WHERE nickname=$3", storedEmail, emailIndex, nickname)
 }
 
-// DeleteUser deletes record for user from database and returns true
-// if the query affected any rows.
-func (pdb *PgsDB) DeleteUser(ctx context.Context, user User) (bool, error) {
-	result, err := pdb.db.ExecContext(ctx, "DELETE FROM Users WHERE nickname=$1 AND email=$2", user.Nickname, user.Email)
+// SetPaused updates the pause flag of the user. A user.paused or user.resumed event is written
+// into the outbox in the same transaction.
+func (pdb *PgsDB) SetPaused(ctx context.Context, nickname string, paused bool) (bool, error) {
+	eventType := EventTypeUserResumed
+	if paused {
+		eventType = EventTypeUserPaused
+	}
+	return pdb.execWithEvent(ctx, eventType, User{Nickname: nickname},
+		"UPDATE Users SET paused=$1 WHERE nickname=$2", paused, nickname)
+}
+
+// execWithEvent executes given query and, if it affected any rows, inserts an outbox event
+// of given type for the user. Both changes are committed in one transaction.
+func (pdb *PgsDB) execWithEvent(ctx context.Context, eventType string, user User, query string, args ...any) (bool, error) {
+	payload, err := json.Marshal(userEventPayload{Type: eventType, Nickname: user.Nickname, OccurredAt: time.Now().UTC()})
+	if err != nil {
+		return false, err
+	}
+	tx, err := pdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		return false, err
 	}
 	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	} else if rows == 0 {
+		return false, nil
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)",
+		user.Nickname, eventType, string(payload))
 	if err != nil {
 		return false, err
 	}
-	return rows > 0, nil
+	return true, tx.Commit()
 }
 
 // SelectAllUsers returns a slice of User according to all records from database.
 func (pdb *PgsDB) SelectAllUsers(ctx context.Context) ([]User, error) {
 	var usersList []User
-	rows, err := pdb.db.QueryContext(ctx, "SELECT nickname, email FROM Users")
+	rows, err := pdb.db.QueryContext(ctx, "SELECT nickname, email, COALESCE(language, '') FROM Users WHERE paused IS NOT TRUE")
 	defer rows.Close()
 	if err != nil {
 		return nil, err
 	}
 	for rows.Next() {
 		var user User
-		if err := rows.Scan(&user.Nickname, &user.Email); err != nil {
+		if err := rows.Scan(&user.Nickname, &user.Email, &user.Language); err != nil {
+			return nil, err
+		}
+		if user.Email, err = pdb.decryptEmail(user.Email); err != nil {
 			return nil, err
 		}
 		usersList = append(usersList, user)
@@ -136,6 +536,288 @@ func (pdb *PgsDB) SelectAllUsers(ctx context.Context) ([]User, error) {
 	return usersList, nil
 }
 
+// InsertHistoryRecord inserts a new event into the History table.
+func (pdb *PgsDB) InsertHistoryRecord(ctx context.Context, nickname, event string) error {
+	_, err := pdb.db.ExecContext(ctx, "INSERT INTO History (nickname, event) VALUES ($1, $2)", nickname, event)
+	return err
+}
+
+// SelectHistory returns a slice of HistoryRecord according to records of user in History table.
+func (pdb *PgsDB) SelectHistory(ctx context.Context, nickname string) ([]HistoryRecord, error) {
+	var history []HistoryRecord
+	rows, err := pdb.db.QueryContext(ctx, "SELECT event, created_at FROM History WHERE nickname = $1 ORDER BY created_at", nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var record HistoryRecord
+		if err := rows.Scan(&record.Event, &record.Time); err != nil {
+			return nil, err
+		}
+		history = append(history, record)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return history, nil
+}
+
+// EraseUser deletes user's records from Users, History, DeliveryCheckpoints, DeliveryReceipts and Outbox tables and inserts a tombstone
+// with keyed hash of the nickname in one transaction. The tombstone is also written into the outbox as user.erased event keyed by
+// the hash, so downstream consumers are notified about the erasure even if the service fails right after the commit.
+func (pdb *PgsDB) EraseUser(ctx context.Context, nickname string) (bool, error) {
+	nicknameHash, err := pdb.hashNickname(nickname)
+	if err != nil {
+		return false, err
+	}
+	tx, err := pdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var affectedRows int64
+	for _, query := range []string{"DELETE FROM Users WHERE nickname=$1", "DELETE FROM History WHERE nickname=$1",
+		"DELETE FROM DeliveryCheckpoints WHERE nickname=$1", "DELETE FROM DeliveryReceipts WHERE nickname=$1",
+		"DELETE FROM Outbox WHERE nickname=$1"} {
+		result, err := tx.ExecContext(ctx, query, nickname)
+		if err != nil {
+			return false, err
+		}
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		affectedRows += rows
+	}
+	if affectedRows == 0 {
+		return false, nil
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO Tombstones (nickname_hash) VALUES ($1)", nicknameHash); err != nil {
+		return false, err
+	}
+	payload, err := json.Marshal(tombstonePayload{NicknameHash: nicknameHash, ErasedAt: time.Now().UTC()})
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)",
+		nicknameHash, EventTypeUserErased, string(payload))
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// SelectUnpublishedEvents returns a slice of OutboxEvent according to records of Outbox table
+// without publishing time, ordered by their IDs.
+func (pdb *PgsDB) SelectUnpublishedEvents(ctx context.Context, limit int) ([]OutboxEvent, error) {
+	var events []OutboxEvent
+	rows, err := pdb.db.QueryContext(ctx, "SELECT id, nickname, event_type, payload FROM Outbox "+
+		"WHERE published_at IS NULL ORDER BY id LIMIT $1", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var event OutboxEvent
+		if err := rows.Scan(&event.ID, &event.Nickname, &event.Type, &event.Payload); err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return events, nil
+}
+
+// MarkEventsPublished sets publishing time of outbox events with given IDs.
+func (pdb *PgsDB) MarkEventsPublished(ctx context.Context, ids []int64) error {
+	_, err := pdb.db.ExecContext(ctx, "UPDATE Outbox SET published_at = now() WHERE id = ANY($1)", pq.Array(ids))
+	return err
+}
+
+// InsertAuditRecord inserts a new record into Audit table. The nickname is stored hashed,
+// so the record outlives the user's erasure without keeping personal data.
+func (pdb *PgsDB) InsertAuditRecord(ctx context.Context, record AuditRecord) error {
+	nicknameHash, err := pdb.hashNickname(record.Nickname)
+	if err != nil {
+		return err
+	}
+	_, err = pdb.db.ExecContext(ctx, "INSERT INTO Audit (actor, action, nickname_hash) VALUES ($1, $2, $3)",
+		record.Actor, record.Action, nicknameHash)
+	return err
+}
+
+// InsertDeliveryRun inserts a new record into DeliveryRuns table, unless there is already a run with given ID.
+func (pdb *PgsDB) InsertDeliveryRun(ctx context.Context, runID string, total int) error {
+	_, err := pdb.db.ExecContext(ctx, "INSERT INTO DeliveryRuns (run_id, total) VALUES ($1, $2) ON CONFLICT (run_id) DO NOTHING",
+		runID, total)
+	return err
+}
+
+// UpsertDeliveryCheckpoint inserts or updates the user's record of DeliveryCheckpoints table.
+func (pdb *PgsDB) UpsertDeliveryCheckpoint(ctx context.Context, runID, nickname string, published bool) error {
+	_, err := pdb.db.ExecContext(ctx, "INSERT INTO DeliveryCheckpoints (run_id, nickname, published) VALUES ($1, $2, $3) "+
+		"ON CONFLICT (run_id, nickname) DO UPDATE SET published = EXCLUDED.published, updated_at = now()",
+		runID, nickname, published)
+	return err
+}
+
+// SelectPublishedNicknames returns nicknames from records of DeliveryCheckpoints table with published message.
+func (pdb *PgsDB) SelectPublishedNicknames(ctx context.Context, runID string) ([]string, error) {
+	var nicknames []string
+	rows, err := pdb.db.QueryContext(ctx, "SELECT nickname FROM DeliveryCheckpoints WHERE run_id = $1 AND published", runID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var nickname string
+		if err := rows.Scan(&nickname); err != nil {
+			return nil, err
+		}
+		nicknames = append(nicknames, nickname)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nicknames, nil
+}
+
+// FinishDeliveryRun sets the end time of the run in DeliveryRuns table.
+func (pdb *PgsDB) FinishDeliveryRun(ctx context.Context, runID string) error {
+	_, err := pdb.db.ExecContext(ctx, "UPDATE DeliveryRuns SET finished_at = now() WHERE run_id = $1", runID)
+	return err
+}
+
+// SelectDeliveryRun returns DeliveryRun according to the record of DeliveryRuns table. Published and
+// failed messages are counted by the run's records of DeliveryCheckpoints table.
+func (pdb *PgsDB) SelectDeliveryRun(ctx context.Context, runID string) (*DeliveryRun, error) {
+	run := &DeliveryRun{ID: runID}
+	var finishedAt sql.NullTime
+	row := pdb.db.QueryRowContext(ctx, "SELECT r.started_at, r.finished_at, r.total, "+
+		"COUNT(c.nickname) FILTER (WHERE c.published), COUNT(c.nickname) FILTER (WHERE NOT c.published) "+
+		"FROM DeliveryRuns r LEFT JOIN DeliveryCheckpoints c ON c.run_id = r.run_id "+
+		"WHERE r.run_id = $1 GROUP BY r.run_id", runID)
+	err := row.Scan(&run.StartedAt, &finishedAt, &run.Total, &run.Published, &run.Failed)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if finishedAt.Valid {
+		run.FinishedAt = finishedAt.Time
+	}
+	return run, nil
+}
+
+// SelectUnfinishedDeliveryRuns returns IDs from records of DeliveryRuns table without end time.
+func (pdb *PgsDB) SelectUnfinishedDeliveryRuns(ctx context.Context) ([]string, error) {
+	var runIDs []string
+	rows, err := pdb.db.QueryContext(ctx, "SELECT run_id FROM DeliveryRuns WHERE finished_at IS NULL ORDER BY started_at")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var runID string
+		if err := rows.Scan(&runID); err != nil {
+			return nil, err
+		}
+		runIDs = append(runIDs, runID)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return runIDs, nil
+}
+
+// InsertDeliveryReceipt inserts a new record into DeliveryReceipts table, if the user exists and there is
+// no receipt with the same ID, so redelivered receipts are counted once. Then it sets the user's time of last
+// delivered email and resets failures counter, or increments the counter for a failed email. Both changes
+// are committed in one transaction.
+func (pdb *PgsDB) InsertDeliveryReceipt(ctx context.Context, receipt DeliveryReceipt) (bool, error) {
+	tx, err := pdb.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, "INSERT INTO DeliveryReceipts (receipt_id, request_id, request_topic, nickname, sent, "+
+		"smtp_response, attempts, created_at) SELECT $1, $2, $3, $4, $5, $6, $7, $8 "+
+		"WHERE EXISTS (SELECT 1 FROM Users WHERE nickname = $4) ON CONFLICT (receipt_id) DO NOTHING",
+		receipt.ID, receipt.RequestID, receipt.RequestTopic, receipt.Nickname, receipt.Sent, receipt.SMTPResponse,
+		receipt.Attempts, receipt.Time)
+	if err != nil {
+		return false, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	} else if rows == 0 {
+		return false, nil
+	}
+	if receipt.Sent {
+		_, err = tx.ExecContext(ctx, "UPDATE Users SET last_delivered_at = GREATEST(last_delivered_at, $1), "+
+			"consecutive_failures = 0 WHERE nickname = $2", receipt.Time, receipt.Nickname)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE Users SET consecutive_failures = COALESCE(consecutive_failures, 0) + 1 "+
+			"WHERE nickname = $1", receipt.Nickname)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// SelectDeliveryReceipts returns a slice of DeliveryReceipt according to records of user in DeliveryReceipts table.
+func (pdb *PgsDB) SelectDeliveryReceipts(ctx context.Context, nickname string) ([]DeliveryReceipt, error) {
+	var receipts []DeliveryReceipt
+	rows, err := pdb.db.QueryContext(ctx, "SELECT receipt_id, request_id, request_topic, sent, smtp_response, attempts, "+
+		"created_at FROM DeliveryReceipts WHERE nickname = $1 ORDER BY created_at", nickname)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		receipt := DeliveryReceipt{Nickname: nickname}
+		if err := rows.Scan(&receipt.ID, &receipt.RequestID, &receipt.RequestTopic, &receipt.Sent, &receipt.SMTPResponse,
+			&receipt.Attempts, &receipt.Time); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, receipt)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return receipts, nil
+}
+
+// SelectDeliveryStatus returns DeliveryStatus according to the user's record of Users table.
+func (pdb *PgsDB) SelectDeliveryStatus(ctx context.Context, nickname string) (DeliveryStatus, error) {
+	var status DeliveryStatus
+	var lastDeliveredAt sql.NullTime
+	var failures sql.NullInt64
+	row := pdb.db.QueryRowContext(ctx, "SELECT last_delivered_at, consecutive_failures FROM Users WHERE nickname = $1", nickname)
+	if err := row.Scan(&lastDeliveredAt, &failures); err != nil && err != sql.ErrNoRows {
+		return status, err
+	}
+	if lastDeliveredAt.Valid {
+		status.LastDeliveredAt = &lastDeliveredAt.Time
+	}
+	status.ConsecutiveFailures = int(failures.Int64)
+	return status, nil
+}
+
+// hashNickname returns keyed hash of the nickname, which is used to refer to an erased user
+// without keeping the nickname itself.
+func (pdb *PgsDB) hashNickname(nickname string) (string, error) {
+	if pdb.nicknameHasher == nil {
+		return "", fmt.Errorf("Nickname key is not set.")
+	}
+	return pdb.nicknameHasher.Hash(nickname), nil
+}
+
 // Close closes database connection.
 func (pdb *PgsDB) Close() {
 	pdb.db.Close()
@@ -1,11 +1,16 @@
 package data
 
 import (
+	"context"
+	"database/sql/driver"
 	"fmt"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -27,3 +32,160 @@ func TestCreateUsersTableCreateTableFailed(t *testing.T) {
 	dbMock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS Users (nickname TEXT, email TEXT);`)).WillReturnError(mockError).WillReturnResult(sqlmock.NewResult(1, 1))
 	assert.NotNil(t, createUsersTable(db))
 }
+
+// payloadWithout matches outbox payloads which don't contain given text.
+type payloadWithout string
+
+func (p payloadWithout) Match(v driver.Value) bool {
+	payload, ok := v.(string)
+	return ok && !strings.Contains(payload, string(p))
+}
+
+func TestInsertUserEventWithoutEmail(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	testUser := User{Nickname: "Newbie", Email: "nwb@example.com"}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Users (nickname, email, email_index, language) VALUES ($1, $2, $3, $4)`)).WithArgs(testUser.Nickname, testUser.Email, testUser.Email, testUser.Language).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Outbox (nickname, event_type, payload) VALUES ($1, $2, $3)`)).WithArgs(testUser.Nickname, EventTypeUserSubscribed, payloadWithout(testUser.Email)).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectCommit()
+	affected, err := pdb.InsertUser(context.Background(), testUser)
+	if assert.Nil(t, err) {
+		assert.True(t, affected)
+		assert.Nil(t, dbMock.ExpectationsWereMet())
+	}
+}
+
+func TestInsertUserNotAffectedNoEvent(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	testUser := User{Nickname: "Newbie", Email: "nwb@example.com"}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO Users (nickname, email, email_index, language) VALUES ($1, $2, $3, $4)`)).WithArgs(testUser.Nickname, testUser.Email, testUser.Email, testUser.Language).WillReturnResult(sqlmock.NewResult(0, 0))
+	dbMock.ExpectRollback()
+	affected, err := pdb.InsertUser(context.Background(), testUser)
+	if assert.Nil(t, err) {
+		assert.False(t, affected)
+		assert.Nil(t, dbMock.ExpectationsWereMet())
+	}
+}
+
+func TestSelectUnpublishedEvents(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	rows := sqlmock.NewRows([]string{"id", "nickname", "event_type", "payload"}).
+		AddRow(1, "pupa", EventTypeUserSubscribed, `{"type":"user.subscribed"}`).
+		AddRow(2, "pupa", EventTypeUserUnsubscribed, `{"type":"user.unsubscribed"}`)
+	dbMock.ExpectQuery(regexp.QuoteMeta(`SELECT id, nickname, event_type, payload FROM Outbox WHERE published_at IS NULL ORDER BY id LIMIT $1`)).WithArgs(10).WillReturnRows(rows)
+	events, err := pdb.SelectUnpublishedEvents(context.Background(), 10)
+	if assert.Nil(t, err) {
+		assert.Equal(t, []OutboxEvent{
+			{1, "pupa", EventTypeUserSubscribed, `{"type":"user.subscribed"}`},
+			{2, "pupa", EventTypeUserUnsubscribed, `{"type":"user.unsubscribed"}`},
+		}, events)
+	}
+}
+
+func TestMarkEventsPublished(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	ids := []int64{1, 3}
+	dbMock.ExpectExec(regexp.QuoteMeta(`UPDATE Outbox SET published_at = now() WHERE id = ANY($1)`)).WithArgs(pq.Array(ids)).WillReturnResult(sqlmock.NewResult(0, 2))
+	assert.Nil(t, pdb.MarkEventsPublished(context.Background(), ids))
+}
+
+func TestUpsertDeliveryCheckpoint(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	dbMock.ExpectExec(regexp.QuoteMeta(`INSERT INTO DeliveryCheckpoints (run_id, nickname, published) VALUES ($1, $2, $3) ON CONFLICT`)).
+		WithArgs("20221001T120000Z", "pupa", true).WillReturnResult(sqlmock.NewResult(1, 1))
+	if assert.Nil(t, pdb.UpsertDeliveryCheckpoint(context.Background(), "20221001T120000Z", "pupa", true)) {
+		assert.Nil(t, dbMock.ExpectationsWereMet())
+	}
+}
+
+func TestSelectDeliveryRun(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	startedAt := time.Date(2022, 10, 1, 12, 0, 1, 0, time.UTC)
+	query := regexp.QuoteMeta(`SELECT r.started_at, r.finished_at, r.total, COUNT(c.nickname) FILTER (WHERE c.published), ` +
+		`COUNT(c.nickname) FILTER (WHERE NOT c.published) FROM DeliveryRuns r LEFT JOIN DeliveryCheckpoints c ON c.run_id = r.run_id ` +
+		`WHERE r.run_id = $1 GROUP BY r.run_id`)
+	dbMock.ExpectQuery(query).WithArgs("20221001T120000Z").WillReturnRows(
+		sqlmock.NewRows([]string{"started_at", "finished_at", "total", "published", "failed"}).AddRow(startedAt, nil, 3, 1, 1))
+	run, err := pdb.SelectDeliveryRun(context.Background(), "20221001T120000Z")
+	if assert.Nil(t, err) {
+		assert.Equal(t, &DeliveryRun{ID: "20221001T120000Z", StartedAt: startedAt, Total: 3, Published: 1, Failed: 1}, run)
+	}
+	dbMock.ExpectQuery(query).WithArgs("20221002T120000Z").WillReturnRows(
+		sqlmock.NewRows([]string{"started_at", "finished_at", "total", "published", "failed"}))
+	run, err = pdb.SelectDeliveryRun(context.Background(), "20221002T120000Z")
+	assert.Nil(t, err)
+	assert.Nil(t, run)
+}
+
+func TestInsertDeliveryReceipt(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	receipt := DeliveryReceipt{ID: "r1", RequestID: "m1", RequestTopic: "daily", Nickname: "pupa", Attempts: 5,
+		SMTPResponse: "550 Mailbox unavailable", Time: time.Date(2022, 10, 1, 12, 0, 1, 0, time.UTC)}
+	insert := regexp.QuoteMeta(`INSERT INTO DeliveryReceipts (receipt_id, request_id, request_topic, nickname, sent, smtp_response, attempts, created_at)`)
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(insert).WithArgs(receipt.ID, receipt.RequestID, receipt.RequestTopic, receipt.Nickname, false,
+		receipt.SMTPResponse, receipt.Attempts, receipt.Time).WillReturnResult(sqlmock.NewResult(1, 1))
+	dbMock.ExpectExec(regexp.QuoteMeta(`UPDATE Users SET consecutive_failures = COALESCE(consecutive_failures, 0) + 1 WHERE nickname = $1`)).
+		WithArgs(receipt.Nickname).WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectCommit()
+	recorded, err := pdb.InsertDeliveryReceipt(context.Background(), receipt)
+	if assert.Nil(t, err) {
+		assert.True(t, recorded)
+	}
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(insert).WillReturnResult(sqlmock.NewResult(0, 0))
+	dbMock.ExpectRollback()
+	recorded, err = pdb.InsertDeliveryReceipt(context.Background(), receipt)
+	if assert.Nil(t, err) {
+		assert.False(t, recorded)
+	}
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestGetLanguageByNickname(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	query := regexp.QuoteMeta(`SELECT COALESCE(language, '') FROM Users WHERE nickname = $1`)
+	dbMock.ExpectQuery(query).WithArgs("arbuz").WillReturnRows(sqlmock.NewRows([]string{"language"}).AddRow("ru"))
+	language, err := pdb.GetLanguageByNickname(context.Background(), "arbuz")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "ru", language)
+	}
+	dbMock.ExpectQuery(query).WithArgs("pupa").WillReturnRows(sqlmock.NewRows([]string{"language"}))
+	language, err = pdb.GetLanguageByNickname(context.Background(), "pupa")
+	if assert.Nil(t, err) {
+		assert.Equal(t, "", language)
+	}
+}
@@ -0,0 +1,65 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+)
+
+// DeliveryLeaderLockKey is the key of advisory lock held by the replica of main service
+// which runs daily delivery.
+const DeliveryLeaderLockKey int64 = 0x776d656c6f6e // "wmelon"
+
+// AdvisoryLock is a PostgreSQL session-level advisory lock. The lock is held by a dedicated
+// connection, so it is released by database as soon as the holder's connection is lost
+// (e.g. the process dies) and another process can acquire it.
+type AdvisoryLock struct {
+	db   *sql.DB
+	key  int64
+	conn *sql.Conn
+}
+
+// NewAdvisoryLock creates a new AdvisoryLock with given key in the database.
+func (pdb *PgsDB) NewAdvisoryLock(key int64) *AdvisoryLock {
+	return &AdvisoryLock{db: pdb.db, key: key}
+}
+
+// TryAcquire tries to acquire the lock without waiting and returns true if the lock is held.
+// If the lock is already held, TryAcquire checks that its' connection is still alive; otherwise
+// the lock is considered lost and false is returned together with the error.
+func (l *AdvisoryLock) TryAcquire(ctx context.Context) (bool, error) {
+	if l.conn != nil {
+		if err := l.conn.PingContext(ctx); err != nil {
+			l.conn.Close()
+			l.conn = nil
+			return false, err
+		}
+		return true, nil
+	}
+	conn, err := l.db.Conn(ctx)
+	if err != nil {
+		return false, err
+	}
+	var acquired bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&acquired); err != nil {
+		conn.Close()
+		return false, err
+	}
+	if !acquired {
+		return false, conn.Close()
+	}
+	l.conn = conn
+	return true, nil
+}
+
+// Release releases the lock, if it is held, and closes its' connection.
+func (l *AdvisoryLock) Release(ctx context.Context) error {
+	if l.conn == nil {
+		return nil
+	}
+	defer func() {
+		l.conn.Close()
+		l.conn = nil
+	}()
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	return err
+}
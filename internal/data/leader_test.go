@@ -0,0 +1,38 @@
+package data
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdvisoryLock(t *testing.T) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("Error \"%v\" was not expected while opening a mock database connection", err)
+	}
+	pdb := &PgsDB{db: db}
+	lock := pdb.NewAdvisoryLock(DeliveryLeaderLockKey)
+	query := regexp.QuoteMeta(`SELECT pg_try_advisory_lock($1)`)
+	dbMock.ExpectQuery(query).WithArgs(DeliveryLeaderLockKey).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(false))
+	dbMock.ExpectQuery(query).WithArgs(DeliveryLeaderLockKey).WillReturnRows(sqlmock.NewRows([]string{"locked"}).AddRow(true))
+	dbMock.ExpectExec(regexp.QuoteMeta(`SELECT pg_advisory_unlock($1)`)).WithArgs(DeliveryLeaderLockKey).WillReturnResult(sqlmock.NewResult(0, 1))
+	ctx := context.Background()
+	acquired, err := lock.TryAcquire(ctx)
+	if assert.Nil(t, err) {
+		assert.False(t, acquired)
+	}
+	acquired, err = lock.TryAcquire(ctx)
+	if assert.Nil(t, err) {
+		assert.True(t, acquired)
+	}
+	acquired, err = lock.TryAcquire(ctx)
+	if assert.Nil(t, err) {
+		assert.True(t, acquired)
+	}
+	assert.Nil(t, lock.Release(ctx))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
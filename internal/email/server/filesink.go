@@ -0,0 +1,99 @@
+package email_server
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhit/go-simple-mail/v2"
+)
+
+const (
+	// Maildir subdirectories: emails are written into tmp and then moved into new, where mail clients
+	// look for unread emails. Read emails are moved into cur by clients.
+	maildirTmp = "tmp"
+	maildirNew = "new"
+	maildirCur = "cur"
+
+	// emlExt is the extension of files written by FileTransport in .eml mode.
+	emlExt = ".eml"
+)
+
+// FileTransport writes emails into local files instead of sending them, so the service can be
+// run and tested without SMTP account. Every email is written completely before it appears in
+// the directory, so readers never see partially written files.
+type FileTransport struct {
+	// directory is the Maildir or the directory of .eml files.
+	directory string
+
+	// maildir defines whether emails are written in Maildir format.
+	maildir bool
+
+	// hostname is used to make unique file names.
+	hostname string
+
+	// delivered counts written emails to make unique file names.
+	delivered uint64
+}
+
+// NewFileTransport creates a new FileTransport which writes emails into given directory. If maildir is true,
+// the directory is used as Maildir and its' subdirectories are created if needed. Otherwise every email is
+// written into a separate .eml file.
+func NewFileTransport(directory string, maildir bool) (*FileTransport, error) {
+	if directory == "" {
+		return nil, fmt.Errorf("No directory for emails is provided.")
+	}
+	subdirectories := []string{directory}
+	if maildir {
+		subdirectories = []string{filepath.Join(directory, maildirTmp), filepath.Join(directory, maildirNew),
+			filepath.Join(directory, maildirCur)}
+	}
+	for _, subdirectory := range subdirectories {
+		if err := os.MkdirAll(subdirectory, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	return &FileTransport{directory: directory, maildir: maildir, hostname: hostname}, nil
+}
+
+// Send writes the email into a new file. In Maildir mode the file is written into tmp and then moved into new,
+// otherwise it is written into a hidden file and then renamed to .eml one.
+func (t *FileTransport) Send(msg *mail.Email) error {
+	if msg.Error != nil {
+		return msg.Error
+	}
+	name := t.uniqueName()
+	tmpPath := filepath.Join(t.directory, "."+name)
+	path := filepath.Join(t.directory, name+emlExt)
+	if t.maildir {
+		tmpPath = filepath.Join(t.directory, maildirTmp, name)
+		path = filepath.Join(t.directory, maildirNew, name)
+	}
+	if err := os.WriteFile(tmpPath, []byte(msg.GetMessage()), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Close does nothing, because files are closed after every email.
+func (t *FileTransport) Close() error {
+	return nil
+}
+
+// uniqueName returns a file name in the format recommended for Maildir: time, process ID with
+// the number of email and the host name.
+func (t *FileTransport) uniqueName() string {
+	now := time.Now()
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&t.delivered, 1), t.hostname)
+}
@@ -0,0 +1,92 @@
+package email_server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/xhit/go-simple-mail/v2"
+)
+
+const (
+	// defaultAPITimeout limits the duration of a request to HTTP API if no timeout is configured.
+	defaultAPITimeout time.Duration = 10 * time.Second
+
+	// apiErrorBodyLimit limits the part of HTTP API's error response included in the error.
+	apiErrorBodyLimit = 512
+)
+
+// apiRequest is the JSON body posted to HTTP API. The email is sent as raw MIME message, so all its'
+// parts and headers (e.g. attachments and List-Unsubscribe) are kept.
+type apiRequest struct {
+	From string   `json:"from,omitempty"`
+	To   []string `json:"to"`
+	Raw  string   `json:"raw"`
+}
+
+// HTTPTransport sends emails by posting them to the HTTP API of a mail provider (or a relay in front of it).
+type HTTPTransport struct {
+	// endpoint is the URL of HTTP API.
+	endpoint string
+
+	// token is sent as bearer token in Authorization header, if it isn't empty.
+	token string
+
+	client *http.Client
+}
+
+// NewHTTPTransport creates a new HTTPTransport which posts emails to given endpoint with optional bearer token.
+// If timeout is zero, defaultAPITimeout is used.
+func NewHTTPTransport(endpoint, token string, timeout time.Duration) (*HTTPTransport, error) {
+	parsed, err := url.ParseRequestURI(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid URL of mail HTTP API %q: %v", endpoint, err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("Invalid URL of mail HTTP API %q: expected http or https scheme.", endpoint)
+	}
+	if timeout <= 0 {
+		timeout = defaultAPITimeout
+	}
+	return &HTTPTransport{endpoint: endpoint, token: token, client: &http.Client{Timeout: timeout}}, nil
+}
+
+// Send posts the email to HTTP API. Any response with status other than 2xx is an error.
+func (t *HTTPTransport) Send(msg *mail.Email) error {
+	if msg.Error != nil {
+		return msg.Error
+	}
+	body, err := json.Marshal(apiRequest{From: msg.GetFrom(), To: msg.GetRecipients(), Raw: msg.GetMessage()})
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if t.token != "" {
+		request.Header.Set("Authorization", "Bearer "+t.token)
+	}
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		content, _ := io.ReadAll(io.LimitReader(response.Body, apiErrorBodyLimit))
+		return fmt.Errorf("Mail HTTP API responded with status %q: %s", response.Status, strings.TrimSpace(string(content)))
+	}
+	io.Copy(io.Discard, response.Body)
+	return nil
+}
+
+// Close closes idle connections to HTTP API.
+func (t *HTTPTransport) Close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
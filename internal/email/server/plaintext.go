@@ -0,0 +1,98 @@
+package email_server
+
+import (
+	"io"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	// blockTags are HTML elements whose content is separated from the surrounding text by an empty line.
+	blockTags = map[string]bool{
+		"p": true, "div": true, "table": true, "tr": true, "ul": true, "ol": true, "li": true, "blockquote": true,
+		"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true, "hr": true,
+	}
+
+	// skippedTags are HTML elements whose content is not displayed.
+	skippedTags = map[string]bool{"head": true, "title": true, "style": true, "script": true}
+
+	// spaces matches a sequence of whitespace characters.
+	spaces = regexp.MustCompile(`\s+`)
+
+	// emptyLines matches more than one empty line.
+	emptyLines = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText converts a rendered HTML message into plain text: blocks become paragraphs, links are
+// followed by their URLs in parentheses and images are replaced with their alternative text.
+func htmlToText(document string) (string, error) {
+	tokenizer := html.NewTokenizer(strings.NewReader(document))
+	var text strings.Builder
+	var links []string
+	skipped := 0
+	for {
+		tokenType := tokenizer.Next()
+		token := tokenizer.Token()
+		switch tokenType {
+		case html.ErrorToken:
+			if err := tokenizer.Err(); err != io.EOF {
+				return "", err
+			}
+			return tidyText(text.String()), nil
+		case html.TextToken:
+			if skipped == 0 {
+				text.WriteString(spaces.ReplaceAllString(token.Data, " "))
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch {
+			case skippedTags[token.Data]:
+				if tokenType == html.StartTagToken {
+					skipped++
+				}
+			case blockTags[token.Data]:
+				text.WriteString("\n\n")
+			case token.Data == "br":
+				text.WriteString("\n")
+			case token.Data == "img":
+				text.WriteString(attribute(token, "alt"))
+			case token.Data == "a" && tokenType == html.StartTagToken:
+				links = append(links, attribute(token, "href"))
+			}
+		case html.EndTagToken:
+			switch {
+			case skippedTags[token.Data]:
+				if skipped > 0 {
+					skipped--
+				}
+			case blockTags[token.Data]:
+				text.WriteString("\n\n")
+			case token.Data == "a" && len(links) != 0:
+				if href := links[len(links)-1]; href != "" {
+					text.WriteString(" (" + href + ")")
+				}
+				links = links[:len(links)-1]
+			}
+		}
+	}
+}
+
+// attribute returns the value of token's attribute with given name or an empty string.
+func attribute(token html.Token, name string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == name {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// tidyText trims spaces around lines and leaves at most one empty line between paragraphs.
+func tidyText(text string) string {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return strings.TrimSpace(emptyLines.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")) + "\n"
+}
@@ -2,42 +2,37 @@ package email_server
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/csv"
 	"fmt"
 	"io"
 	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/xhit/go-simple-mail/v2"
 
-	"github.com/Shopify/sarama"
-
 	"github.com/rs/zerolog"
 
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
 	"github.com/KSpaceer/go_watermelon/internal/kafkawriter"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
 	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
 )
 
 const (
-	// maxConns is used to limit currently active SMTP connections.
+	// maxConns is used to limit currently active connections of the transport.
 	maxConns = 10
 
 	// watermelonImgMailName defines the name of attached file.
 	watermelonImgMailName = "watermelon"
 
-	// dailyDeliveryMethodName represents a key to msgTemplates for value of daily message.
+	// dailyDeliveryMethodName represents the message type of daily message in templates.
 	dailyDeliveryMethodName = "sendWatermelon"
 
-	// *SubjectName consts define subject name for different types of messages
-	authMsgSubjectName  = "Confirm action"
-	dailyMsgSubjectName = "Daily watermelon"
-
 	// emailInfoFieldAmount is used to count necessary fields of SMTPServer
 	emailInfoFieldAmount = 4
 
@@ -49,89 +44,106 @@ const (
 
 	// sendAttemptsAmount defines a number of attempts for sending an email before failing.
 	sendAttemptsAmount = 5
-)
 
-var (
-	// msgTemplates contains HTML templates for different messages.
-	msgTemplates = map[string]string{
-		"ADD": `<html>
-                    <head>
-                        <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
-                        <title>Watermelon delivery</title>
-                    </head>
-                    <body>
-                        <p>Hi! This is confirm message for subscribing to watermelon photo daily delivery service.</p>
-                        <p>If you didn't try to subscribe, ignore this message.</p>
-                        <p>Otherwise, <a href="%s/v1/auth/%s">click here</a></p>
-                    </body>
-                </html>`,
-		"DELETE": `<html>
-                    <head>
-                        <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
-                        <title>Watermelon delivery</title>
-                    </head>
-                    <body>
-                        <p>Hi! This is confirm message for unsubscribing from watermelon photo daily delivery service.</p>
-                        <p>If you didn't try to unsubscribe, ignore this message.</p>
-                        <p>Otherwise, <a href="%s/v1/auth/%s">click here</a></p>
-                    </body>
-                </html>`,
-		dailyDeliveryMethodName: `<html>
-                                    <head>
-                                        <meta http-equiv="Content-Type" content="text/html; charset=utf-8" />
-                                        <title>Here comes watermelon</title>
-                                    </head>
-                                    <body>
-                                        <p><b>Have a nice day, %s!</b></p>
-                                        <p><img src="cid:%s" alt="Watermelon" /></p>
-                                    </body>
-                                  </html>`}
+	// ledgerExpiration defines how long sent delivery keys are kept in the ledger.
+	ledgerExpiration time.Duration = 48 * time.Hour
+
+	// ledgerTimeout is used to make a context with timeout for ledger operations.
+	ledgerTimeout time.Duration = 3 * time.Second
+
+	// ledgerPendingExpiration defines how long a delivery key is claimed while its' message is being sent.
+	// It must exceed the duration of all sending attempts, and the claim of a crashed process expires
+	// after it, so the redelivered message is sent.
+	ledgerPendingExpiration time.Duration = 3 * time.Minute
+
+	// ledgerWaitStep is the interval of checking a pending claim of another delivery of the same message.
+	ledgerWaitStep time.Duration = 500 * time.Millisecond
+
+	// ledgerPending is the value of claimed delivery key, while ledgerSentPrefix starts the value of
+	// delivery key of sent message.
+	ledgerPending    = "pending"
+	ledgerSentPrefix = "sent:"
 )
 
-// EmailServer embodies email sending service. It embeds
-// SMTPServer to send email messages, Kafka ConsumerGroup to get requests
-// from other services (meaning UserHandling), Logger to log events.
+// errDuplicate is returned when the daily message of the same delivery run was already sent to the user.
+var errDuplicate = fmt.Errorf("Duplicate daily message.")
+
+// EmailServer embodies email sending service. It uses Transport to send
+// email messages and embeds Logger to log events. Requests from other
+// services (meaning UserHandling) are received through message broker subscriber.
 type EmailServer struct {
-	*mail.SMTPServer
-	sarama.ConsumerGroup
 	zerolog.Logger
 
+	// transport is used to send email messages.
+	transport Transport
+
 	// connLimiter is a buffered channel used to limit a number of active connections.
 	connLimiter chan struct{}
 
+	// subscriber is used to receive requests from other services.
+	subscriber broker.Subscriber
+
+	// publisher is used to publish delivery receipts and requests which could not be delivered
+	// to dead letter topic.
+	publisher broker.Publisher
+
+	// ledger records keys of sent daily messages to skip duplicates. If it is nil,
+	// duplicates are not detected.
+	ledger data.Cache
+
+	// duplicatesSkipped counts skipped duplicate daily messages.
+	duplicatesSkipped int64
+
 	// mainServiceLocation defines a location of UserHandling service (i.e. HTTP proxy) to put
 	// it in templates.
 	mainServiceLocation string
 
 	// imageDirectory contains path to the directory with images.
 	imageDirectory string
+
+	// templateDirectory contains path to the directory with message templates.
+	templateDirectory string
+
+	// templates are the message templates used to render emails. They are replaced on reload.
+	templates atomic.Pointer[messageTemplates]
+
+	// checkedTemplatesVersion is the version of template files checked by the last reload.
+	checkedTemplatesVersion string
 }
 
-// NewEmailServer creates a new EmailServer instance using a file to configurate the SMTP Server,
-// path to the main service and broker addresses to create a consumer group and log producer.
-func NewEmailServer(emailInfoFilePath, mainServiceLocation, imageDirectory string, cg sarama.ConsumerGroup, lp sarama.SyncProducer) (returnedS *EmailServer, returnedErr error) {
-	s := &EmailServer{}
-	s.SMTPServer = mail.NewSMTPClient()
-	err := s.readEmailInfoFile(emailInfoFilePath)
-	if err != nil {
-		return nil, err
-	}
+// NewEmailServer creates a new EmailServer instance using a transport to send emails,
+// path to the main service, directories with images and message templates, message broker subscriber
+// to get requests and publisher to send logs, receipts and dead letters. Templates are validated at once.
+func NewEmailServer(transport Transport, mainServiceLocation, imageDirectory, templateDirectory string, subscriber broker.Subscriber, publisher broker.Publisher) (returnedS *EmailServer, returnedErr error) {
+	s := &EmailServer{transport: transport}
+	var err error
 	s.mainServiceLocation, err = s.defineMainServiceLocation(mainServiceLocation)
 	if err != nil {
 		return nil, err
 	}
 
-	if info, err := os.Stat(imageDirectory); err != nil {
+	if err := checkDirectory(imageDirectory); err != nil {
 		return nil, err
-	} else if !info.IsDir() {
-		return nil, fmt.Errorf("%s is not a directory.", imageDirectory)
 	}
 
 	s.imageDirectory = imageDirectory
 
-	s.Logger = zerolog.New(io.MultiWriter(os.Stderr, kafkawriter.New(lp))).With().Timestamp().Logger()
+	if err := checkDirectory(templateDirectory); err != nil {
+		return nil, err
+	}
+	templates, err := loadTemplates(templateDirectory)
+	if err != nil {
+		return nil, err
+	}
+	s.templateDirectory = templateDirectory
+	s.templates.Store(templates)
+	s.checkedTemplatesVersion = templates.version
+
+	s.Logger = zerolog.New(io.MultiWriter(os.Stderr, kafkawriter.New(publisher, sc.EmailServiceName))).With().Timestamp().Logger()
 
-	s.ConsumerGroup = cg
+	s.subscriber = subscriber
+
+	s.publisher = publisher
 
 	s.connLimiter = make(chan struct{}, maxConns)
 
@@ -139,6 +151,95 @@ func NewEmailServer(emailInfoFilePath, mainServiceLocation, imageDirectory strin
 	return s, nil
 }
 
+// SetLogWriter replaces the message broker writer of the logger (e.g. with asynchronous one).
+// Logs are still written to stderr too.
+func (s *EmailServer) SetLogWriter(w io.Writer) {
+	s.Logger = zerolog.New(io.MultiWriter(os.Stderr, w)).With().Timestamp().Logger()
+}
+
+// SetLedger sets the cache used to record sent daily messages, so repeated requests of the same
+// delivery run are skipped.
+func (s *EmailServer) SetLedger(ledger data.Cache) {
+	s.ledger = ledger
+}
+
+// DuplicatesSkipped returns the number of duplicate daily messages which were skipped.
+func (s *EmailServer) DuplicatesSkipped() int64 {
+	return atomic.LoadInt64(&s.duplicatesSkipped)
+}
+
+// claimDelivery records the delivery key in the ledger as pending. It returns errDuplicate if the message
+// is already sent. If another delivery of the same message is pending, claimDelivery waits until it is sent
+// or its' claim is released or expires. If the ledger is not set or unavailable, the delivery is allowed.
+// If ctx is done while waiting, its' error is returned.
+func (s *EmailServer) claimDelivery(ctx context.Context, deliveryKey string) error {
+	if s.ledger == nil || deliveryKey == "" {
+		return nil
+	}
+	deadline := time.Now().Add(ledgerPendingExpiration + ledgerWaitStep)
+	for {
+		value, claimed, err := s.tryClaimDelivery(deliveryKey)
+		if err != nil {
+			s.Error().Msgf("An error occured while accessing ledger, sending a daily message without deduplication: %v", err)
+			return nil
+		} else if claimed {
+			return nil
+		} else if value != ledgerPending {
+			return errDuplicate
+		} else if time.Now().After(deadline) {
+			s.Error().Msg("Daily message is pending for too long, sending it without deduplication.")
+			return nil
+		}
+		select {
+		case <-time.After(ledgerWaitStep):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryClaimDelivery tries to record the delivery key as pending. If the key is already recorded, it returns
+// its' value. If the key has just expired, it is reported as pending, so the claim is tried again.
+func (s *EmailServer) tryClaimDelivery(deliveryKey string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ledgerTimeout)
+	defer cancel()
+	claimed, err := s.ledger.SetNX(ctx, deliveryKey, ledgerPending, ledgerPendingExpiration)
+	if err != nil || claimed {
+		return "", claimed, err
+	}
+	value, err := s.ledger.Get(ctx, deliveryKey)
+	if err == data.CacheNil {
+		return ledgerPending, false, nil
+	}
+	return value, false, err
+}
+
+// confirmDelivery records the delivery key of sent message in the ledger, so next deliveries of the message
+// are skipped.
+func (s *EmailServer) confirmDelivery(deliveryKey string) {
+	if s.ledger == nil || deliveryKey == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ledgerTimeout)
+	defer cancel()
+	if err := s.ledger.Set(ctx, deliveryKey, ledgerSentPrefix+time.Now().UTC().Format(time.RFC3339), ledgerExpiration); err != nil {
+		s.Error().Msgf("An error occured while accessing ledger: %v", err)
+	}
+}
+
+// releaseDelivery removes the pending delivery key from the ledger after failed sending, so the request can be
+// delivered again (e.g. replayed from dead letter topic).
+func (s *EmailServer) releaseDelivery(deliveryKey string) {
+	if s.ledger == nil || deliveryKey == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), ledgerTimeout)
+	defer cancel()
+	if _, err := s.ledger.DelIfEqual(ctx, deliveryKey, ledgerPending); err != nil {
+		s.Error().Msgf("An error occured while accessing ledger: %v", err)
+	}
+}
+
 // Wait is used to lock main goroutine until all connections are closed.
 func (s *EmailServer) Wait() {
 	for len(s.connLimiter) != 0 {
@@ -147,14 +248,7 @@ func (s *EmailServer) Wait() {
 
 // SubscribeToTopics starts consuming incoming messages from other services.
 func (s *EmailServer) SubscribeToTopics(ctx context.Context) error {
-	for {
-		if err := s.Consume(ctx, []string{sc.AuthTopic, sc.DailyDeliveryTopic}, s); err != nil {
-			return err
-		}
-		if ctx.Err() != nil {
-			return nil
-		}
-	}
+	return s.subscriber.Subscribe(ctx, []string{sc.AuthTopic, sc.DailyDeliveryTopic}, s.HandleMessage)
 }
 
 // defineMainServiceLocation replaces "localhost" with external IP. Otherwise it returns given string.
@@ -172,131 +266,73 @@ func (s *EmailServer) defineMainServiceLocation(mainServiceLocation string) (str
 	return mainServiceLocation, nil
 }
 
-// readEmailInfoFile reads CSV data from file (with given filepath) and
-// sets SMTPServer fields.
-func (s *EmailServer) readEmailInfoFile(emailInfoFilePath string) error {
-	var err error
-	if !filepath.IsAbs(emailInfoFilePath) {
-		emailInfoFilePath, err = filepath.Abs(emailInfoFilePath)
-		if err != nil {
-			return err
-		}
-	}
-	emailInfoFile, err := os.Open(emailInfoFilePath)
-	if err != nil {
-		return err
-	}
-	defer emailInfoFile.Close()
-	csvReader := csv.NewReader(emailInfoFile)
-	emailInfo, err := csvReader.ReadAll()
-	if err != nil {
-		return err
-	}
-	infoCount := 0
-	for i := range emailInfo[0] {
-		infoCount++
-		switch emailInfo[0][i] {
-		case "Host":
-			s.SMTPServer.Host = emailInfo[1][i]
-		case "Port":
-			s.SMTPServer.Port, err = strconv.Atoi(emailInfo[1][i])
-			if err != nil {
-				return err
-			}
-		case "Username":
-			s.SMTPServer.Username = emailInfo[1][i]
-		case "Password":
-			s.SMTPServer.Password = emailInfo[1][i]
-		default:
-			infoCount--
-		}
-	}
-	if infoCount != emailInfoFieldAmount {
-		return fmt.Errorf("Invalid file %q: expected %d fields of info to parse, got %d.", emailInfoFilePath, emailInfoFieldAmount, infoCount)
-	}
-	s.SMTPServer.Encryption = mail.EncryptionSTARTTLS
-	s.SMTPServer.TLSConfig = &tls.Config{InsecureSkipVerify: true}
-	return nil
-}
-
-// createSMTPClient tries to create a SMTP client for several attempts.
+// sendMessage tries to send the message with the transport. Returns the number of made attempts.
 // If all attempts have failed, returns last error.
-func (s *EmailServer) createSMTPClient(email string) (*mail.SMTPClient, error) {
-	var client *mail.SMTPClient
+func (s *EmailServer) sendMessage(msg *mail.Email) (int, error) {
 	var err error
 	timeout := timeoutStep
 	for i := 0; i < sendAttemptsAmount; i++ {
-		client, err = s.Connect()
+		err = s.transport.Send(msg)
 		if err == nil {
-			return client, nil
+			return i + 1, nil
 		}
-		s.Error().Msgf("Can't create SMTP client for sending email to %q: %v", email, err)
+		s.Error().Msgf("Can't send email (attempt %d): %v", i+1, err)
 		time.Sleep(timeout)
 		timeout += timeoutStep
 	}
-	return nil, err
+	return sendAttemptsAmount, err
 }
 
-// sendMessage tries to send the message with given SMTP client.
-// If all attempts have failed, returns last error.
-func (s *EmailServer) sendMessage(msg *mail.Email, email string) error {
-	var err error
-	timeout := timeoutStep
-	for i := 0; i < sendAttemptsAmount; i++ {
-		client, err := s.createSMTPClient(email)
-		if err != nil {
-			return err
-		}
-		defer client.Close()
-		err = msg.Send(client)
-		if err == nil {
-			return nil
-		}
-		s.Error().Msgf("Can't send email to %q: %v", email, err)
-		time.Sleep(timeout)
-		timeout += timeoutStep
+// SendAuthMessage sends a new auth message in given language
+// using given email. Returns the number of sending attempts.
+func (s *EmailServer) SendAuthMessage(email, key, method, language string) (int, error) {
+	rendered, err := s.makeAuthMessage(key, method, language)
+	if err != nil {
+		return 0, err
 	}
-	return err
-}
-
-// SendAuthMessage creates a new SMTP connection through which sends a new auth message
-// using given email.
-func (s *EmailServer) SendAuthMessage(email, key, method string) error {
-	msg := mail.NewMSG()
-	msg.AddTo(email).SetSubject("Confirm action")
-	msgBody := s.makeAuthMessage(key, method)
-	msg.SetBody(mail.TextHTML, msgBody)
+	msg := newEmail(email, rendered)
 	if msg.Error != nil {
-		return msg.Error
+		return 0, msg.Error
 	}
-	err := s.sendMessage(msg, email)
-	return err
+	return s.sendMessage(msg)
 }
 
-// makeAuthMessage puts given key and method into template's placeholders.
-func (s *EmailServer) makeAuthMessage(key, method string) string {
-	return fmt.Sprintf(msgTemplates[method], s.mainServiceLocation, key)
+// makeAuthMessage renders auth message with given key using the templates of the method in given language.
+func (s *EmailServer) makeAuthMessage(key, method, language string) (*renderedMessage, error) {
+	return s.templates.Load().render(language, method, templateData{Link: s.mainServiceLocation + "/v1/auth/" + url.PathEscape(key)})
 }
 
-// SendDailyMessage creates a new SMTP connection through which sends a daily message
-// with random image using given email.
-func (s *EmailServer) SendDailyMessage(email, nickname string) error {
+// SendDailyMessage sends a daily message in given language
+// with random image using given email. Returns the number of sending attempts.
+func (s *EmailServer) SendDailyMessage(email, nickname, language string) (int, error) {
 	imgPath, err := s.chooseRandomImg()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	msg := mail.NewMSG()
-	msg.AddTo(email).SetSubject(dailyMsgSubjectName).SetListUnsubscribe(strings.Join([]string{"<", s.mainServiceLocation, "v1/unsubscribe/", nickname, ">"}, ""))
+	unsubscribeLink := s.mainServiceLocation + "/v1/unsubscribe/" + url.PathEscape(nickname)
 	attachedFileName := watermelonImgMailName + filepath.Ext(imgPath)
+	rendered, err := s.makeDailyMessage(nickname, attachedFileName, unsubscribeLink, language)
+	if err != nil {
+		return 0, err
+	}
+	msg := newEmail(email, rendered)
+	msg.SetListUnsubscribe("<" + unsubscribeLink + ">")
 	msg.Attach(&mail.File{FilePath: imgPath, Name: attachedFileName})
-	msgBody := s.makeDailyMessage(nickname, attachedFileName)
-	msg.SetBody(mail.TextHTML, msgBody)
 	if msg.Error != nil {
-		return msg.Error
+		return 0, msg.Error
 	}
-	err = s.sendMessage(msg, email)
-	return err
+	return s.sendMessage(msg)
+}
+
+// newEmail creates an email to given address with the rendered message. The plain text body is followed
+// by the HTML alternative, which is preferred by capable clients.
+func newEmail(email string, rendered *renderedMessage) *mail.Email {
+	msg := mail.NewMSG()
+	msg.AddTo(email).SetSubject(rendered.subject)
+	msg.SetBody(mail.TextPlain, rendered.text)
+	msg.AddAlternative(mail.TextHTML, rendered.html)
+	return msg
 }
 
 // chooseRandomImg picks a random image from imageDirectory.
@@ -318,56 +354,153 @@ func (s *EmailServer) chooseRandomImg() (string, error) {
 	return result, nil
 }
 
-// makeDailyMessage puts gives nickname and filename into template's placeholders.
-func (s *EmailServer) makeDailyMessage(nickname, filename string) string {
-	return fmt.Sprintf(msgTemplates[dailyDeliveryMethodName], nickname, filename)
+// makeDailyMessage renders daily message in given language with given nickname, filename of attached image
+// and unsubscribe link.
+func (s *EmailServer) makeDailyMessage(nickname, filename, unsubscribeLink, language string) (*renderedMessage, error) {
+	return s.templates.Load().render(language, dailyDeliveryMethodName, templateData{Nickname: nickname, Image: filename,
+		UnsubscribeLink: unsubscribeLink})
 }
 
-// Setup is defined to implement sarama.ConsumerGroupHandler
-func (s *EmailServer) Setup(session sarama.ConsumerGroupSession) error {
+// sendDeadLetter publishes the request which could not be delivered to dead letter topic
+// together with the error and the number of made attempts, so it can be inspected and replayed later.
+// The dead letter keeps the key and the trace context of the original message.
+func (s *EmailServer) sendDeadLetter(message *broker.Message, attempts int, sendErr error) error {
+	deadLetter, err := messages.NewDeadLetter(message.Topic, message.Value, attempts, sendErr)
+	if err != nil {
+		s.Error().Msgf("An error occured while creating dead letter: %v", err)
+		return err
+	}
+	value, err := deadLetter.Encode()
+	if err != nil {
+		s.Error().Msgf("An error occured while encoding dead letter: %v", err)
+		return err
+	}
+	err = s.publisher.Publish(&broker.Message{
+		Topic:   sc.DeadLetterTopic,
+		Key:     message.Key,
+		Value:   value,
+		Headers: deadLetter.Headers(sc.EmailServiceName, messages.ChildTraceParent(message.Headers[messages.HeaderTraceParent])),
+	})
+	if err != nil {
+		s.Error().Msgf("An error occured while sending dead letter to MB: %v", err)
+		return err
+	}
+	s.Info().Msgf("Request from topic %q is sent to dead letter topic.", message.Topic)
 	return nil
 }
 
-// Cleanup is defined to implement sarama.ConsumerGroupHandler
-func (s *EmailServer) Cleanup(session sarama.ConsumerGroupSession) error {
-	return nil
+// sendReceipt publishes the outcome of sending an email requested by the message to receipts topic,
+// so the main service can track deliveries of the user. The receipt is keyed by user's nickname.
+// Failed receipts are only logged, because they don't affect the delivery itself. Requests without
+// the user's nickname as key get no receipt.
+func (s *EmailServer) sendReceipt(message *broker.Message, attempts int, sendErr error) {
+	if message.Key == "" {
+		return
+	}
+	receipt, err := messages.NewDeliveryReceipt(message.Headers[messages.HeaderMessageID], message.Topic, message.Key,
+		attempts, sendErr)
+	if err != nil {
+		s.Error().Msgf("An error occured while creating delivery receipt: %v", err)
+		return
+	}
+	value, err := receipt.Encode()
+	if err != nil {
+		s.Error().Msgf("An error occured while encoding delivery receipt: %v", err)
+		return
+	}
+	err = s.publisher.Publish(&broker.Message{
+		Topic:   sc.ReceiptsTopic,
+		Key:     message.Key,
+		Value:   value,
+		Headers: receipt.Headers(sc.EmailServiceName, messages.ChildTraceParent(message.Headers[messages.HeaderTraceParent])),
+	})
+	if err != nil {
+		s.Error().Msgf("An error occured while sending delivery receipt to MB: %v", err)
+	}
 }
 
-// ConsumeClaim is defined to implement sarama.ConsumerGroupHandler and processes incoming messages, calling
-// corresponding method.
-func (s *EmailServer) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	for message := range claim.Messages() {
-		switch message.Topic {
-		case sc.AuthTopic:
-			authInfo := strings.Split(string(message.Value), " ")
-			go func() {
-				s.Info().Msg("Waiting for opening a connection...")
-				s.connLimiter <- struct{}{}
-				s.Info().Msgf("Connecting and sending an auth message with method %q to email %q", authInfo[2], authInfo[0])
-				err := s.SendAuthMessage(authInfo[0], authInfo[1], authInfo[2])
-				if err != nil {
-					s.Error().Msgf("All attempts to send a message have failed: %v", err)
-				} else {
-					s.Info().Msg("Successfully sent an email message.")
-				}
-				<-s.connLimiter
-			}()
-		case sc.DailyDeliveryTopic:
-			userInfo := strings.Split(string(message.Value), " ")
-			go func() {
-				s.Info().Msg("Waiting for opening a connection...")
-				s.connLimiter <- struct{}{}
-				s.Info().Msgf("Connecting and sending a daily message to email %q", userInfo[0])
-				err := s.SendDailyMessage(userInfo[0], userInfo[1])
-				if err != nil {
-					s.Error().Msgf("All attempts to send a message have failed: %v", err)
-				} else {
-					s.Info().Msg("Successfully sent an email message.")
-				}
-				<-s.connLimiter
-			}()
+// HandleMessage is the broker.Handler of incoming messages, which calls the corresponding method
+// in background. The message is done with commit after the outcome of sending is known (the email
+// is sent or the request is dead-lettered). Invalid messages are logged and committed at once. If ctx
+// is done before sending, the message is done without commit.
+func (s *EmailServer) HandleMessage(ctx context.Context, message *broker.Message, done func(commit bool)) {
+	headers := message.Headers
+	trace := headers[messages.HeaderTraceParent]
+	var send func() (int, error)
+	switch message.Topic {
+	case sc.AuthTopic:
+		authRequest, err := messages.DecodeAuthRequest(message.Value)
+		if err != nil {
+			s.Error().Msgf("Rejected invalid message %q from producer %q at offset %d of topic %q: %v",
+				headers[messages.HeaderMessageID], headers[messages.HeaderProducer], message.Offset, message.Topic, err)
+			break
+		}
+		send = func() (int, error) {
+			s.Info().Msgf("Connecting and sending an auth message %s (trace %s) with method %q", authRequest.ID, trace, authRequest.Method)
+			return s.SendAuthMessage(authRequest.Email, authRequest.Key, authRequest.Method, authRequest.Language)
+		}
+	case sc.DailyDeliveryTopic:
+		dailyDelivery, err := messages.DecodeDailyDelivery(message.Value)
+		if err != nil {
+			s.Error().Msgf("Rejected invalid message %q from producer %q at offset %d of topic %q: %v",
+				headers[messages.HeaderMessageID], headers[messages.HeaderProducer], message.Offset, message.Topic, err)
+			break
+		}
+		send = func() (int, error) {
+			if err := s.claimDelivery(ctx, dailyDelivery.DeliveryKey); err != nil {
+				return 0, err
+			}
+			s.Info().Msgf("Connecting and sending a daily message %s (trace %s)", dailyDelivery.ID, trace)
+			attempts, err := s.SendDailyMessage(dailyDelivery.Email, dailyDelivery.Nickname, dailyDelivery.Language)
+			if err != nil {
+				s.releaseDelivery(dailyDelivery.DeliveryKey)
+			} else {
+				s.confirmDelivery(dailyDelivery.DeliveryKey)
+			}
+			return attempts, err
 		}
-		session.MarkMessage(message, "")
 	}
-	return nil
+	if send == nil {
+		done(true)
+		return
+	}
+	go func() {
+		done(s.deliver(ctx, message, send))
+	}()
+}
+
+// deliver sends an email using given function, limiting the number of active connections, and publishes
+// a receipt with the outcome. If sending has failed, the message is published to dead letter topic.
+// Returns false if the message was neither sent nor dead-lettered, so it must not be committed, e.g. when
+// ctx is done before sending.
+func (s *EmailServer) deliver(ctx context.Context, message *broker.Message, send func() (int, error)) bool {
+	s.Info().Msg("Waiting for opening a connection...")
+	select {
+	case s.connLimiter <- struct{}{}:
+		defer func() { <-s.connLimiter }()
+	case <-ctx.Done():
+	}
+	attempts, err := 0, ctx.Err()
+	if err == nil {
+		attempts, err = send()
+	}
+	if err != nil && err == ctx.Err() {
+		s.Info().Msgf("Subscription has ended, message at offset %d of topic %q will be redelivered.", message.Offset, message.Topic)
+		return false
+	} else if err == errDuplicate {
+		skipped := atomic.AddInt64(&s.duplicatesSkipped, 1)
+		s.Info().Msgf("Skipped duplicate message at offset %d of topic %q (%d duplicates skipped).", message.Offset, message.Topic, skipped)
+		return true
+	}
+	s.sendReceipt(message, attempts, err)
+	if err == nil {
+		s.Info().Msg("Successfully sent an email message.")
+		return true
+	}
+	s.Error().Msgf("All attempts to send a message have failed: %v", err)
+	if err := s.sendDeadLetter(message, attempts, err); err != nil {
+		s.Error().Msgf("Message at offset %d of topic %q is not committed and will be redelivered.", message.Offset, message.Topic)
+		return false
+	}
+	return true
 }
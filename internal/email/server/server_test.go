@@ -1,12 +1,23 @@
 package email_server
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/xhit/go-simple-mail/v2"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
 )
 
 func TestDefineMainServiceLocationLocalhost(t *testing.T) {
@@ -30,22 +41,20 @@ func TestDefineMainServiceLocationExternalDomain(t *testing.T) {
 
 func TestReadEmailInfoFileCorrect(t *testing.T) {
 	testFilePath := "testdata/email_info.csv"
-	eServer := EmailServer{}
-	eServer.SMTPServer = mail.NewSMTPClient()
-	err := eServer.readEmailInfoFile(testFilePath)
+	server := mail.NewSMTPClient()
+	err := readEmailInfoFile(server, testFilePath)
 	if assert.Nil(t, err) {
-		assert.Equal(t, eServer.Host, "example.com")
-		assert.Equal(t, eServer.Port, 8000)
-		assert.Equal(t, eServer.Username, "username")
-		assert.Equal(t, eServer.Password, "password")
+		assert.Equal(t, server.Host, "example.com")
+		assert.Equal(t, server.Port, 8000)
+		assert.Equal(t, server.Username, "username")
+		assert.Equal(t, server.Password, "password")
 	}
 }
 
 func TestReadEmailInfoFileWrong(t *testing.T) {
 	testFilePath := "testdata/invalid_email_info.csv"
-	eServer := EmailServer{}
-	eServer.SMTPServer = mail.NewSMTPClient()
-	err := eServer.readEmailInfoFile(testFilePath)
+	server := mail.NewSMTPClient()
+	err := readEmailInfoFile(server, testFilePath)
 	assert.NotNil(t, err)
 }
 
@@ -59,3 +68,238 @@ func TestChooseRandomImg(t *testing.T) {
 		}
 	}
 }
+
+func TestHandleMessageRejectsInvalidMessages(t *testing.T) {
+	eServer := EmailServer{Logger: zerolog.Nop()}
+	for _, message := range []*broker.Message{
+		{Topic: sc.AuthTopic, Offset: 1, Value: []byte("arbuz@example.com")},
+		{Topic: sc.DailyDeliveryTopic, Offset: 2, Value: []byte(`{"version":1}`)},
+	} {
+		var committed []bool
+		assert.NotPanics(t, func() {
+			eServer.HandleMessage(context.Background(), message, func(commit bool) { committed = append(committed, commit) })
+		})
+		assert.Equal(t, []bool{true}, committed)
+	}
+}
+
+func TestSendDeadLetter(t *testing.T) {
+	memory := broker.NewMemory()
+	eServer := EmailServer{Logger: zerolog.Nop(), publisher: memory}
+	payload := []byte(`{"version":1,"id":"1","email":"arbuz@example.com","nickname":"arbuz"}`)
+	message := &broker.Message{
+		Topic:   sc.DailyDeliveryTopic,
+		Key:     "arbuz",
+		Value:   payload,
+		Headers: map[string]string{messages.HeaderTraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+	}
+	if !assert.Nil(t, eServer.sendDeadLetter(message, 2, fmt.Errorf("smtp is down"))) {
+		return
+	}
+	published := memory.Messages(sc.DeadLetterTopic)
+	if !assert.Len(t, published, 1) {
+		return
+	}
+	assert.Equal(t, "arbuz", published[0].Key)
+	deadLetter, err := messages.DecodeDeadLetter(published[0].Value)
+	if assert.Nil(t, err) {
+		assert.Equal(t, sc.DailyDeliveryTopic, deadLetter.Topic)
+		assert.Equal(t, "smtp is down", deadLetter.Error)
+		assert.Equal(t, 2, deadLetter.Attempts)
+		assert.Equal(t, string(payload), string(deadLetter.Payload))
+		assert.Equal(t, deadLetter.ID, published[0].Headers[messages.HeaderMessageID])
+	}
+	assert.Equal(t, sc.EmailServiceName, published[0].Headers[messages.HeaderProducer])
+	assert.True(t, strings.HasPrefix(published[0].Headers[messages.HeaderTraceParent], "00-0af7651916cd43dd8448eb211c80319c-"))
+}
+
+type fakeLedger struct {
+	data.Cache
+	mu   sync.Mutex
+	keys map[string]string
+}
+
+func (l *fakeLedger) SetNX(ctx context.Context, key, value string, expiration time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.keys[key]; ok {
+		return false, nil
+	}
+	l.keys[key] = value
+	return true, nil
+}
+
+func (l *fakeLedger) Get(ctx context.Context, key string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if value, ok := l.keys[key]; ok {
+		return value, nil
+	}
+	return "", data.CacheNil
+}
+
+func (l *fakeLedger) Set(ctx context.Context, key, value string, expiration time.Duration) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys[key] = value
+	return nil
+}
+
+func (l *fakeLedger) Del(ctx context.Context, key string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.keys, key)
+	return nil
+}
+
+func (l *fakeLedger) DelIfEqual(ctx context.Context, key, value string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.keys[key] != value {
+		return false, nil
+	}
+	delete(l.keys, key)
+	return true, nil
+}
+
+func TestClaimDelivery(t *testing.T) {
+	ledger := &fakeLedger{keys: map[string]string{}}
+	eServer := EmailServer{Logger: zerolog.Nop()}
+	eServer.SetLedger(ledger)
+	key := messages.DailyDeliveryKey("20221001T120000Z", "arbuz")
+	assert.Nil(t, eServer.claimDelivery(context.Background(), key))
+	value, _ := ledger.Get(context.Background(), key)
+	assert.Equal(t, ledgerPending, value)
+	eServer.releaseDelivery(key)
+	_, err := ledger.Get(context.Background(), key)
+	assert.Equal(t, data.CacheNil, err)
+
+	assert.Nil(t, eServer.claimDelivery(context.Background(), key))
+	eServer.confirmDelivery(key)
+	value, _ = ledger.Get(context.Background(), key)
+	assert.True(t, strings.HasPrefix(value, ledgerSentPrefix))
+	assert.Equal(t, errDuplicate, eServer.claimDelivery(context.Background(), key))
+	eServer.releaseDelivery(key)
+	assert.Equal(t, errDuplicate, eServer.claimDelivery(context.Background(), key))
+}
+
+func TestClaimDeliveryWaitsForPending(t *testing.T) {
+	ledger := &fakeLedger{keys: map[string]string{}}
+	eServer := EmailServer{Logger: zerolog.Nop()}
+	eServer.SetLedger(ledger)
+	sentKey := messages.DailyDeliveryKey("20221001T120000Z", "arbuz")
+	expiredKey := messages.DailyDeliveryKey("20221001T120000Z", "pupa")
+	ledger.keys[sentKey] = ledgerPending
+	ledger.keys[expiredKey] = ledgerPending
+	go func() {
+		time.Sleep(ledgerWaitStep / 2)
+		eServer.confirmDelivery(sentKey)
+		// the claim of crashed process expires
+		ledger.Del(context.Background(), expiredKey)
+	}()
+	assert.Equal(t, errDuplicate, eServer.claimDelivery(context.Background(), sentKey))
+	assert.Nil(t, eServer.claimDelivery(context.Background(), expiredKey))
+}
+
+func TestSubscribeSkipsDuplicateDailyMessages(t *testing.T) {
+	memory := broker.NewMemory()
+	ledger := &fakeLedger{keys: map[string]string{messages.DailyDeliveryKey("20221001T120000Z", "arbuz"): "sent"}}
+	eServer := EmailServer{Logger: zerolog.Nop(), connLimiter: make(chan struct{}, maxConns), subscriber: memory}
+	eServer.SetLedger(ledger)
+	delivery, err := messages.NewDailyDelivery("arbuz@example.com", "arbuz", "20221001T120000Z", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+	value, err := delivery.Encode()
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, memory.Publish(&broker.Message{Topic: sc.DailyDeliveryTopic, Key: "arbuz", Value: value}))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, eServer.SubscribeToTopics(ctx))
+	assert.Equal(t, int64(1), eServer.DuplicatesSkipped())
+	redelivered := 0
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Nil(t, memory.Subscribe(ctx, []string{sc.DailyDeliveryTopic}, func(ctx context.Context, msg *broker.Message, done func(bool)) {
+		redelivered++
+		done(true)
+	}))
+	assert.Equal(t, 0, redelivered)
+}
+
+func TestDeliverAfterSubscriptionEnded(t *testing.T) {
+	memory := broker.NewMemory()
+	eServer := EmailServer{Logger: zerolog.Nop(), connLimiter: make(chan struct{}, 1), publisher: memory}
+	eServer.connLimiter <- struct{}{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sent := false
+	message := &broker.Message{Topic: sc.AuthTopic, Key: "arbuz"}
+	assert.False(t, eServer.deliver(ctx, message, func() (int, error) {
+		sent = true
+		return 1, nil
+	}))
+	<-eServer.connLimiter
+	assert.False(t, eServer.deliver(ctx, message, func() (int, error) {
+		sent = true
+		return 1, nil
+	}))
+	assert.False(t, sent)
+	assert.Empty(t, memory.Messages(sc.ReceiptsTopic))
+	assert.Empty(t, memory.Messages(sc.DeadLetterTopic))
+}
+
+func TestDeliverPublishesReceipts(t *testing.T) {
+	memory := broker.NewMemory()
+	eServer := EmailServer{Logger: zerolog.Nop(), connLimiter: make(chan struct{}, maxConns), publisher: memory}
+	message := &broker.Message{
+		Topic:   sc.AuthTopic,
+		Key:     "arbuz",
+		Headers: map[string]string{messages.HeaderMessageID: "abc"},
+	}
+	assert.True(t, eServer.deliver(context.Background(), message, func() (int, error) { return 2, nil }))
+	assert.True(t, eServer.deliver(context.Background(), message, func() (int, error) { return sendAttemptsAmount, fmt.Errorf("550 Mailbox unavailable") }))
+	assert.True(t, eServer.deliver(context.Background(), message, func() (int, error) { return 0, errDuplicate }))
+	published := memory.Messages(sc.ReceiptsTopic)
+	if !assert.Len(t, published, 2) {
+		return
+	}
+	var receipts []*messages.DeliveryReceipt
+	for _, msg := range published {
+		assert.Equal(t, "arbuz", msg.Key)
+		receipt, err := messages.DecodeDeliveryReceipt(msg.Value)
+		if !assert.Nil(t, err) {
+			return
+		}
+		receipts = append(receipts, receipt)
+	}
+	assert.Equal(t, []string{messages.OutcomeSent, messages.OutcomeFailed}, []string{receipts[0].Outcome, receipts[1].Outcome})
+	assert.Equal(t, []int{2, sendAttemptsAmount}, []int{receipts[0].Attempts, receipts[1].Attempts})
+	assert.Equal(t, "abc", receipts[1].RequestID)
+	assert.Equal(t, sc.AuthTopic, receipts[1].RequestTopic)
+	assert.Equal(t, "550 Mailbox unavailable", receipts[1].SMTPResponse)
+	assert.Len(t, memory.Messages(sc.DeadLetterTopic), 1)
+}
+
+func TestDeliverDeadLetterAttempts(t *testing.T) {
+	memory := broker.NewMemory()
+	eServer := EmailServer{Logger: zerolog.Nop(), connLimiter: make(chan struct{}, maxConns), publisher: memory}
+	message := &broker.Message{Topic: sc.AuthTopic, Key: "arbuz"}
+	assert.True(t, eServer.deliver(context.Background(), message, func() (int, error) { return 0, fmt.Errorf("template is missing") }))
+	assert.True(t, eServer.deliver(context.Background(), message, func() (int, error) { return 3, fmt.Errorf("550 Mailbox unavailable") }))
+	published := memory.Messages(sc.DeadLetterTopic)
+	if !assert.Len(t, published, 2) {
+		return
+	}
+	var attempts []int
+	for _, msg := range published {
+		deadLetter, err := messages.DecodeDeadLetter(msg.Value)
+		if !assert.Nil(t, err) {
+			return
+		}
+		attempts = append(attempts, deadLetter.Attempts)
+	}
+	assert.Equal(t, []int{0, 3}, attempts)
+}
@@ -0,0 +1,219 @@
+package email_server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xhit/go-simple-mail/v2"
+)
+
+const (
+	// smtpConnMaxLifetime limits how long a SMTP connection is reused, so connections are renewed
+	// even if they are always busy.
+	smtpConnMaxLifetime time.Duration = 5 * time.Minute
+
+	// smtpConnMaxMessages limits the number of emails sent through one SMTP connection, because
+	// servers often refuse to accept more messages in one session.
+	smtpConnMaxMessages = 100
+
+	// smtpCommandTimeout limits waiting for the answer to NOOP, RSET and QUIT of pooled connections,
+	// so a server which stopped answering doesn't block the sender.
+	smtpCommandTimeout time.Duration = 10 * time.Second
+)
+
+// errTransportClosed is returned by SMTPTransport after it was closed.
+var errTransportClosed = fmt.Errorf("Mail transport is closed.")
+
+// smtpConn is a pooled SMTP connection.
+type smtpConn struct {
+	client *mail.SMTPClient
+
+	// created is the time when the connection was established.
+	created time.Time
+
+	// messages is the number of emails sent through the connection.
+	messages int
+}
+
+// command runs the SMTP command, waiting for the answer at most timeout. The client doesn't expose
+// its' connection to set a deadline, so on timeout the connection is closed, which unblocks the command.
+func (c *smtpConn) command(run func() error, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- run() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		c.client.Close()
+		return fmt.Errorf("SMTP server didn't answer in %v.", timeout)
+	}
+}
+
+// close quits the SMTP session and closes the connection.
+func (c *smtpConn) close(timeout time.Duration) {
+	c.command(c.client.Quit, timeout)
+	c.client.Close()
+}
+
+// SMTPTransport sends emails through SMTP server. Connections are kept alive and reused by next emails:
+// at most maxConns connections are open, every one of them is reset with RSET after an email, checked
+// with NOOP before reuse and closed after smtpConnMaxLifetime or smtpConnMaxMessages emails.
+type SMTPTransport struct {
+	server *mail.SMTPServer
+
+	// slots is a buffered channel used to limit a number of open connections.
+	slots chan struct{}
+
+	// maxLifetime and maxMessages limit the reuse of a connection.
+	maxLifetime time.Duration
+	maxMessages int
+
+	// commandTimeout limits waiting for the answer to NOOP, RSET and QUIT.
+	commandTimeout time.Duration
+
+	// mu guards idle connections and closed flag.
+	mu     sync.Mutex
+	idle   []*smtpConn
+	closed bool
+}
+
+// newSMTPTransport creates a new SMTPTransport with connection pool for given SMTP server.
+func newSMTPTransport(server *mail.SMTPServer) *SMTPTransport {
+	server.KeepAlive = true
+	return &SMTPTransport{
+		server:         server,
+		slots:          make(chan struct{}, maxConns),
+		maxLifetime:    smtpConnMaxLifetime,
+		maxMessages:    smtpConnMaxMessages,
+		commandTimeout: smtpCommandTimeout,
+	}
+}
+
+// Send sends the email through an idle connection or a new one, if there are no healthy idle connections.
+// The connection is returned to the pool after the email is sent, while a connection which failed to send
+// it is closed without QUIT, because its' SMTP session may be left in unknown state.
+func (t *SMTPTransport) Send(msg *mail.Email) error {
+	if msg.Error != nil {
+		return msg.Error
+	}
+	t.slots <- struct{}{}
+	defer func() { <-t.slots }()
+	conn, err := t.get()
+	if err != nil {
+		return err
+	}
+	conn.messages++
+	if err := msg.Send(conn.client); err != nil {
+		conn.client.Close()
+		return err
+	}
+	t.put(conn)
+	return nil
+}
+
+// get takes the most recently used idle connection which is still healthy (answers NOOP in time)
+// or connects to SMTP server.
+func (t *SMTPTransport) get() (*smtpConn, error) {
+	for {
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			return nil, errTransportClosed
+		}
+		if len(t.idle) == 0 {
+			t.mu.Unlock()
+			break
+		}
+		conn := t.idle[len(t.idle)-1]
+		t.idle = t.idle[:len(t.idle)-1]
+		t.mu.Unlock()
+		if t.expired(conn) {
+			conn.close(t.commandTimeout)
+			continue
+		}
+		if err := conn.command(conn.client.Noop, t.commandTimeout); err != nil {
+			conn.client.Close()
+			continue
+		}
+		return conn, nil
+	}
+	client, err := t.connect()
+	if err != nil {
+		return nil, fmt.Errorf("Can't connect to SMTP server: %v", err)
+	}
+	return &smtpConn{client: client, created: time.Now()}, nil
+}
+
+// connect connects to SMTP server. The client skips STARTTLS if the server doesn't offer it, so with
+// STARTTLS encryption the connection is refused unless TLS handshake was made, instead of sending
+// the password and emails in clear text.
+func (t *SMTPTransport) connect() (*mail.SMTPClient, error) {
+	if t.server.Encryption != mail.EncryptionSTARTTLS {
+		return t.server.Connect()
+	}
+	var secured int32
+	server := *t.server
+	if server.TLSConfig = t.server.TLSConfig.Clone(); server.TLSConfig == nil {
+		server.TLSConfig = &tls.Config{ServerName: server.Host}
+	}
+	server.TLSConfig.VerifyConnection = func(tls.ConnectionState) error {
+		atomic.StoreInt32(&secured, 1)
+		return nil
+	}
+	client, err := server.Connect()
+	if err != nil {
+		return nil, err
+	} else if atomic.LoadInt32(&secured) == 0 {
+		client.Close()
+		return nil, fmt.Errorf("SMTP server doesn't support STARTTLS.")
+	}
+	return client, nil
+}
+
+// put returns the connection to the pool. The connection is closed instead, if it has reached its' limits
+// or the transport is closed. The SMTP transaction is cleared with RSET, so the next email starts afresh.
+func (t *SMTPTransport) put(conn *smtpConn) {
+	if t.expired(conn) {
+		conn.close(t.commandTimeout)
+		return
+	}
+	// the client resets KeepAlive connections by itself only when sending with timeout
+	if t.server.SendTimeout == 0 {
+		if err := conn.command(conn.client.Reset, t.commandTimeout); err != nil {
+			conn.client.Close()
+			return
+		}
+	}
+	t.mu.Lock()
+	if !t.closed {
+		t.idle = append(t.idle, conn)
+		t.mu.Unlock()
+		return
+	}
+	t.mu.Unlock()
+	conn.close(t.commandTimeout)
+}
+
+// expired checks whether the connection has reached its' lifetime or messages limit.
+func (t *SMTPTransport) expired(conn *smtpConn) bool {
+	return conn.messages >= t.maxMessages || time.Since(conn.created) >= t.maxLifetime
+}
+
+// Close closes idle connections. Connections which are in use are closed after sending, and
+// next emails are not sent.
+func (t *SMTPTransport) Close() error {
+	t.mu.Lock()
+	idle := t.idle
+	t.idle = nil
+	t.closed = true
+	t.mu.Unlock()
+	for _, conn := range idle {
+		conn.close(t.commandTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,328 @@
+package email_server
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xhit/go-simple-mail/v2"
+)
+
+// fakeSMTPServer is a minimal SMTP server which accepts all emails and counts connections and commands.
+type fakeSMTPServer struct {
+	listener net.Listener
+
+	// tlsConfig enables STARTTLS or, if the listener is wrapped with TLS, is used for implicit TLS.
+	tlsConfig *tls.Config
+
+	mu          sync.Mutex
+	conns       []net.Conn
+	connections int
+	messages    int
+	commands    map[string]int
+
+	// silent is the command which the server doesn't answer, like a stuck server.
+	silent string
+}
+
+// startFakeSMTPServer starts a fakeSMTPServer without TLS on a random local port. It is stopped with the test.
+func startFakeSMTPServer(t *testing.T) *fakeSMTPServer {
+	return startFakeSMTPServerTLS(t, nil, false)
+}
+
+// startFakeSMTPServerTLS starts a fakeSMTPServer which offers STARTTLS or, if implicit is true, accepts
+// only TLS connections with given config.
+func startFakeSMTPServerTLS(t *testing.T, tlsConfig *tls.Config, implicit bool) *fakeSMTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start fake SMTP server: %v", err)
+	}
+	f := &fakeSMTPServer{listener: listener, commands: make(map[string]int)}
+	if implicit {
+		listener = tls.NewListener(listener, tlsConfig)
+	} else {
+		f.tlsConfig = tlsConfig
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.connections++
+			f.conns = append(f.conns, conn)
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		f.dropConnections()
+	})
+	return f
+}
+
+func (f *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 localhost ESMTP")
+	secured := false
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		f.mu.Lock()
+		f.commands[command]++
+		silent := f.silent == command
+		f.mu.Unlock()
+		if silent {
+			continue
+		}
+		switch command {
+		case "EHLO", "HELO":
+			if f.tlsConfig != nil && !secured {
+				text.PrintfLine("250-localhost")
+				text.PrintfLine("250 STARTTLS")
+			} else {
+				text.PrintfLine("250 localhost")
+			}
+		case "STARTTLS":
+			text.PrintfLine("220 Ready to start TLS")
+			tlsConn := tls.Server(conn, f.tlsConfig)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			text = textproto.NewConn(tlsConn)
+			secured = true
+		case "MAIL", "RCPT", "RSET", "NOOP":
+			text.PrintfLine("250 OK")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			if _, err := text.ReadDotBytes(); err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.messages++
+			f.mu.Unlock()
+			text.PrintfLine("250 OK")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("502 Command not implemented")
+		}
+	}
+}
+
+// dropConnections closes all accepted connections, as servers do with idle clients.
+func (f *fakeSMTPServer) dropConnections() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, conn := range f.conns {
+		conn.Close()
+	}
+	f.conns = nil
+}
+
+// stats returns the number of accepted connections, received messages and given command.
+func (f *fakeSMTPServer) stats(command string) (int, int, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connections, f.messages, f.commands[command]
+}
+
+// newTestSMTPTransport creates a SMTPTransport connected to the fake server without encryption.
+func newTestSMTPTransport(f *fakeSMTPServer) *SMTPTransport {
+	server := mail.NewSMTPClient()
+	address := f.listener.Addr().(*net.TCPAddr)
+	server.Host = address.IP.String()
+	server.Port = address.Port
+	server.Encryption = mail.EncryptionNone
+	return newSMTPTransport(server)
+}
+
+func TestSMTPTransportReusesConnections(t *testing.T) {
+	f := startFakeSMTPServer(t)
+	transport := newTestSMTPTransport(f)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, transport.Send(newTestEmail()))
+	}
+	connections, messages, noops := f.stats("NOOP")
+	assert.Equal(t, 1, connections)
+	assert.Equal(t, 3, messages)
+	assert.Equal(t, 2, noops)
+	_, _, resets := f.stats("RSET")
+	assert.Equal(t, 3, resets)
+
+	assert.Nil(t, transport.Close())
+	assert.Eventually(t, func() bool {
+		_, _, quits := f.stats("QUIT")
+		return quits == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, errTransportClosed, transport.Send(newTestEmail()))
+}
+
+func TestSMTPTransportLimits(t *testing.T) {
+	f := startFakeSMTPServer(t)
+	transport := newTestSMTPTransport(f)
+	transport.maxMessages = 2
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, transport.Send(newTestEmail()))
+	}
+	connections, messages, _ := f.stats("")
+	assert.Equal(t, 2, connections)
+	assert.Equal(t, 3, messages)
+
+	transport.maxLifetime = time.Nanosecond
+	assert.Nil(t, transport.Send(newTestEmail()))
+	connections, _, _ = f.stats("")
+	assert.Equal(t, 3, connections)
+}
+
+func TestSMTPTransportReconnects(t *testing.T) {
+	f := startFakeSMTPServer(t)
+	transport := newTestSMTPTransport(f)
+	assert.Nil(t, transport.Send(newTestEmail()))
+	f.dropConnections()
+	assert.Nil(t, transport.Send(newTestEmail()))
+	connections, messages, _ := f.stats("")
+	assert.Equal(t, 2, connections)
+	assert.Equal(t, 2, messages)
+}
+
+func TestSMTPTransportStuckServer(t *testing.T) {
+	f := startFakeSMTPServer(t)
+	transport := newTestSMTPTransport(f)
+	transport.commandTimeout = 50 * time.Millisecond
+	assert.Nil(t, transport.Send(newTestEmail()))
+	f.mu.Lock()
+	f.silent = "NOOP"
+	f.mu.Unlock()
+	start := time.Now()
+	assert.Nil(t, transport.Send(newTestEmail()))
+	assert.Less(t, time.Since(start), time.Second)
+	connections, messages, _ := f.stats("")
+	assert.Equal(t, 2, connections)
+	assert.Equal(t, 2, messages)
+
+	f.mu.Lock()
+	f.silent = "QUIT"
+	f.mu.Unlock()
+	start = time.Now()
+	assert.Nil(t, transport.Close())
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestSMTPTransportLimitsConnections(t *testing.T) {
+	f := startFakeSMTPServer(t)
+	transport := newTestSMTPTransport(f)
+	var wg sync.WaitGroup
+	for i := 0; i < 5*maxConns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, transport.Send(newTestEmail()))
+		}()
+	}
+	wg.Wait()
+	connections, messages, _ := f.stats("")
+	assert.LessOrEqual(t, connections, maxConns)
+	assert.Equal(t, 5*maxConns, messages)
+	transport.mu.Lock()
+	assert.Equal(t, connections, len(transport.idle))
+	transport.mu.Unlock()
+}
+
+func TestSMTPTransportConnectError(t *testing.T) {
+	f := startFakeSMTPServer(t)
+	transport := newTestSMTPTransport(f)
+	f.listener.Close()
+	assert.NotNil(t, transport.Send(newTestEmail()))
+	assert.Len(t, transport.slots, 0)
+}
+
+// testCertificate returns TLS config with the certificate of httptest package (valid for 127.0.0.1 and
+// example.com) and the path to the file with it, which can be used as CA certificate.
+func testCertificate(t *testing.T) (*tls.Config, string) {
+	ts := httptest.NewTLSServer(nil)
+	defer ts.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := os.WriteFile(caFile, caPEM, 0o644); err != nil {
+		t.Fatalf("Failed to write CA certificate: %v", err)
+	}
+	return &tls.Config{Certificates: ts.TLS.Certificates}, caFile
+}
+
+// newSecuredTestSMTPTransport creates a SMTPTransport connected to the fake server with given security settings.
+func newSecuredTestSMTPTransport(f *fakeSMTPServer, conf TransportConfig) (*SMTPTransport, error) {
+	server := mail.NewSMTPClient()
+	address := f.listener.Addr().(*net.TCPAddr)
+	server.Host = address.IP.String()
+	server.Port = address.Port
+	conf.SMTPAuth = "none"
+	if err := configureSMTPSecurity(server, conf); err != nil {
+		return nil, err
+	}
+	return newSMTPTransport(server), nil
+}
+
+func TestSMTPTransportSTARTTLS(t *testing.T) {
+	tlsConfig, caFile := testCertificate(t)
+	f := startFakeSMTPServerTLS(t, tlsConfig, false)
+	transport, err := newSecuredTestSMTPTransport(f, TransportConfig{SMTPCAFile: caFile})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, transport.Send(newTestEmail()))
+	_, messages, starttls := f.stats("STARTTLS")
+	assert.Equal(t, 1, messages)
+	assert.Equal(t, 1, starttls)
+
+	transport, err = newSecuredTestSMTPTransport(f, TransportConfig{})
+	if assert.Nil(t, err) {
+		assert.NotNil(t, transport.Send(newTestEmail()))
+	}
+
+	plain := startFakeSMTPServer(t)
+	transport, err = newSecuredTestSMTPTransport(plain, TransportConfig{SMTPCAFile: caFile})
+	if assert.Nil(t, err) {
+		err = transport.Send(newTestEmail())
+		if assert.NotNil(t, err) {
+			assert.Contains(t, err.Error(), "STARTTLS")
+		}
+	}
+	_, messages, _ = plain.stats("")
+	assert.Equal(t, 0, messages)
+}
+
+func TestSMTPTransportImplicitTLS(t *testing.T) {
+	tlsConfig, caFile := testCertificate(t)
+	f := startFakeSMTPServerTLS(t, tlsConfig, true)
+	transport, err := newSecuredTestSMTPTransport(f, TransportConfig{SMTPEncryption: "tls", SMTPCAFile: caFile,
+		SMTPServerName: "example.com"})
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, transport.Send(newTestEmail()))
+	_, messages, _ := f.stats("")
+	assert.Equal(t, 1, messages)
+
+	transport, err = newSecuredTestSMTPTransport(f, TransportConfig{SMTPEncryption: "tls", SMTPCAFile: caFile,
+		SMTPServerName: "relay.example.org"})
+	if assert.Nil(t, err) {
+		assert.NotNil(t, transport.Send(newTestEmail()))
+	}
+}
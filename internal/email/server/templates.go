@@ -0,0 +1,309 @@
+package email_server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/KSpaceer/go_watermelon/internal/data"
+)
+
+const (
+	// layoutsDirectory is the subdirectory of template directory with shared layouts.
+	layoutsDirectory = "layouts"
+
+	// layoutTemplateName is the name of template which renders the whole message body. It must be
+	// defined by a layout and include "content" template defined by the message's body template.
+	layoutTemplateName = "layout"
+
+	// *TemplateExt consts define extensions of body, plain text and subject templates of messages.
+	bodyTemplateExt    = ".html"
+	textTemplateExt    = ".txt"
+	subjectTemplateExt = ".subject.txt"
+
+	// defaultLanguage is the name of default (English) language, whose templates are in the root of
+	// template directory and are used when there are no templates of the requested language.
+	defaultLanguage = ""
+)
+
+// languageNamePattern matches names of subdirectories with localized templates.
+var languageNamePattern = regexp.MustCompile(`^[a-z]{2,8}$`)
+
+// templateFiles maps message types (auth methods and dailyDeliveryMethodName) to base names of their
+// template files. Every message type must have both body and subject templates, while plain text
+// template is optional.
+var templateFiles = map[string]string{
+	string(data.OperationAdd):         "subscribe",
+	string(data.OperationDelete):      "unsubscribe",
+	string(data.OperationExport):      "export",
+	string(data.OperationChangeEmail): "change_email",
+	string(data.OperationPause):       "pause",
+	dailyDeliveryMethodName:           "daily",
+}
+
+// templateData contains the values available in message templates.
+type templateData struct {
+	// Nickname is the user's nickname (daily messages only).
+	Nickname string
+
+	// Link is the confirmation link of auth messages.
+	Link string
+
+	// Image is the content ID of attached image in daily messages.
+	Image string
+
+	// UnsubscribeLink is the link to unsubscribe from daily messages.
+	UnsubscribeLink string
+}
+
+// sampleTemplateData is used to validate templates when they are loaded.
+var sampleTemplateData = templateData{
+	Nickname:        "arbuz",
+	Link:            "https://example.com/v1/auth/key",
+	Image:           watermelonImgMailName + ".jpg",
+	UnsubscribeLink: "https://example.com/v1/unsubscribe/arbuz",
+}
+
+// languageTemplates contains parsed body, plain text and subject templates of all message types in one
+// language. If a message type has no plain text template, its' text is converted from the HTML body.
+type languageTemplates struct {
+	bodies   map[string]*htmltemplate.Template
+	texts    map[string]*texttemplate.Template
+	subjects map[string]*texttemplate.Template
+}
+
+// messageTemplates contains templates of the default language (English) and localized ones.
+type messageTemplates struct {
+	// languages maps language names to their templates. The default language has empty name.
+	languages map[string]*languageTemplates
+
+	// version identifies the state of template files, so their changes can be detected.
+	version string
+}
+
+// loadTemplates parses templates of the default language from given directory and localized templates
+// from its' subdirectories named by languages (e.g. "ru"). A localized subdirectory may contain only
+// a part of files, the rest is taken from the default language. Bodies are parsed with html/template,
+// so the values are escaped according to their context. Every template is executed with sample data,
+// so missing or broken templates are reported at once.
+func loadTemplates(directory string) (*messageTemplates, error) {
+	version, err := templatesVersion(directory)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(directory)
+	if err != nil {
+		return nil, err
+	}
+	templates := &messageTemplates{languages: make(map[string]*languageTemplates), version: version}
+	languages := []string{defaultLanguage}
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != layoutsDirectory && languageNamePattern.MatchString(entry.Name()) {
+			languages = append(languages, entry.Name())
+		}
+	}
+	for _, language := range languages {
+		if templates.languages[language], err = loadLanguageTemplates(directory, language); err != nil {
+			return nil, err
+		}
+	}
+	for _, language := range languages {
+		for messageType, name := range templateFiles {
+			if _, err := templates.render(language, messageType, sampleTemplateData); err != nil {
+				return nil, fmt.Errorf("Invalid template %q of language %q: %v", name, language, err)
+			}
+		}
+	}
+	return templates, nil
+}
+
+// loadLanguageTemplates parses templates of given language. The plain text template is taken from the same
+// directory as the body, so the text is not left in the default language when the body is localized.
+func loadLanguageTemplates(directory, language string) (*languageTemplates, error) {
+	layouts, err := filepath.Glob(filepath.Join(directory, language, layoutsDirectory, "*"+bodyTemplateExt))
+	if err != nil {
+		return nil, err
+	} else if len(layouts) == 0 && language != defaultLanguage {
+		layouts, err = filepath.Glob(filepath.Join(directory, layoutsDirectory, "*"+bodyTemplateExt))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(layouts) == 0 {
+		return nil, fmt.Errorf("There are no layouts in directory %q.", filepath.Join(directory, layoutsDirectory))
+	}
+	base, err := htmltemplate.ParseFiles(layouts...)
+	if err != nil {
+		return nil, err
+	}
+	templates := &languageTemplates{
+		bodies:   make(map[string]*htmltemplate.Template),
+		texts:    make(map[string]*texttemplate.Template),
+		subjects: make(map[string]*texttemplate.Template),
+	}
+	for messageType, name := range templateFiles {
+		bodyDirectory := localizedDirectory(directory, language, name+bodyTemplateExt)
+		body, err := base.Clone()
+		if err != nil {
+			return nil, err
+		}
+		if body, err = body.ParseFiles(filepath.Join(bodyDirectory, name+bodyTemplateExt)); err != nil {
+			return nil, err
+		}
+		subjectDirectory := localizedDirectory(directory, language, name+subjectTemplateExt)
+		subject, err := texttemplate.ParseFiles(filepath.Join(subjectDirectory, name+subjectTemplateExt))
+		if err != nil {
+			return nil, err
+		}
+		textFile := filepath.Join(bodyDirectory, name+textTemplateExt)
+		if _, err := os.Stat(textFile); err == nil {
+			text, err := texttemplate.ParseFiles(textFile)
+			if err != nil {
+				return nil, err
+			}
+			templates.texts[messageType] = text
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+		templates.bodies[messageType] = body
+		templates.subjects[messageType] = subject
+	}
+	return templates, nil
+}
+
+// localizedDirectory returns the subdirectory of given language, if it contains the file,
+// or the directory of default language otherwise.
+func localizedDirectory(directory, language, file string) string {
+	if language != defaultLanguage {
+		if _, err := os.Stat(filepath.Join(directory, language, file)); err == nil {
+			return filepath.Join(directory, language)
+		}
+	}
+	return directory
+}
+
+// renderedMessage contains the subject and bodies of a message ready to be sent.
+type renderedMessage struct {
+	subject string
+	html    string
+	text    string
+}
+
+// render executes templates of given message type in given language or, if there are no templates of
+// the language, in the default one. The subject is folded into one line, so the values can't add headers
+// to the email.
+func (t *messageTemplates) render(language, messageType string, data templateData) (*renderedMessage, error) {
+	templates, ok := t.languages[language]
+	if !ok {
+		templates = t.languages[defaultLanguage]
+	}
+	body, ok := templates.bodies[messageType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown message type %q.", messageType)
+	}
+	var subject, content bytes.Buffer
+	if err := templates.subjects[messageType].Execute(&subject, data); err != nil {
+		return nil, err
+	}
+	if err := body.ExecuteTemplate(&content, layoutTemplateName, data); err != nil {
+		return nil, err
+	}
+	message := &renderedMessage{subject: strings.Join(strings.Fields(subject.String()), " "), html: content.String()}
+	if message.subject == "" {
+		return nil, fmt.Errorf("Empty subject of message type %q.", messageType)
+	}
+	if text, ok := templates.texts[messageType]; ok {
+		var plain bytes.Buffer
+		if err := text.Execute(&plain, data); err != nil {
+			return nil, err
+		}
+		message.text = plain.String()
+	} else {
+		var err error
+		if message.text, err = htmlToText(message.html); err != nil {
+			return nil, err
+		}
+	}
+	return message, nil
+}
+
+// templatesVersion returns a string which changes when a file in template directory is added,
+// removed or modified.
+func templatesVersion(directory string) (string, error) {
+	var files int
+	var lastModified time.Time
+	err := filepath.WalkDir(directory, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		files++
+		if info.ModTime().After(lastModified) {
+			lastModified = info.ModTime()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d/%d", files, lastModified.UnixNano()), nil
+}
+
+// WatchTemplates checks the template directory every interval until ctx is done and reloads
+// templates when its' files are changed. If new templates are invalid, the error is logged and
+// the previous templates are kept.
+func (s *EmailServer) WatchTemplates(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reloadTemplates()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// reloadTemplates loads templates again if the template directory was changed since the last check.
+// Invalid templates are reported once until they are changed again.
+func (s *EmailServer) reloadTemplates() {
+	version, err := templatesVersion(s.templateDirectory)
+	if err != nil {
+		s.Error().Msgf("An error occured while checking templates: %v", err)
+		return
+	} else if version == s.checkedTemplatesVersion {
+		return
+	}
+	s.checkedTemplatesVersion = version
+	templates, err := loadTemplates(s.templateDirectory)
+	if err != nil {
+		s.Error().Msgf("Failed to reload templates, previous ones are kept: %v", err)
+		return
+	}
+	s.templates.Store(templates)
+	s.Info().Msgf("Reloaded templates from directory %q.", s.templateDirectory)
+}
+
+// checkDirectory returns an error if the path is not an existing directory.
+func checkDirectory(path string) error {
+	if info, err := os.Stat(path); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory.", path)
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package email_server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+const testTemplateDirectory = "../../../templates"
+
+func TestLoadTemplatesEscapesValues(t *testing.T) {
+	templates, err := loadTemplates(testTemplateDirectory)
+	if !assert.Nil(t, err) {
+		return
+	}
+	for messageType := range templateFiles {
+		_, err := templates.render(defaultLanguage, messageType, sampleTemplateData)
+		assert.Nil(t, err)
+	}
+	message, err := templates.render(defaultLanguage, dailyDeliveryMethodName, templateData{Nickname: `<a href="https://evil.com">arbuz</a>`,
+		Image: "watermelon.jpg"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Daily watermelon", message.subject)
+		assert.Contains(t, message.html, "Have a nice day, &lt;a href=&#34;https://evil.com&#34;&gt;arbuz&lt;/a&gt;!")
+		assert.Contains(t, message.html, `src="cid:watermelon.jpg"`)
+		assert.Contains(t, message.html, "<title>Here comes watermelon</title>")
+	}
+	_, err = templates.render(defaultLanguage, "UNKNOWN", sampleTemplateData)
+	assert.NotNil(t, err)
+}
+
+// copyTemplates copies the default templates into a temporary directory.
+func copyTemplates(t *testing.T) string {
+	directory := t.TempDir()
+	err := filepath.Walk(testTemplateDirectory, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(directory, path[len(testTemplateDirectory):])
+		if info.IsDir() {
+			return os.MkdirAll(target, 0o755)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, 0o644)
+	})
+	if err != nil {
+		t.Fatalf("Failed to copy templates: %v", err)
+	}
+	return directory
+}
+
+func TestLoadTemplatesInvalid(t *testing.T) {
+	directory := copyTemplates(t)
+	assert.Nil(t, os.WriteFile(filepath.Join(directory, "daily.html"), []byte(`{{define "content"}}{{.Unknown}}{{end}}`), 0o644))
+	_, err := loadTemplates(directory)
+	assert.NotNil(t, err)
+	assert.Nil(t, os.Remove(filepath.Join(directory, "daily.html")))
+	_, err = loadTemplates(directory)
+	assert.NotNil(t, err)
+}
+
+func TestReloadTemplates(t *testing.T) {
+	directory := copyTemplates(t)
+	templates, err := loadTemplates(directory)
+	if !assert.Nil(t, err) {
+		return
+	}
+	eServer := EmailServer{Logger: zerolog.Nop(), templateDirectory: directory, checkedTemplatesVersion: templates.version}
+	eServer.templates.Store(templates)
+	subjectFile := filepath.Join(directory, "daily.subject.txt")
+	modified := time.Now().Add(time.Minute)
+
+	assert.Nil(t, os.WriteFile(subjectFile, []byte("{{.Unknown}}"), 0o644))
+	assert.Nil(t, os.Chtimes(subjectFile, modified, modified))
+	eServer.reloadTemplates()
+	assert.Same(t, templates, eServer.templates.Load())
+
+	assert.Nil(t, os.WriteFile(subjectFile, []byte("Watermelon for\n{{.Nickname}}\n"), 0o644))
+	assert.Nil(t, os.Chtimes(subjectFile, modified.Add(time.Minute), modified.Add(time.Minute)))
+	eServer.reloadTemplates()
+	message, err := eServer.templates.Load().render(defaultLanguage, dailyDeliveryMethodName, sampleTemplateData)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Watermelon for arbuz", message.subject)
+	}
+}
+
+func TestRenderPlainText(t *testing.T) {
+	directory := copyTemplates(t)
+	templates, err := loadTemplates(directory)
+	if !assert.Nil(t, err) {
+		return
+	}
+	message, err := templates.render(defaultLanguage, "ADD", templateData{Link: "https://example.com/v1/auth/key"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Hi! This is confirm message for subscribing to watermelon photo daily delivery service.\n\n"+
+			"If you didn't try to subscribe, ignore this message.\n\n"+
+			"Otherwise, click here (https://example.com/v1/auth/key)\n", message.text)
+	}
+	assert.Nil(t, os.WriteFile(filepath.Join(directory, "subscribe.txt"), []byte("Confirm: {{.Link}}\n"), 0o644))
+	templates, err = loadTemplates(directory)
+	if !assert.Nil(t, err) {
+		return
+	}
+	message, err = templates.render(defaultLanguage, "ADD", templateData{Link: "https://example.com/v1/auth/<key>"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Confirm: https://example.com/v1/auth/<key>\n", message.text)
+	}
+}
+
+func TestRenderLocalized(t *testing.T) {
+	directory := copyTemplates(t)
+	assert.Nil(t, os.Remove(filepath.Join(directory, "ru", "export.html")))
+	templates, err := loadTemplates(directory)
+	if !assert.Nil(t, err) {
+		return
+	}
+	message, err := templates.render("ru", dailyDeliveryMethodName, sampleTemplateData)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Ежедневный арбуз", message.subject)
+		assert.Contains(t, message.html, "Хорошего дня, arbuz!")
+		assert.Contains(t, message.text, "Хорошего дня, arbuz!")
+	}
+	message, err = templates.render("ru", "EXPORT", sampleTemplateData)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Подтвердите действие", message.subject)
+		assert.Contains(t, message.html, "<title>Доставка арбузов</title>")
+		assert.Contains(t, message.html, "exporting your data")
+		assert.Contains(t, message.text, "exporting your data")
+	}
+	message, err = templates.render("de", dailyDeliveryMethodName, sampleTemplateData)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "Daily watermelon", message.subject)
+	}
+}
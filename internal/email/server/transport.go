@@ -0,0 +1,245 @@
+package email_server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/xhit/go-simple-mail/v2"
+)
+
+// Transport* consts define the names of transports, which can be selected by TransportConfig.
+const (
+	// TransportSMTP sends emails through the SMTP server described by the email info file.
+	TransportSMTP = "smtp"
+
+	// TransportMaildir writes emails into Maildir (tmp, new and cur subdirectories), so they can
+	// be read by any mail client supporting it.
+	TransportMaildir = "maildir"
+
+	// TransportEML writes every email into a separate .eml file of the directory.
+	TransportEML = "eml"
+
+	// TransportHTTP posts emails to the HTTP API of a mail provider.
+	TransportHTTP = "http"
+)
+
+// Transport delivers composed emails. One call of Send is one attempt of delivery: retries and
+// backoff are made by EmailServer. Transports must be safe for concurrent use.
+type Transport interface {
+	// Send delivers the email to its' recipients.
+	Send(msg *mail.Email) error
+
+	// Close releases resources of the transport.
+	Close() error
+}
+
+// TransportConfig contains the settings used to create a Transport.
+type TransportConfig struct {
+	// Kind is the name of transport (one of Transport* consts).
+	Kind string
+
+	// EmailInfoFile is the path to CSV file with SMTP server's host, port, username and password
+	// (TransportSMTP only).
+	EmailInfoFile string
+
+	// SMTPEncryption is the encryption of SMTP connections: "starttls" (default), "tls" (implicit TLS)
+	// or "none".
+	SMTPEncryption string
+
+	// SMTPCAFile adds trusted CA certificates to system ones. SMTP server's certificate is always verified.
+	SMTPCAFile string
+
+	// SMTPServerName is the name expected in SMTP server's certificate, if it differs from the host.
+	SMTPServerName string
+
+	// SMTPAuth is the authentication mechanism: "plain" (default), "login", "cram-md5" or "none".
+	SMTPAuth string
+
+	// Directory is the directory where emails are written (TransportMaildir and TransportEML only).
+	Directory string
+
+	// APIURL is the endpoint of mail provider's HTTP API (TransportHTTP only).
+	APIURL string
+
+	// APITokenFile is the path to file with the bearer token of HTTP API. No token is sent if it is empty.
+	APITokenFile string
+
+	// APITimeout limits the duration of one request to HTTP API.
+	APITimeout time.Duration
+}
+
+// NewTransport creates the transport selected by the config.
+func NewTransport(conf TransportConfig) (Transport, error) {
+	switch conf.Kind {
+	case TransportSMTP:
+		return NewSMTPTransport(conf)
+	case TransportMaildir:
+		return NewFileTransport(conf.Directory, true)
+	case TransportEML:
+		return NewFileTransport(conf.Directory, false)
+	case TransportHTTP:
+		var token string
+		if conf.APITokenFile != "" {
+			content, err := os.ReadFile(conf.APITokenFile)
+			if err != nil {
+				return nil, err
+			}
+			token = strings.TrimSpace(string(content))
+		}
+		return NewHTTPTransport(conf.APIURL, token, conf.APITimeout)
+	default:
+		return nil, fmt.Errorf("Unknown mail transport %q: expected one of %q, %q, %q or %q.", conf.Kind,
+			TransportSMTP, TransportMaildir, TransportEML, TransportHTTP)
+	}
+}
+
+// SMTP encryptions and authentication mechanisms, which can be selected by TransportConfig.
+var (
+	smtpEncryptions = map[string]mail.Encryption{
+		"none":     mail.EncryptionNone,
+		"starttls": mail.EncryptionSTARTTLS,
+		"tls":      mail.EncryptionSSLTLS,
+	}
+	smtpAuthMechanisms = map[string]mail.AuthType{
+		"none":     mail.AuthNone,
+		"plain":    mail.AuthPlain,
+		"login":    mail.AuthLogin,
+		"cram-md5": mail.AuthCRAMMD5,
+	}
+)
+
+const (
+	// defaultSMTPEncryption and defaultSMTPAuth are used if the config doesn't set them.
+	defaultSMTPEncryption = "starttls"
+	defaultSMTPAuth       = "plain"
+
+	// smtpSubmissionPort and smtpSubmissionsPort are standard ports of message submission
+	// with STARTTLS and implicit TLS (RFC 8314).
+	smtpSubmissionPort  = 587
+	smtpSubmissionsPort = 465
+)
+
+// NewSMTPTransport creates a new SMTPTransport using the email info file and security settings of the config.
+func NewSMTPTransport(conf TransportConfig) (*SMTPTransport, error) {
+	server := mail.NewSMTPClient()
+	if err := readEmailInfoFile(server, conf.EmailInfoFile); err != nil {
+		return nil, err
+	}
+	if err := configureSMTPSecurity(server, conf); err != nil {
+		return nil, err
+	}
+	return newSMTPTransport(server), nil
+}
+
+// configureSMTPSecurity sets encryption, TLS config and authentication mechanism of the SMTP server.
+// Certificates are verified against system CAs and the optional CA file. Combinations which can't work
+// or would send the password in clear text are rejected.
+func configureSMTPSecurity(server *mail.SMTPServer, conf TransportConfig) error {
+	encryptionName := strings.ToLower(conf.SMTPEncryption)
+	if encryptionName == "" {
+		encryptionName = defaultSMTPEncryption
+	}
+	encryption, ok := smtpEncryptions[encryptionName]
+	if !ok {
+		return fmt.Errorf("Unknown SMTP encryption %q: expected \"starttls\", \"tls\" or \"none\".", conf.SMTPEncryption)
+	}
+	authName := strings.ToLower(conf.SMTPAuth)
+	if authName == "" {
+		authName = defaultSMTPAuth
+	}
+	auth, ok := smtpAuthMechanisms[authName]
+	if !ok {
+		return fmt.Errorf("Unknown SMTP authentication %q: expected \"plain\", \"login\", \"cram-md5\" or \"none\".", conf.SMTPAuth)
+	}
+	switch {
+	case auth == mail.AuthNone && (server.Username != "" || server.Password != ""):
+		return fmt.Errorf("SMTP username and password are set, but authentication is disabled.")
+	case auth != mail.AuthNone && server.Username == "":
+		return fmt.Errorf("SMTP authentication %q requires username.", authName)
+	case encryption == mail.EncryptionNone && (auth == mail.AuthPlain || auth == mail.AuthLogin):
+		return fmt.Errorf("SMTP authentication %q sends the password in clear text, so it requires \"starttls\" or \"tls\" encryption.", authName)
+	case encryption == mail.EncryptionNone && (conf.SMTPCAFile != "" || conf.SMTPServerName != ""):
+		return fmt.Errorf("SMTP CA certificate and server name are used only with \"starttls\" or \"tls\" encryption.")
+	case encryption == mail.EncryptionSTARTTLS && server.Port == smtpSubmissionsPort:
+		return fmt.Errorf("SMTP port %d expects implicit TLS, so it requires \"tls\" encryption.", server.Port)
+	case encryption == mail.EncryptionSSLTLS && server.Port == smtpSubmissionPort:
+		return fmt.Errorf("SMTP port %d expects STARTTLS, so it requires \"starttls\" encryption.", server.Port)
+	}
+	server.Encryption = encryption
+	server.Authentication = auth
+	if encryption == mail.EncryptionNone {
+		return nil
+	}
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12, ServerName: server.Host}
+	if conf.SMTPServerName != "" {
+		tlsConf.ServerName = conf.SMTPServerName
+	}
+	if conf.SMTPCAFile != "" {
+		caCertPEM, err := os.ReadFile(conf.SMTPCAFile)
+		if err != nil {
+			return err
+		}
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			certPool = x509.NewCertPool()
+		}
+		if !certPool.AppendCertsFromPEM(caCertPEM) {
+			return fmt.Errorf("Failed to add trusted CA certificate from file %q.", conf.SMTPCAFile)
+		}
+		tlsConf.RootCAs = certPool
+	}
+	server.TLSConfig = tlsConf
+	return nil
+}
+
+// readEmailInfoFile reads CSV data from file (with given filepath) and
+// sets SMTPServer fields.
+func readEmailInfoFile(server *mail.SMTPServer, emailInfoFilePath string) error {
+	var err error
+	if !filepath.IsAbs(emailInfoFilePath) {
+		emailInfoFilePath, err = filepath.Abs(emailInfoFilePath)
+		if err != nil {
+			return err
+		}
+	}
+	emailInfoFile, err := os.Open(emailInfoFilePath)
+	if err != nil {
+		return err
+	}
+	defer emailInfoFile.Close()
+	csvReader := csv.NewReader(emailInfoFile)
+	emailInfo, err := csvReader.ReadAll()
+	if err != nil {
+		return err
+	}
+	infoCount := 0
+	for i := range emailInfo[0] {
+		infoCount++
+		switch emailInfo[0][i] {
+		case "Host":
+			server.Host = emailInfo[1][i]
+		case "Port":
+			server.Port, err = strconv.Atoi(emailInfo[1][i])
+			if err != nil {
+				return err
+			}
+		case "Username":
+			server.Username = emailInfo[1][i]
+		case "Password":
+			server.Password = emailInfo[1][i]
+		default:
+			infoCount--
+		}
+	}
+	if infoCount != emailInfoFieldAmount {
+		return fmt.Errorf("Invalid file %q: expected %d fields of info to parse, got %d.", emailInfoFilePath, emailInfoFieldAmount, infoCount)
+	}
+	return nil
+}
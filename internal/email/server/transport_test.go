@@ -0,0 +1,220 @@
+package email_server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/xhit/go-simple-mail/v2"
+)
+
+// newTestEmail creates an email to be sent by transports in tests.
+func newTestEmail() *mail.Email {
+	return newEmail("arbuz@example.com", &renderedMessage{subject: "Daily watermelon", html: "<p>Watermelon</p>",
+		text: "Watermelon\n"})
+}
+
+func TestFileTransportMaildir(t *testing.T) {
+	directory := filepath.Join(t.TempDir(), "Maildir")
+	transport, err := NewFileTransport(directory, true)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, transport.Send(newTestEmail()))
+	assert.Nil(t, transport.Send(newTestEmail()))
+	for _, subdirectory := range []string{maildirTmp, maildirCur} {
+		entries, err := os.ReadDir(filepath.Join(directory, subdirectory))
+		if assert.Nil(t, err) {
+			assert.Len(t, entries, 0)
+		}
+	}
+	entries, err := os.ReadDir(filepath.Join(directory, maildirNew))
+	if !assert.Nil(t, err) || !assert.Len(t, entries, 2) {
+		return
+	}
+	assert.NotEqual(t, entries[0].Name(), entries[1].Name())
+	content, err := os.ReadFile(filepath.Join(directory, maildirNew, entries[0].Name()))
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(content), "Subject: Daily watermelon")
+		assert.Contains(t, string(content), "To: <arbuz@example.com>")
+	}
+}
+
+func TestFileTransportEML(t *testing.T) {
+	directory := t.TempDir()
+	transport, err := NewFileTransport(directory, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, transport.Send(newTestEmail()))
+	files, err := filepath.Glob(filepath.Join(directory, "*"))
+	if assert.Nil(t, err) && assert.Len(t, files, 1) {
+		assert.Equal(t, emlExt, filepath.Ext(files[0]))
+	}
+	invalid := newTestEmail()
+	invalid.AddTo("invalid address")
+	assert.NotNil(t, transport.Send(invalid))
+	_, err = NewFileTransport("", false)
+	assert.NotNil(t, err)
+}
+
+func TestHTTPTransport(t *testing.T) {
+	var received apiRequest
+	status := http.StatusAccepted
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer secret" ||
+			r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&received); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+		w.Write([]byte("mailbox is full\n"))
+	}))
+	defer server.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	assert.Nil(t, os.WriteFile(tokenFile, []byte("secret\n"), 0o600))
+	transport, err := NewTransport(TransportConfig{Kind: TransportHTTP, APIURL: server.URL + "/send", APITokenFile: tokenFile})
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer transport.Close()
+	assert.Nil(t, transport.Send(newTestEmail()))
+	assert.Equal(t, []string{"arbuz@example.com"}, received.To)
+	assert.Contains(t, received.Raw, "Subject: Daily watermelon")
+
+	status = http.StatusUnprocessableEntity
+	err = transport.Send(newTestEmail())
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), "422")
+		assert.Contains(t, err.Error(), "mailbox is full")
+	}
+
+	_, err = NewHTTPTransport("ftp://example.com", "", 0)
+	assert.NotNil(t, err)
+}
+
+func TestNewTransportUnknown(t *testing.T) {
+	_, err := NewTransport(TransportConfig{Kind: "pigeon"})
+	assert.NotNil(t, err)
+	_, err = NewTransport(TransportConfig{Kind: TransportSMTP, EmailInfoFile: "testdata/invalid_email_info.csv"})
+	assert.NotNil(t, err)
+}
+
+func TestSendAuthMessageWithFileTransport(t *testing.T) {
+	templates, err := loadTemplates(testTemplateDirectory)
+	if !assert.Nil(t, err) {
+		return
+	}
+	directory := t.TempDir()
+	transport, err := NewFileTransport(directory, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	eServer := EmailServer{Logger: zerolog.Nop(), transport: transport, mainServiceLocation: "https://example.com"}
+	eServer.templates.Store(templates)
+	attempts, err := eServer.SendAuthMessage("arbuz@example.com", "key", "ADD", defaultLanguage)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 1, attempts)
+	files, err := filepath.Glob(filepath.Join(directory, "*"+emlExt))
+	if !assert.Nil(t, err) || !assert.Len(t, files, 1) {
+		return
+	}
+	content, err := os.ReadFile(files[0])
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(content), "Subject: Confirm action")
+		assert.Contains(t, string(content), "https://example.com/v1/auth/key")
+	}
+}
+
+func TestSendDailyMessageWithFileTransport(t *testing.T) {
+	templates, err := loadTemplates(testTemplateDirectory)
+	if !assert.Nil(t, err) {
+		return
+	}
+	directory := t.TempDir()
+	transport, err := NewFileTransport(directory, false)
+	if !assert.Nil(t, err) {
+		return
+	}
+	eServer := EmailServer{Logger: zerolog.Nop(), transport: transport, mainServiceLocation: "https://example.com",
+		imageDirectory: "../../../img"}
+	eServer.templates.Store(templates)
+	attempts, err := eServer.SendDailyMessage("arbuz@example.com", "arbuz", defaultLanguage)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Equal(t, 1, attempts)
+	files, err := filepath.Glob(filepath.Join(directory, "*"+emlExt))
+	if !assert.Nil(t, err) || !assert.Len(t, files, 1) {
+		return
+	}
+	content, err := os.ReadFile(files[0])
+	if assert.Nil(t, err) {
+		assert.Contains(t, string(content), "List-Unsubscribe: <https://example.com/v1/unsubscribe/arbuz>")
+		assert.Contains(t, string(content), "Unsubscribe: https://example.com/v1/unsubscribe/arbuz\r\n")
+	}
+}
+
+// newTestSMTPServer creates a SMTP server config with given port and credentials, if username isn't empty.
+func newTestSMTPServer(port int, username string) *mail.SMTPServer {
+	server := mail.NewSMTPClient()
+	server.Host, server.Port, server.Username = "smtp.example.com", port, username
+	if username != "" {
+		server.Password = "password"
+	}
+	return server
+}
+
+func TestConfigureSMTPSecurity(t *testing.T) {
+	server := newTestSMTPServer(587, "username")
+	if assert.Nil(t, configureSMTPSecurity(server, TransportConfig{})) {
+		assert.Equal(t, mail.EncryptionSTARTTLS, server.Encryption)
+		assert.Equal(t, mail.AuthPlain, server.Authentication)
+		if assert.NotNil(t, server.TLSConfig) {
+			assert.False(t, server.TLSConfig.InsecureSkipVerify)
+			assert.Equal(t, "smtp.example.com", server.TLSConfig.ServerName)
+		}
+	}
+	server = newTestSMTPServer(465, "username")
+	if assert.Nil(t, configureSMTPSecurity(server, TransportConfig{SMTPEncryption: "TLS", SMTPAuth: "login", SMTPServerName: "relay"})) {
+		assert.Equal(t, mail.EncryptionSSLTLS, server.Encryption)
+		assert.Equal(t, mail.AuthLogin, server.Authentication)
+		assert.Equal(t, "relay", server.TLSConfig.ServerName)
+	}
+	server = newTestSMTPServer(25, "username")
+	if assert.Nil(t, configureSMTPSecurity(server, TransportConfig{SMTPEncryption: "none", SMTPAuth: "cram-md5"})) {
+		assert.Equal(t, mail.EncryptionNone, server.Encryption)
+		assert.Nil(t, server.TLSConfig)
+	}
+	assert.Nil(t, configureSMTPSecurity(newTestSMTPServer(25, ""), TransportConfig{SMTPEncryption: "none", SMTPAuth: "none"}))
+}
+
+func TestConfigureSMTPSecurityWrong(t *testing.T) {
+	invalidCAFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(invalidCAFile, []byte("not a certificate"), 0o644))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(587, "username"), TransportConfig{SMTPEncryption: "ssl"}))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(587, "username"), TransportConfig{SMTPAuth: "xoauth2"}))
+	// password in clear text
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(25, "username"), TransportConfig{SMTPEncryption: "none"}))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(587, "username"), TransportConfig{SMTPAuth: "none"}))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(587, ""), TransportConfig{}))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(25, ""), TransportConfig{SMTPEncryption: "none", SMTPAuth: "none",
+		SMTPServerName: "relay"}))
+	// ports of the other encryption
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(465, "username"), TransportConfig{}))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(587, "username"), TransportConfig{SMTPEncryption: "tls"}))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(587, "username"), TransportConfig{SMTPCAFile: invalidCAFile}))
+	assert.NotNil(t, configureSMTPSecurity(newTestSMTPServer(587, "username"), TransportConfig{SMTPCAFile: invalidCAFile + ".missing"}))
+}
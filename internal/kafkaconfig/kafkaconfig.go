@@ -0,0 +1,313 @@
+package kafkaconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/xdg-go/scram"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+)
+
+// retentionConfig is the name of topic config with retention time in milliseconds.
+const retentionConfig = "retention.ms"
+
+// SASL* consts are supported SASL mechanisms.
+const (
+	SASLPlain       = "PLAIN"
+	SASLSCRAMSHA256 = "SCRAM-SHA-256"
+	SASLSCRAMSHA512 = "SCRAM-SHA-512"
+)
+
+// Provision* consts define what is done with topics on startup.
+const (
+	ProvisionNone   = ""
+	ProvisionVerify = "verify"
+	ProvisionCreate = "create"
+)
+
+// Config contains settings of connection to the Kafka cluster which are shared by all
+// producers and consumers of a service.
+type Config struct {
+	// ClientID is the name of client in broker logs and quotas. If it is empty, sarama's default is used.
+	ClientID string
+
+	// SASLMechanism is one of SASL* consts. If it is empty, SASL authentication is disabled.
+	SASLMechanism    string
+	SASLUser         string
+	SASLPasswordFile string
+
+	// TLS enables TLS connection to brokers. CAFile adds trusted CA certificates to system ones,
+	// CertFile and KeyFile set the client certificate. All of them are optional.
+	TLS      bool
+	CAFile   string
+	CertFile string
+	KeyFile  string
+
+	// TopicPrefix is added to names of all topics, unless they are overridden by TopicNames,
+	// which is a comma-separated list of "logical=name" pairs. It is also added to consumer group IDs,
+	// so environments sharing one cluster don't share consumer offsets.
+	TopicPrefix string
+	TopicNames  string
+
+	// ProvisionTopics is one of Provision* consts.
+	ProvisionTopics string
+
+	// Topic* fields are the settings of provisioned topics. Zero retention is not checked.
+	TopicPartitions        int
+	TopicReplicationFactor int
+	TopicRetention         time.Duration
+}
+
+// RegisterFlags defines flags of the Kafka connection settings in given flag set.
+// The returned Config is filled after the flags are parsed.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	c := &Config{}
+	fs.StringVar(&c.ClientID, "kafka-client-id", "", "Client ID used in requests to message brokers")
+	fs.StringVar(&c.SASLMechanism, "kafka-sasl-mechanism", "", "SASL mechanism for message brokers: PLAIN, SCRAM-SHA-256 or SCRAM-SHA-512 (disabled if empty)")
+	fs.StringVar(&c.SASLUser, "kafka-sasl-user", "", "SASL user name for message brokers")
+	fs.StringVar(&c.SASLPasswordFile, "kafka-sasl-password-file", "", "File with SASL password for message brokers")
+	fs.BoolVar(&c.TLS, "kafka-tls", false, "Use TLS for connection to message brokers")
+	fs.StringVar(&c.CAFile, "kafka-ca-cert", "", "CA certificate of message brokers (system ones are used if empty)")
+	fs.StringVar(&c.CertFile, "kafka-cert", "", "Client certificate for message brokers")
+	fs.StringVar(&c.KeyFile, "kafka-key", "", "Private key of client certificate for message brokers")
+	fs.StringVar(&c.TopicPrefix, "topic-prefix", "", "Environment prefix added to names of topics and consumer groups")
+	fs.StringVar(&c.TopicNames, "topic-names", "", "Comma-separated list of logical=name pairs overriding names of topics")
+	fs.StringVar(&c.ProvisionTopics, "provision-topics", "", "Check topics on startup (\"verify\") or also create missing ones (\"create\")")
+	fs.IntVar(&c.TopicPartitions, "topic-partitions", 3, "Minimal number of partitions of provisioned topics")
+	fs.IntVar(&c.TopicReplicationFactor, "topic-replication-factor", 1, "Replication factor of provisioned topics")
+	fs.DurationVar(&c.TopicRetention, "topic-retention", 0, "Retention of provisioned topics (not checked if zero)")
+	return c
+}
+
+// NewSaramaConfig creates a new sarama config with the settings applied.
+func (c *Config) NewSaramaConfig() (*sarama.Config, error) {
+	conf := sarama.NewConfig()
+	conf.Version = sarama.V3_2_0_0
+	if err := c.Apply(conf); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+// Apply sets client ID, SASL and TLS settings of given sarama config.
+func (c *Config) Apply(conf *sarama.Config) error {
+	if c.ClientID != "" {
+		conf.ClientID = c.ClientID
+	}
+	if err := c.applySASL(conf); err != nil {
+		return err
+	}
+	return c.applyTLS(conf)
+}
+
+// applySASL enables SASL authentication with configured mechanism.
+func (c *Config) applySASL(conf *sarama.Config) error {
+	if c.SASLMechanism == "" {
+		return nil
+	}
+	switch strings.ToUpper(c.SASLMechanism) {
+	case SASLPlain:
+		conf.Net.SASL.Mechanism = sarama.SASLTypePlaintext
+	case SASLSCRAMSHA256:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA256
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA256}
+		}
+	case SASLSCRAMSHA512:
+		conf.Net.SASL.Mechanism = sarama.SASLTypeSCRAMSHA512
+		conf.Net.SASL.SCRAMClientGeneratorFunc = func() sarama.SCRAMClient {
+			return &scramClient{HashGeneratorFcn: scram.SHA512}
+		}
+	default:
+		return fmt.Errorf("Unknown SASL mechanism %q.", c.SASLMechanism)
+	}
+	if c.SASLUser == "" {
+		return fmt.Errorf("SASL user is not set.")
+	}
+	password := ""
+	if c.SASLPasswordFile != "" {
+		content, err := os.ReadFile(c.SASLPasswordFile)
+		if err != nil {
+			return err
+		}
+		password = strings.TrimSpace(string(content))
+	}
+	conf.Net.SASL.Enable = true
+	conf.Net.SASL.Handshake = true
+	conf.Net.SASL.User = c.SASLUser
+	conf.Net.SASL.Password = password
+	return nil
+}
+
+// applyTLS enables TLS with configured certificates.
+func (c *Config) applyTLS(conf *sarama.Config) error {
+	if !c.TLS {
+		return nil
+	}
+	tlsConf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		caCertPEM, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return err
+		}
+		certPool, err := x509.SystemCertPool()
+		if err != nil {
+			certPool = x509.NewCertPool()
+		}
+		if !certPool.AppendCertsFromPEM(caCertPEM) {
+			return fmt.Errorf("Failed to add trusted CA certificate")
+		}
+		tlsConf.RootCAs = certPool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return err
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	conf.Net.TLS.Enable = true
+	conf.Net.TLS.Config = tlsConf
+	return nil
+}
+
+// scramClient implements sarama.SCRAMClient interface.
+type scramClient struct {
+	*scram.Client
+	*scram.ClientConversation
+	scram.HashGeneratorFcn
+}
+
+// Begin prepares the client for SCRAM exchange with given credentials.
+func (sc *scramClient) Begin(userName, password, authzID string) error {
+	client, err := sc.HashGeneratorFcn.NewClient(userName, password, authzID)
+	if err != nil {
+		return err
+	}
+	sc.Client = client
+	sc.ClientConversation = client.NewConversation()
+	return nil
+}
+
+// Step returns the next message of SCRAM exchange for given server's challenge.
+func (sc *scramClient) Step(challenge string) (string, error) {
+	return sc.ClientConversation.Step(challenge)
+}
+
+// Done reports whether the SCRAM exchange is finished.
+func (sc *scramClient) Done() bool {
+	return sc.ClientConversation.Done()
+}
+
+// Topics returns the mapping of logical topic names to names of topics in the cluster.
+func (c *Config) Topics() (broker.Topics, error) {
+	topics := broker.Topics{Prefix: c.TopicPrefix}
+	if c.TopicNames == "" {
+		return topics, nil
+	}
+	topics.Overrides = make(map[string]string)
+	for _, pair := range strings.Split(c.TopicNames, ",") {
+		topic, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || topic == "" || name == "" {
+			return broker.Topics{}, fmt.Errorf("Invalid topic name %q, expected \"logical=name\".", pair)
+		}
+		topics.Overrides[topic] = name
+	}
+	return topics, nil
+}
+
+// ConsumerGroup returns the ID of consumer group with given name in the cluster.
+func (c *Config) ConsumerGroup(group string) string {
+	return c.TopicPrefix + group
+}
+
+// TopicAdmin is the part of sarama.ClusterAdmin used to provision topics.
+type TopicAdmin interface {
+	ListTopics() (map[string]sarama.TopicDetail, error)
+	CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error
+}
+
+// Provision connects to the cluster and provisions given topics (see ProvisionWith).
+func (c *Config) Provision(addrs []string, conf *sarama.Config, topics ...string) error {
+	if c.ProvisionTopics == ProvisionNone {
+		return nil
+	}
+	admin, err := sarama.NewClusterAdmin(addrs, conf)
+	if err != nil {
+		return err
+	}
+	defer admin.Close()
+	return c.ProvisionWith(admin, topics...)
+}
+
+// ProvisionWith verifies that given logical topics exist in the cluster and have enough partitions,
+// configured replication factor and retention. In "create" mode missing topics are created.
+// Returns an error describing all misconfigured topics.
+func (c *Config) ProvisionWith(admin TopicAdmin, topics ...string) error {
+	switch c.ProvisionTopics {
+	case ProvisionNone:
+		return nil
+	case ProvisionVerify, ProvisionCreate:
+	default:
+		return fmt.Errorf("Unknown topics provisioning mode %q, expected \"verify\" or \"create\".", c.ProvisionTopics)
+	}
+	names, err := c.Topics()
+	if err != nil {
+		return err
+	}
+	existing, err := admin.ListTopics()
+	if err != nil {
+		return err
+	}
+	retention := ""
+	if c.TopicRetention > 0 {
+		retention = strconv.FormatInt(c.TopicRetention.Milliseconds(), 10)
+	}
+	var problems []string
+	for _, topic := range topics {
+		name := names.Name(topic)
+		detail, ok := existing[name]
+		if !ok {
+			if c.ProvisionTopics != ProvisionCreate {
+				problems = append(problems, fmt.Sprintf("topic %q does not exist", name))
+				continue
+			}
+			newDetail := &sarama.TopicDetail{
+				NumPartitions:     int32(c.TopicPartitions),
+				ReplicationFactor: int16(c.TopicReplicationFactor),
+			}
+			if retention != "" {
+				newDetail.ConfigEntries = map[string]*string{retentionConfig: &retention}
+			}
+			if err := admin.CreateTopic(name, newDetail, false); err != nil {
+				problems = append(problems, fmt.Sprintf("topic %q can't be created: %v", name, err))
+			}
+			continue
+		}
+		if detail.NumPartitions < int32(c.TopicPartitions) {
+			problems = append(problems, fmt.Sprintf("topic %q has %d partitions, expected at least %d", name, detail.NumPartitions, c.TopicPartitions))
+		}
+		if detail.ReplicationFactor != int16(c.TopicReplicationFactor) {
+			problems = append(problems, fmt.Sprintf("topic %q has replication factor %d, expected %d", name, detail.ReplicationFactor, c.TopicReplicationFactor))
+		}
+		if value := detail.ConfigEntries[retentionConfig]; retention != "" && (value == nil || *value != retention) {
+			actual := "default"
+			if value != nil {
+				actual = *value + "ms"
+			}
+			problems = append(problems, fmt.Sprintf("topic %q has retention %s, expected %sms", name, actual, retention))
+		}
+	}
+	if len(problems) != 0 {
+		return fmt.Errorf("Misconfigured topics: %s.", strings.Join(problems, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package kafkaconfig
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisterFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	c := RegisterFlags(fs)
+	err := fs.Parse([]string{"-kafka-client-id", "watermelon", "-kafka-sasl-mechanism", "PLAIN", "-kafka-sasl-user", "arbuz", "-kafka-tls"})
+	if assert.Nil(t, err) {
+		assert.Equal(t, &Config{ClientID: "watermelon", SASLMechanism: "PLAIN", SASLUser: "arbuz", TLS: true,
+			TopicPartitions: 3, TopicReplicationFactor: 1}, c)
+	}
+}
+
+func TestApplyPlain(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	if !assert.Nil(t, os.WriteFile(passwordFile, []byte("secret\n"), 0o600)) {
+		return
+	}
+	c := &Config{ClientID: "watermelon", SASLMechanism: "plain", SASLUser: "arbuz", SASLPasswordFile: passwordFile}
+	conf, err := c.NewSaramaConfig()
+	if assert.Nil(t, err) {
+		assert.Nil(t, conf.Validate())
+		assert.Equal(t, "watermelon", conf.ClientID)
+		assert.True(t, conf.Net.SASL.Enable)
+		assert.Equal(t, sarama.SASLMechanism(sarama.SASLTypePlaintext), conf.Net.SASL.Mechanism)
+		assert.Equal(t, "arbuz", conf.Net.SASL.User)
+		assert.Equal(t, "secret", conf.Net.SASL.Password)
+		assert.False(t, conf.Net.TLS.Enable)
+	}
+}
+
+func TestApplySCRAM(t *testing.T) {
+	for _, mechanism := range []string{SASLSCRAMSHA256, SASLSCRAMSHA512} {
+		conf, err := (&Config{SASLMechanism: mechanism, SASLUser: "arbuz"}).NewSaramaConfig()
+		if !assert.Nil(t, err) {
+			continue
+		}
+		assert.Equal(t, sarama.SASLMechanism(mechanism), conf.Net.SASL.Mechanism)
+		client := conf.Net.SASL.SCRAMClientGeneratorFunc()
+		if assert.Nil(t, client.Begin("arbuz", "secret", "")) {
+			first, err := client.Step("")
+			if assert.Nil(t, err) {
+				assert.True(t, strings.HasPrefix(first, "n,,n=arbuz,r="))
+			}
+			assert.False(t, client.Done())
+		}
+	}
+}
+
+func TestApplyWrongSASL(t *testing.T) {
+	_, err := (&Config{SASLMechanism: "GSSAPI", SASLUser: "arbuz"}).NewSaramaConfig()
+	assert.NotNil(t, err)
+	_, err = (&Config{SASLMechanism: SASLPlain}).NewSaramaConfig()
+	assert.NotNil(t, err)
+}
+
+func TestApplyTLS(t *testing.T) {
+	conf, err := (&Config{TLS: true}).NewSaramaConfig()
+	if assert.Nil(t, err) {
+		assert.True(t, conf.Net.TLS.Enable)
+		assert.NotNil(t, conf.Net.TLS.Config)
+	}
+	_, err = (&Config{TLS: true, CAFile: filepath.Join(t.TempDir(), "missing.pem")}).NewSaramaConfig()
+	assert.NotNil(t, err)
+}
+
+func TestTopics(t *testing.T) {
+	topics, err := (&Config{TopicPrefix: "staging_", TopicNames: "logs=shared_logs, erasure=gdpr"}).Topics()
+	if assert.Nil(t, err) {
+		assert.Equal(t, "staging_auth", topics.Name("auth"))
+		assert.Equal(t, "shared_logs", topics.Name("logs"))
+		assert.Equal(t, "gdpr", topics.Name("erasure"))
+	}
+	_, err = (&Config{TopicNames: "logs"}).Topics()
+	assert.NotNil(t, err)
+}
+
+func TestConsumerGroup(t *testing.T) {
+	assert.Equal(t, "staging_emailsend", (&Config{TopicPrefix: "staging_"}).ConsumerGroup("emailsend"))
+	assert.Equal(t, "emailsend", (&Config{}).ConsumerGroup("emailsend"))
+}
+
+type fakeAdmin struct {
+	topics  map[string]sarama.TopicDetail
+	created map[string]*sarama.TopicDetail
+}
+
+func (admin *fakeAdmin) ListTopics() (map[string]sarama.TopicDetail, error) {
+	return admin.topics, nil
+}
+
+func (admin *fakeAdmin) CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error {
+	admin.created[topic] = detail
+	return nil
+}
+
+func TestProvisionCreatesMissingTopics(t *testing.T) {
+	retention := "86400000"
+	admin := &fakeAdmin{
+		topics: map[string]sarama.TopicDetail{
+			"staging_auth": {NumPartitions: 3, ReplicationFactor: 2, ConfigEntries: map[string]*string{"retention.ms": &retention}},
+		},
+		created: make(map[string]*sarama.TopicDetail),
+	}
+	c := &Config{TopicPrefix: "staging_", ProvisionTopics: ProvisionCreate, TopicPartitions: 3, TopicReplicationFactor: 2, TopicRetention: 24 * time.Hour}
+	if assert.Nil(t, c.ProvisionWith(admin, "auth", "daily")) {
+		assert.Equal(t, map[string]*sarama.TopicDetail{
+			"staging_daily": {NumPartitions: 3, ReplicationFactor: 2, ConfigEntries: map[string]*string{"retention.ms": &retention}},
+		}, admin.created)
+	}
+}
+
+func TestProvisionVerifyFails(t *testing.T) {
+	admin := &fakeAdmin{
+		topics:  map[string]sarama.TopicDetail{"auth": {NumPartitions: 1, ReplicationFactor: 1}},
+		created: make(map[string]*sarama.TopicDetail),
+	}
+	c := &Config{ProvisionTopics: ProvisionVerify, TopicPartitions: 3, TopicReplicationFactor: 1, TopicRetention: time.Hour}
+	err := c.ProvisionWith(admin, "auth", "daily")
+	if assert.NotNil(t, err) {
+		assert.Contains(t, err.Error(), `topic "auth" has 1 partitions, expected at least 3`)
+		assert.Contains(t, err.Error(), `topic "auth" has retention default, expected 3600000ms`)
+		assert.Contains(t, err.Error(), `topic "daily" does not exist`)
+	}
+	assert.Empty(t, admin.created)
+	assert.Nil(t, (&Config{}).ProvisionWith(nil, "auth"))
+}
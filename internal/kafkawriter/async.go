@@ -0,0 +1,307 @@
+package kafkawriter
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Shopify/sarama"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+)
+
+// OverflowPolicy defines what AsyncWriter does when its' buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropOnOverflow makes Write drop the log line and return immediately.
+	DropOnOverflow OverflowPolicy = iota
+
+	// BlockOnOverflow makes Write wait until there is free space in the buffer.
+	BlockOnOverflow
+)
+
+const (
+	// defaultBufferSize is the default number of log lines buffered in memory.
+	defaultBufferSize = 1024
+
+	// defaultReplayInterval is the default minimal interval between replays of spilled log lines.
+	defaultReplayInterval time.Duration = 30 * time.Second
+)
+
+// ErrClosed is returned by Write after AsyncWriter is closed.
+var ErrClosed = fmt.Errorf("kafkawriter: writer is closed")
+
+// ParseOverflowPolicy converts "drop" or "block" to OverflowPolicy.
+func ParseOverflowPolicy(policy string) (OverflowPolicy, error) {
+	switch policy {
+	case "drop":
+		return DropOnOverflow, nil
+	case "block":
+		return BlockOnOverflow, nil
+	}
+	return DropOnOverflow, fmt.Errorf("Unknown overflow policy %q, expected \"drop\" or \"block\".", policy)
+}
+
+// AsyncWriter implements io.Writer interface and sends log messages to the Kafka
+// in background with sarama.AsyncProducer, which batches them according to its'
+// configuration. Log lines are buffered in memory. Lines which can't be delivered
+// (e.g. the broker is unavailable) are spilled to disk, if spill directory is set,
+// and are replayed once the broker accepts messages again.
+type AsyncWriter struct {
+	producer sarama.AsyncProducer
+
+	// service is the name of service which writes logs.
+	service string
+
+	// buffer contains log lines waiting to be passed to producer.
+	buffer chan []byte
+	policy OverflowPolicy
+
+	// topics maps logs topic to its' name in the cluster.
+	topics broker.Topics
+
+	// spill stores undelivered log lines. It is nil if spilling is disabled.
+	spill *spillFile
+
+	replayInterval time.Duration
+	lastReplay     time.Time
+	replaying      int32
+
+	// dropped counts log lines which were lost.
+	dropped int64
+
+	// done is closed when the writer is closing.
+	done chan struct{}
+
+	// mu guards closed and starting of replays.
+	mu     sync.Mutex
+	closed bool
+
+	pumpWG   sync.WaitGroup
+	replayWG sync.WaitGroup
+	resultWG sync.WaitGroup
+}
+
+// AsyncOption configures AsyncWriter.
+type AsyncOption func(*AsyncWriter) error
+
+// WithBufferSize sets the number of log lines buffered in memory.
+func WithBufferSize(size int) AsyncOption {
+	return func(w *AsyncWriter) error {
+		if size <= 0 {
+			return fmt.Errorf("Buffer size must be positive, got %d.", size)
+		}
+		w.buffer = make(chan []byte, size)
+		return nil
+	}
+}
+
+// WithOverflowPolicy sets the behaviour of Write when the buffer is full.
+func WithOverflowPolicy(policy OverflowPolicy) AsyncOption {
+	return func(w *AsyncWriter) error {
+		w.policy = policy
+		return nil
+	}
+}
+
+// WithSpillDir enables spilling of undelivered log lines to a file in given directory.
+// The file is limited by maxSize bytes, lines over the limit are dropped.
+func WithSpillDir(dir string, maxSize int64) AsyncOption {
+	return func(w *AsyncWriter) error {
+		spill, err := openSpillFile(dir, w.service, maxSize)
+		if err != nil {
+			return err
+		}
+		w.spill = spill
+		return nil
+	}
+}
+
+// WithTopics sets the mapping of logical topic names to names of topics in the cluster.
+func WithTopics(topics broker.Topics) AsyncOption {
+	return func(w *AsyncWriter) error {
+		w.topics = topics
+		return nil
+	}
+}
+
+// WithReplayInterval sets the minimal interval between replays of spilled log lines.
+func WithReplayInterval(interval time.Duration) AsyncOption {
+	return func(w *AsyncWriter) error {
+		w.replayInterval = interval
+		return nil
+	}
+}
+
+// NewAsync creates a new AsyncWriter which sends messages of given service using the producer.
+// The producer must be configured to return both successes and errors. AsyncWriter takes
+// ownership of the producer and closes it on Close. Log lines spilled by previous runs
+// are replayed after the first successful delivery.
+func NewAsync(p sarama.AsyncProducer, service string, opts ...AsyncOption) (*AsyncWriter, error) {
+	w := &AsyncWriter{
+		producer:       p,
+		service:        service,
+		buffer:         make(chan []byte, defaultBufferSize),
+		replayInterval: defaultReplayInterval,
+		done:           make(chan struct{}),
+	}
+	for _, opt := range opts {
+		if err := opt(w); err != nil {
+			if w.spill != nil {
+				w.spill.close()
+			}
+			return nil, err
+		}
+	}
+	w.pumpWG.Add(1)
+	go w.pump()
+	w.resultWG.Add(2)
+	go w.handleSuccesses()
+	go w.handleErrors()
+	return w, nil
+}
+
+// Write copies p into the buffer. It allows AsyncWriter to implement io.Writer interface.
+// If the buffer is full, Write drops the line or waits according to overflow policy.
+func (w *AsyncWriter) Write(p []byte) (int, error) {
+	line := append([]byte(nil), p...)
+	select {
+	case <-w.done:
+		return 0, ErrClosed
+	default:
+	}
+	if w.policy == BlockOnOverflow {
+		select {
+		case w.buffer <- line:
+			return len(p), nil
+		case <-w.done:
+			return 0, ErrClosed
+		}
+	}
+	select {
+	case w.buffer <- line:
+	default:
+		atomic.AddInt64(&w.dropped, 1)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of log lines which were lost due to overflow or delivery failures.
+func (w *AsyncWriter) Dropped() int64 {
+	return atomic.LoadInt64(&w.dropped)
+}
+
+// Close flushes buffered log lines, closes the producer and waits until all results are handled.
+// Lines which could not be delivered are spilled to disk.
+func (w *AsyncWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	close(w.done)
+	w.mu.Unlock()
+	w.replayWG.Wait()
+	w.pumpWG.Wait()
+	w.producer.AsyncClose()
+	w.resultWG.Wait()
+	if w.spill != nil {
+		return w.spill.close()
+	}
+	return nil
+}
+
+// pump passes buffered log lines to the producer. After the writer is closed it passes
+// the rest of buffer and returns.
+func (w *AsyncWriter) pump() {
+	defer w.pumpWG.Done()
+	for {
+		select {
+		case line := <-w.buffer:
+			w.producer.Input() <- w.newProducerMessage(line)
+		case <-w.done:
+			for {
+				select {
+				case line := <-w.buffer:
+					w.producer.Input() <- w.newProducerMessage(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// newProducerMessage creates a producer message of logs topic with given log line.
+func (w *AsyncWriter) newProducerMessage(line []byte) *sarama.ProducerMessage {
+	msg := newLogMessage(w.service, line)
+	msg.Topic = w.topics.Name(msg.Topic)
+	return broker.NewProducerMessage(msg)
+}
+
+// handleSuccesses drains successes of the producer. A success means the broker is available,
+// so spilled log lines are replayed.
+func (w *AsyncWriter) handleSuccesses() {
+	defer w.resultWG.Done()
+	for range w.producer.Successes() {
+		w.startReplay()
+	}
+}
+
+// handleErrors spills log lines which the producer failed to deliver.
+func (w *AsyncWriter) handleErrors() {
+	defer w.resultWG.Done()
+	for producerErr := range w.producer.Errors() {
+		if w.spill == nil || producerErr.Msg == nil || producerErr.Msg.Value == nil {
+			atomic.AddInt64(&w.dropped, 1)
+			continue
+		}
+		line, err := producerErr.Msg.Value.Encode()
+		if err != nil || w.spill.write(line) != nil {
+			atomic.AddInt64(&w.dropped, 1)
+		}
+	}
+}
+
+// startReplay starts replaying spilled log lines in background if there are any, the writer is open,
+// no replay is running and replay interval has passed since the last replay.
+func (w *AsyncWriter) startReplay() {
+	if w.spill == nil || w.spill.empty() || !atomic.CompareAndSwapInt32(&w.replaying, 0, 1) {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed || time.Since(w.lastReplay) < w.replayInterval {
+		atomic.StoreInt32(&w.replaying, 0)
+		return
+	}
+	w.lastReplay = time.Now()
+	w.replayWG.Add(1)
+	go w.replay()
+}
+
+// replay moves spilled log lines back into the buffer. If the writer is closed meanwhile,
+// the rest of lines is spilled again.
+func (w *AsyncWriter) replay() {
+	defer w.replayWG.Done()
+	defer atomic.StoreInt32(&w.replaying, 0)
+	lines, err := w.spill.take()
+	if err != nil {
+		return
+	}
+	for i, line := range lines {
+		select {
+		case w.buffer <- line:
+		case <-w.done:
+			for _, rest := range lines[i:] {
+				if w.spill.write(rest) != nil {
+					atomic.AddInt64(&w.dropped, 1)
+				}
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package kafkawriter
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+)
+
+func newMockAsyncProducer(t *testing.T) *mocks.AsyncProducer {
+	conf := mocks.NewTestConfig()
+	conf.Producer.Return.Successes = true
+	conf.Producer.Return.Errors = true
+	return mocks.NewAsyncProducer(t, conf)
+}
+
+func TestAsyncWriterDelivers(t *testing.T) {
+	producer := newMockAsyncProducer(t)
+	producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if msg.Topic != "logs" {
+			return fmt.Errorf("Wrong topic %q", msg.Topic)
+		} else if key, _ := msg.Key.Encode(); string(key) != "test_service" {
+			return fmt.Errorf("Wrong key %q", key)
+		} else if value, _ := msg.Value.Encode(); string(value) != "{\"message\":\"hi\"}\n" {
+			return fmt.Errorf("Wrong value %q", value)
+		}
+		return nil
+	})
+	w, err := NewAsync(producer, "test_service")
+	if !assert.Nil(t, err) {
+		return
+	}
+	n, err := w.Write([]byte("{\"message\":\"hi\"}\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 17, n)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, int64(0), w.Dropped())
+}
+
+func TestAsyncWriterTopics(t *testing.T) {
+	producer := newMockAsyncProducer(t)
+	producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if msg.Topic != "staging_logs" {
+			return fmt.Errorf("Wrong topic %q", msg.Topic)
+		}
+		return nil
+	})
+	w, err := NewAsync(producer, "test_service", WithTopics(broker.Topics{Prefix: "staging_"}))
+	if !assert.Nil(t, err) {
+		return
+	}
+	w.Write([]byte("line\n"))
+	assert.Nil(t, w.Close())
+}
+
+func TestAsyncWriterSpillsAndReplays(t *testing.T) {
+	producer := newMockAsyncProducer(t)
+	producer.ExpectInputAndFail(sarama.ErrOutOfBrokers)
+	producer.ExpectInputAndSucceed()
+	producer.ExpectInputWithMessageCheckerFunctionAndSucceed(func(msg *sarama.ProducerMessage) error {
+		if value, _ := msg.Value.Encode(); string(value) != "first\n" {
+			return fmt.Errorf("Expected replayed line, got %q", value)
+		}
+		return nil
+	})
+	w, err := NewAsync(producer, "test_service", WithSpillDir(t.TempDir(), 1024), WithReplayInterval(0))
+	if !assert.Nil(t, err) {
+		return
+	}
+	w.Write([]byte("first\n"))
+	assert.Eventually(t, func() bool { return !w.spill.empty() }, time.Second, 10*time.Millisecond)
+	w.Write([]byte("second\n"))
+	assert.Eventually(t, func() bool { return w.spill.empty() && len(w.buffer) == 0 }, time.Second, 10*time.Millisecond)
+	assert.Nil(t, w.Close())
+	assert.Equal(t, int64(0), w.Dropped())
+}
+
+func TestAsyncWriterDropsOnOverflow(t *testing.T) {
+	w := &AsyncWriter{buffer: make(chan []byte, 1), policy: DropOnOverflow, done: make(chan struct{})}
+	_, err := w.Write([]byte("first\n"))
+	assert.Nil(t, err)
+	_, err = w.Write([]byte("second\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), w.Dropped())
+}
+
+func TestAsyncWriterBlockingWriteAfterClose(t *testing.T) {
+	w := &AsyncWriter{buffer: make(chan []byte), policy: BlockOnOverflow, done: make(chan struct{})}
+	close(w.done)
+	_, err := w.Write([]byte("line\n"))
+	assert.Equal(t, ErrClosed, err)
+}
+
+func TestSpillFileKeepsLinesBetweenRuns(t *testing.T) {
+	dir := t.TempDir()
+	spill, err := openSpillFile(dir, "test_service", 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	assert.Nil(t, spill.write([]byte("first\n")))
+	assert.Nil(t, spill.write([]byte("second")))
+	assert.Nil(t, spill.close())
+	spill, err = openSpillFile(dir, "test_service", 0)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer spill.close()
+	assert.False(t, spill.empty())
+	lines, err := spill.take()
+	if assert.Nil(t, err) {
+		assert.Equal(t, [][]byte{[]byte("first\n"), []byte("second\n")}, lines)
+	}
+	assert.True(t, spill.empty())
+}
+
+func TestSpillFileLimit(t *testing.T) {
+	spill, err := openSpillFile(t.TempDir(), "test_service", 8)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer spill.close()
+	assert.Nil(t, spill.write([]byte("first\n")))
+	assert.NotNil(t, spill.write([]byte("second\n")))
+}
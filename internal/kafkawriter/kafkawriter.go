@@ -1,33 +1,50 @@
 package kafkawriter
 
 import (
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
 	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
-
-	"github.com/Shopify/sarama"
 )
 
 // kafkaWriter implements io.Writer interface and
-// is used to send log messages to the Kafka
+// is used to send log messages to the message broker
 type kafkaWriter struct {
-	sarama.SyncProducer
+	broker.Publisher
+
+	// service is the name of service which writes logs.
+	service string
 }
 
 // New returns a new instance of kafkaWriter
-// which will send messages using SyncProducer p
-func New(p sarama.SyncProducer) *kafkaWriter {
-	return &kafkaWriter{p}
+// which will send messages of given service using Publisher p
+func New(p broker.Publisher, service string) *kafkaWriter {
+	return &kafkaWriter{Publisher: p, service: service}
 }
 
-// Write uses p as a value of a new producer message. It allows
-// kafkaWriter to implement io.Writer interface
+// Write uses p as a value of a new message. It allows
+// kafkaWriter to implement io.Writer interface.
 func (kw *kafkaWriter) Write(p []byte) (n int, err error) {
-	msg := &sarama.ProducerMessage{
-		Topic: sc.LogsTopic,
-		Value: sarama.ByteEncoder(p),
-	}
-	_, _, err = kw.SendMessage(msg)
+	err = kw.Publish(newLogMessage(kw.service, p))
 	if err != nil {
 		return 0, err
 	}
 	return len(p), nil
 }
+
+// newLogMessage creates a message of logs topic with given log line. Messages are keyed
+// by service name and have headers with message ID and producer.
+func newLogMessage(service string, line []byte) *broker.Message {
+	msg := &broker.Message{
+		Topic: sc.LogsTopic,
+		Key:   service,
+		Value: line,
+	}
+	header, err := messages.NewHeader()
+	if err == nil {
+		msg.Headers = map[string]string{
+			messages.HeaderMessageID: header.ID,
+			messages.HeaderProducer:  service,
+		}
+	}
+	return msg
+}
@@ -0,0 +1,106 @@
+package kafkawriter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// spillFile stores log lines which could not be delivered, one line per record.
+type spillFile struct {
+	mu      sync.Mutex
+	path    string
+	file    *os.File
+	size    int64
+	maxSize int64
+}
+
+// openSpillFile opens (or creates) the spill file of given service in directory dir.
+func openSpillFile(dir, service string, maxSize int64) (*spillFile, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	sf := &spillFile{path: filepath.Join(dir, service+".spill"), maxSize: maxSize}
+	if err := sf.open(); err != nil {
+		return nil, err
+	}
+	return sf, nil
+}
+
+// open opens the file for appending and reads its' current size.
+func (sf *spillFile) open() error {
+	file, err := os.OpenFile(sf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sf.file, sf.size = file, info.Size()
+	return nil
+}
+
+// write appends the log line to the file. Returns an error if the file is full.
+func (sf *spillFile) write(line []byte) error {
+	line = bytes.TrimRight(line, "\n")
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.file == nil {
+		return fmt.Errorf("Spill file %q is closed.", sf.path)
+	} else if sf.maxSize > 0 && sf.size+int64(len(line))+1 > sf.maxSize {
+		return fmt.Errorf("Spill file %q is full.", sf.path)
+	}
+	n, err := sf.file.Write(append(line, '\n'))
+	sf.size += int64(n)
+	return err
+}
+
+// empty reports whether there are no spilled lines.
+func (sf *spillFile) empty() bool {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	return sf.size == 0
+}
+
+// take reads all spilled lines and truncates the file.
+func (sf *spillFile) take() ([][]byte, error) {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.file == nil {
+		return nil, fmt.Errorf("Spill file %q is closed.", sf.path)
+	}
+	content, err := os.ReadFile(sf.path)
+	if err != nil {
+		return nil, err
+	}
+	if err := sf.file.Truncate(0); err != nil {
+		return nil, err
+	}
+	sf.size = 0
+	var lines [][]byte
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, len(content)+1)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) != 0 {
+			lines = append(lines, append(append([]byte(nil), scanner.Bytes()...), '\n'))
+		}
+	}
+	return lines, scanner.Err()
+}
+
+// close closes the file.
+func (sf *spillFile) close() error {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	if sf.file == nil {
+		return nil
+	}
+	err := sf.file.Close()
+	sf.file = nil
+	return err
+}
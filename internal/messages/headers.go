@@ -0,0 +1,51 @@
+package messages
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// Header* consts are the names of message broker headers with metadata of messages.
+const (
+	HeaderMessageID     = "message-id"
+	HeaderProducer      = "producer"
+	HeaderSchemaVersion = "schema-version"
+	HeaderTraceParent   = "traceparent"
+)
+
+// traceParentPattern matches W3C trace context "traceparent" values of version 00.
+var traceParentPattern = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})$`)
+
+// Headers returns message broker headers with the metadata of message: its' ID, schema version,
+// name of producing service and trace context.
+func (h Header) Headers(producer, traceParent string) map[string]string {
+	return map[string]string{
+		HeaderMessageID:     h.ID,
+		HeaderProducer:      producer,
+		HeaderSchemaVersion: strconv.Itoa(h.Version),
+		HeaderTraceParent:   traceParent,
+	}
+}
+
+// ChildTraceParent returns a "traceparent" value for an operation caused by the one with given
+// trace context: it keeps the trace ID and flags but has a new span ID. If parent is not a valid
+// "traceparent", a new trace is started.
+func ChildTraceParent(parent string) string {
+	traceID, flags := "", "01"
+	if match := traceParentPattern.FindStringSubmatch(parent); match != nil {
+		traceID, flags = match[1], match[3]
+	} else {
+		traceID = randomHex(16)
+	}
+	return "00-" + traceID + "-" + randomHex(8) + "-" + flags
+}
+
+// randomHex returns hex encoded random bytes of given size.
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	io.ReadFull(rand.Reader, buf) // trace IDs only correlate logs, so the error is not critical
+	return hex.EncodeToString(buf)
+}
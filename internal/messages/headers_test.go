@@ -0,0 +1,31 @@
+package messages
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaders(t *testing.T) {
+	header := Header{Version: SchemaVersion, ID: "abc"}
+	values := header.Headers("email_service", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	assert.Equal(t, "abc", values[HeaderMessageID])
+	assert.Equal(t, "email_service", values[HeaderProducer])
+	assert.Equal(t, "1", values[HeaderSchemaVersion])
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", values[HeaderTraceParent])
+}
+
+func TestChildTraceParentKeepsTraceID(t *testing.T) {
+	parent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+	child := ChildTraceParent(parent)
+	assert.Regexp(t, traceParentPattern, child)
+	assert.True(t, strings.HasPrefix(child, "00-0af7651916cd43dd8448eb211c80319c-"))
+	assert.NotEqual(t, parent, child)
+}
+
+func TestChildTraceParentStartsNewTrace(t *testing.T) {
+	assert.Regexp(t, traceParentPattern, ChildTraceParent(""))
+	assert.Regexp(t, traceParentPattern, ChildTraceParent("garbage"))
+	assert.NotEqual(t, ChildTraceParent(""), ChildTraceParent(""))
+}
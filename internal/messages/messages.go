@@ -0,0 +1,228 @@
+// Package messages defines the schema of messages which services exchange through
+// message broker topics. Every message is a JSON object with a header (schema version,
+// message ID and creation time) and topic-specific fields.
+package messages
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+const (
+	// SchemaVersion is the current version of messages schema. Consumers reject
+	// messages with unknown versions.
+	SchemaVersion = 1
+
+	// idSize defines the size of message ID in bytes.
+	idSize = 16
+)
+
+// Header contains fields common for all messages.
+type Header struct {
+	Version   int       `json:"version"`
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// AuthRequest is a message of auth topic with request to send an authenticating email.
+// Language is the preferred language of the email; empty means the default one.
+type AuthRequest struct {
+	Header
+	Email    string `json:"email"`
+	Key      string `json:"key"`
+	Method   string `json:"method"`
+	Language string `json:"language,omitempty"`
+}
+
+// DailyDelivery is a message of daily topic with request to send a daily message to the user.
+// DeliveryKey is deterministic for the pair of delivery run and user, so repeated requests
+// of the same run can be detected. Language is the preferred language of the email; empty means the default one.
+type DailyDelivery struct {
+	Header
+	Email       string `json:"email"`
+	Nickname    string `json:"nickname"`
+	RunID       string `json:"run_id,omitempty"`
+	DeliveryKey string `json:"delivery_key,omitempty"`
+	Language    string `json:"language,omitempty"`
+}
+
+// DeadLetter is a message of dead letter topic with a request which could not be delivered.
+// It keeps the original payload, so the request can be replayed into its' topic.
+type DeadLetter struct {
+	Header
+	Topic    string          `json:"topic"`
+	Error    string          `json:"error"`
+	Attempts int             `json:"attempts"`
+	Payload  json.RawMessage `json:"payload"`
+}
+
+// Outcome* consts are the outcomes of email delivery in DeliveryReceipt.
+const (
+	OutcomeSent   = "SENT"
+	OutcomeFailed = "FAILED"
+)
+
+// DeliveryReceipt is a message of receipts topic with the result of sending an email requested by
+// the message with RequestID from RequestTopic. SMTPResponse contains the error of the last attempt
+// if the email was not sent.
+type DeliveryReceipt struct {
+	Header
+	RequestID    string `json:"request_id"`
+	RequestTopic string `json:"request_topic"`
+	Nickname     string `json:"nickname"`
+	Outcome      string `json:"outcome"`
+	SMTPResponse string `json:"smtp_response,omitempty"`
+	Attempts     int    `json:"attempts"`
+}
+
+// NewHeader creates a header of current schema version with random message ID.
+func NewHeader() (Header, error) {
+	id := make([]byte, idSize)
+	if _, err := io.ReadFull(rand.Reader, id); err != nil {
+		return Header{}, err
+	}
+	return Header{Version: SchemaVersion, ID: hex.EncodeToString(id), CreatedAt: time.Now().UTC()}, nil
+}
+
+// NewAuthRequest creates an AuthRequest message.
+func NewAuthRequest(email, key, method, language string) (*AuthRequest, error) {
+	header, err := NewHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &AuthRequest{Header: header, Email: email, Key: key, Method: method, Language: language}, nil
+}
+
+// Encode encodes the message into JSON.
+func (m *AuthRequest) Encode() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// NewDailyDelivery creates a DailyDelivery message of given delivery run.
+func NewDailyDelivery(email, nickname, runID, language string) (*DailyDelivery, error) {
+	header, err := NewHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &DailyDelivery{Header: header, Email: email, Nickname: nickname, RunID: runID,
+		DeliveryKey: DailyDeliveryKey(runID, nickname), Language: language}, nil
+}
+
+// Encode encodes the message into JSON.
+func (m *DailyDelivery) Encode() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// DailyDeliveryKey returns the deterministic key of daily message for the user in given delivery run.
+func DailyDeliveryKey(runID, nickname string) string {
+	return "daily:" + runID + ":" + nickname
+}
+
+// NewDeadLetter creates a DeadLetter message with the original payload of given topic.
+func NewDeadLetter(topic string, payload []byte, attempts int, sendErr error) (*DeadLetter, error) {
+	header, err := NewHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &DeadLetter{Header: header, Topic: topic, Error: sendErr.Error(), Attempts: attempts,
+		Payload: json.RawMessage(payload)}, nil
+}
+
+// Encode encodes the message into JSON.
+func (m *DeadLetter) Encode() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// NewDeliveryReceipt creates a DeliveryReceipt message. If sendErr is nil, the outcome is OutcomeSent.
+func NewDeliveryReceipt(requestID, requestTopic, nickname string, attempts int, sendErr error) (*DeliveryReceipt, error) {
+	header, err := NewHeader()
+	if err != nil {
+		return nil, err
+	}
+	receipt := &DeliveryReceipt{Header: header, RequestID: requestID, RequestTopic: requestTopic, Nickname: nickname,
+		Outcome: OutcomeSent, Attempts: attempts}
+	if sendErr != nil {
+		receipt.Outcome = OutcomeFailed
+		receipt.SMTPResponse = sendErr.Error()
+	}
+	return receipt, nil
+}
+
+// Encode encodes the message into JSON.
+func (m *DeliveryReceipt) Encode() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// DecodeAuthRequest decodes and validates an AuthRequest message.
+func DecodeAuthRequest(data []byte) (*AuthRequest, error) {
+	msg := new(AuthRequest)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("Malformed auth request: %v", err)
+	}
+	if err := msg.Header.validate(); err != nil {
+		return nil, err
+	}
+	if msg.Email == "" || msg.Key == "" || msg.Method == "" {
+		return nil, fmt.Errorf("Auth request %s misses required fields.", msg.ID)
+	}
+	return msg, nil
+}
+
+// DecodeDailyDelivery decodes and validates a DailyDelivery message.
+func DecodeDailyDelivery(data []byte) (*DailyDelivery, error) {
+	msg := new(DailyDelivery)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("Malformed daily delivery request: %v", err)
+	}
+	if err := msg.Header.validate(); err != nil {
+		return nil, err
+	}
+	if msg.Email == "" || msg.Nickname == "" {
+		return nil, fmt.Errorf("Daily delivery request %s misses required fields.", msg.ID)
+	}
+	return msg, nil
+}
+
+// validate checks that the header has supported version and message ID.
+func (h *Header) validate() error {
+	if h.Version != SchemaVersion {
+		return fmt.Errorf("Unsupported message schema version %d.", h.Version)
+	} else if h.ID == "" {
+		return fmt.Errorf("Message has no ID.")
+	}
+	return nil
+}
+
+// DecodeDeadLetter decodes and validates a DeadLetter message.
+func DecodeDeadLetter(data []byte) (*DeadLetter, error) {
+	msg := new(DeadLetter)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("Malformed dead letter: %v", err)
+	}
+	if err := msg.Header.validate(); err != nil {
+		return nil, err
+	}
+	if msg.Topic == "" || len(msg.Payload) == 0 {
+		return nil, fmt.Errorf("Dead letter %s misses required fields.", msg.ID)
+	}
+	return msg, nil
+}
+
+// DecodeDeliveryReceipt decodes and validates a DeliveryReceipt message.
+func DecodeDeliveryReceipt(data []byte) (*DeliveryReceipt, error) {
+	msg := new(DeliveryReceipt)
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, fmt.Errorf("Malformed delivery receipt: %v", err)
+	}
+	if err := msg.Header.validate(); err != nil {
+		return nil, err
+	}
+	if msg.Nickname == "" || (msg.Outcome != OutcomeSent && msg.Outcome != OutcomeFailed) {
+		return nil, fmt.Errorf("Delivery receipt %s misses required fields.", msg.ID)
+	}
+	return msg, nil
+}
@@ -0,0 +1,111 @@
+package messages
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthRequestRoundTrip(t *testing.T) {
+	request, err := NewAuthRequest("arbuz@example.com", "key", "ADD", "ru")
+	if !assert.Nil(t, err) {
+		return
+	}
+	value, err := request.Encode()
+	if !assert.Nil(t, err) {
+		return
+	}
+	msg, err := DecodeAuthRequest(value)
+	if assert.Nil(t, err) {
+		assert.Equal(t, SchemaVersion, msg.Version)
+		assert.NotEmpty(t, msg.ID)
+		assert.False(t, msg.CreatedAt.IsZero())
+		assert.Equal(t, "arbuz@example.com", msg.Email)
+		assert.Equal(t, "key", msg.Key)
+		assert.Equal(t, "ADD", msg.Method)
+		assert.Equal(t, "ru", msg.Language)
+	}
+}
+
+func TestDailyDeliveryNicknameWithSpaces(t *testing.T) {
+	delivery, err := NewDailyDelivery("arbuz@example.com", "big ripe arbuz", "20221001T120000Z", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+	value, err := delivery.Encode()
+	if !assert.Nil(t, err) {
+		return
+	}
+	msg, err := DecodeDailyDelivery(value)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "arbuz@example.com", msg.Email)
+		assert.Equal(t, "big ripe arbuz", msg.Nickname)
+		assert.Equal(t, "20221001T120000Z", msg.RunID)
+		assert.Equal(t, DailyDeliveryKey("20221001T120000Z", "big ripe arbuz"), msg.DeliveryKey)
+	}
+}
+
+func TestDecodeInvalidMessages(t *testing.T) {
+	invalid := []string{
+		"arbuz@example.com key ADD",
+		`{"version":2,"id":"1","email":"arbuz@example.com","key":"key","method":"ADD"}`,
+		`{"version":1,"email":"arbuz@example.com","key":"key","method":"ADD"}`,
+		`{"version":1,"id":"1","email":"arbuz@example.com"}`,
+	}
+	for _, value := range invalid {
+		_, err := DecodeAuthRequest([]byte(value))
+		assert.NotNil(t, err, value)
+	}
+	_, err := DecodeDailyDelivery([]byte(`{"version":1,"id":"1","email":"arbuz@example.com"}`))
+	assert.NotNil(t, err)
+}
+
+func TestDeadLetterKeepsPayload(t *testing.T) {
+	delivery, err := NewDailyDelivery("arbuz@example.com", "arbuz", "20221001T120000Z", "")
+	if !assert.Nil(t, err) {
+		return
+	}
+	payload, err := delivery.Encode()
+	if !assert.Nil(t, err) {
+		return
+	}
+	deadLetter, err := NewDeadLetter("daily", payload, 5, fmt.Errorf("connection refused"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	value, err := deadLetter.Encode()
+	if !assert.Nil(t, err) {
+		return
+	}
+	msg, err := DecodeDeadLetter(value)
+	if assert.Nil(t, err) {
+		assert.Equal(t, "daily", msg.Topic)
+		assert.Equal(t, "connection refused", msg.Error)
+		assert.Equal(t, 5, msg.Attempts)
+		assert.JSONEq(t, string(payload), string(msg.Payload))
+	}
+}
+
+func TestDeliveryReceiptRoundTrip(t *testing.T) {
+	receipt, err := NewDeliveryReceipt("abc", "daily", "arbuz", 3, fmt.Errorf("550 Mailbox unavailable"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	value, err := receipt.Encode()
+	if !assert.Nil(t, err) {
+		return
+	}
+	msg, err := DecodeDeliveryReceipt(value)
+	if assert.Nil(t, err) {
+		assert.Equal(t, receipt.ID, msg.ID)
+		assert.Equal(t, "abc", msg.RequestID)
+		assert.Equal(t, "daily", msg.RequestTopic)
+		assert.Equal(t, "arbuz", msg.Nickname)
+		assert.Equal(t, OutcomeFailed, msg.Outcome)
+		assert.Equal(t, "550 Mailbox unavailable", msg.SMTPResponse)
+		assert.Equal(t, 3, msg.Attempts)
+	}
+	_, err = DecodeDeliveryReceipt([]byte(`{"version":1,"id":"1","nickname":"arbuz","outcome":"LOST"}`))
+	assert.NotNil(t, err)
+}
@@ -5,4 +5,14 @@ const (
 	AuthTopic          = "auth"
 	DailyDeliveryTopic = "daily"
 	LogsTopic          = "logs"
+	ErasureTopic       = "erasure"
+	UserEventsTopic    = "user_events"
+	DeadLetterTopic    = "dead_letters"
+	ReceiptsTopic      = "receipts"
+)
+
+const (
+	// *ServiceName consts are the names of services which produce messages.
+	MainServiceName  = "user_handling_service"
+	EmailServiceName = "email_service"
 )
@@ -27,6 +27,12 @@ type UserHandlingClient interface {
 	DeleteUser(ctx context.Context, in *User, opts ...grpc.CallOption) (*Response, error)
 	AuthUser(ctx context.Context, in *Key, opts ...grpc.CallOption) (*Response, error)
 	ListUsers(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (UserHandling_ListUsersClient, error)
+	ExportMyData(ctx context.Context, in *User, opts ...grpc.CallOption) (*Response, error)
+	ChangeEmail(ctx context.Context, in *EmailChange, opts ...grpc.CallOption) (*Response, error)
+	PauseUser(ctx context.Context, in *Pause, opts ...grpc.CallOption) (*Response, error)
+	EraseUser(ctx context.Context, in *User, opts ...grpc.CallOption) (*Response, error)
+	ImportUsers(ctx context.Context, opts ...grpc.CallOption) (UserHandling_ImportUsersClient, error)
+	GetDeliveryRun(ctx context.Context, in *DeliveryRunRequest, opts ...grpc.CallOption) (*DeliveryRun, error)
 }
 
 type userHandlingClient struct {
@@ -96,6 +102,85 @@ func (x *userHandlingListUsersClient) Recv() (*User, error) {
 	return m, nil
 }
 
+func (c *userHandlingClient) ExportMyData(ctx context.Context, in *User, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/user_handling_proto.UserHandling/exportMyData", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userHandlingClient) ChangeEmail(ctx context.Context, in *EmailChange, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/user_handling_proto.UserHandling/changeEmail", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userHandlingClient) PauseUser(ctx context.Context, in *Pause, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/user_handling_proto.UserHandling/pauseUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userHandlingClient) EraseUser(ctx context.Context, in *User, opts ...grpc.CallOption) (*Response, error) {
+	out := new(Response)
+	err := c.cc.Invoke(ctx, "/user_handling_proto.UserHandling/eraseUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *userHandlingClient) ImportUsers(ctx context.Context, opts ...grpc.CallOption) (UserHandling_ImportUsersClient, error) {
+	stream, err := c.cc.NewStream(ctx, &UserHandling_ServiceDesc.Streams[1], "/user_handling_proto.UserHandling/importUsers", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &userHandlingImportUsersClient{stream}
+	return x, nil
+}
+
+type UserHandling_ImportUsersClient interface {
+	Send(*ImportedUser) error
+	CloseAndRecv() (*ImportReport, error)
+	grpc.ClientStream
+}
+
+type userHandlingImportUsersClient struct {
+	grpc.ClientStream
+}
+
+func (x *userHandlingImportUsersClient) Send(m *ImportedUser) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *userHandlingImportUsersClient) CloseAndRecv() (*ImportReport, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(ImportReport)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *userHandlingClient) GetDeliveryRun(ctx context.Context, in *DeliveryRunRequest, opts ...grpc.CallOption) (*DeliveryRun, error) {
+	out := new(DeliveryRun)
+	err := c.cc.Invoke(ctx, "/user_handling_proto.UserHandling/getDeliveryRun", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // UserHandlingServer is the server API for UserHandling service.
 // All implementations must embed UnimplementedUserHandlingServer
 // for forward compatibility
@@ -104,6 +189,12 @@ type UserHandlingServer interface {
 	DeleteUser(context.Context, *User) (*Response, error)
 	AuthUser(context.Context, *Key) (*Response, error)
 	ListUsers(*emptypb.Empty, UserHandling_ListUsersServer) error
+	ExportMyData(context.Context, *User) (*Response, error)
+	ChangeEmail(context.Context, *EmailChange) (*Response, error)
+	PauseUser(context.Context, *Pause) (*Response, error)
+	EraseUser(context.Context, *User) (*Response, error)
+	ImportUsers(UserHandling_ImportUsersServer) error
+	GetDeliveryRun(context.Context, *DeliveryRunRequest) (*DeliveryRun, error)
 	mustEmbedUnimplementedUserHandlingServer()
 }
 
@@ -123,6 +214,24 @@ func (UnimplementedUserHandlingServer) AuthUser(context.Context, *Key) (*Respons
 func (UnimplementedUserHandlingServer) ListUsers(*emptypb.Empty, UserHandling_ListUsersServer) error {
 	return status.Errorf(codes.Unimplemented, "method ListUsers not implemented")
 }
+func (UnimplementedUserHandlingServer) ExportMyData(context.Context, *User) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ExportMyData not implemented")
+}
+func (UnimplementedUserHandlingServer) ChangeEmail(context.Context, *EmailChange) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ChangeEmail not implemented")
+}
+func (UnimplementedUserHandlingServer) PauseUser(context.Context, *Pause) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PauseUser not implemented")
+}
+func (UnimplementedUserHandlingServer) EraseUser(context.Context, *User) (*Response, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method EraseUser not implemented")
+}
+func (UnimplementedUserHandlingServer) ImportUsers(UserHandling_ImportUsersServer) error {
+	return status.Errorf(codes.Unimplemented, "method ImportUsers not implemented")
+}
+func (UnimplementedUserHandlingServer) GetDeliveryRun(context.Context, *DeliveryRunRequest) (*DeliveryRun, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetDeliveryRun not implemented")
+}
 func (UnimplementedUserHandlingServer) mustEmbedUnimplementedUserHandlingServer() {}
 
 // UnsafeUserHandlingServer may be embedded to opt out of forward compatibility for this service.
@@ -211,6 +320,122 @@ func (x *userHandlingListUsersServer) Send(m *User) error {
 	return x.ServerStream.SendMsg(m)
 }
 
+func _UserHandling_ExportMyData_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(User)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserHandlingServer).ExportMyData(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/user_handling_proto.UserHandling/exportMyData",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserHandlingServer).ExportMyData(ctx, req.(*User))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserHandling_ChangeEmail_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EmailChange)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserHandlingServer).ChangeEmail(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/user_handling_proto.UserHandling/changeEmail",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserHandlingServer).ChangeEmail(ctx, req.(*EmailChange))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserHandling_PauseUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(Pause)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserHandlingServer).PauseUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/user_handling_proto.UserHandling/pauseUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserHandlingServer).PauseUser(ctx, req.(*Pause))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserHandling_EraseUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(User)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserHandlingServer).EraseUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/user_handling_proto.UserHandling/eraseUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserHandlingServer).EraseUser(ctx, req.(*User))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _UserHandling_ImportUsers_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(UserHandlingServer).ImportUsers(&userHandlingImportUsersServer{stream})
+}
+
+type UserHandling_ImportUsersServer interface {
+	SendAndClose(*ImportReport) error
+	Recv() (*ImportedUser, error)
+	grpc.ServerStream
+}
+
+type userHandlingImportUsersServer struct {
+	grpc.ServerStream
+}
+
+func (x *userHandlingImportUsersServer) SendAndClose(m *ImportReport) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *userHandlingImportUsersServer) Recv() (*ImportedUser, error) {
+	m := new(ImportedUser)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _UserHandling_GetDeliveryRun_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeliveryRunRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UserHandlingServer).GetDeliveryRun(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/user_handling_proto.UserHandling/getDeliveryRun",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UserHandlingServer).GetDeliveryRun(ctx, req.(*DeliveryRunRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // UserHandling_ServiceDesc is the grpc.ServiceDesc for UserHandling service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -230,6 +455,26 @@ var UserHandling_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "authUser",
 			Handler:    _UserHandling_AuthUser_Handler,
 		},
+		{
+			MethodName: "exportMyData",
+			Handler:    _UserHandling_ExportMyData_Handler,
+		},
+		{
+			MethodName: "changeEmail",
+			Handler:    _UserHandling_ChangeEmail_Handler,
+		},
+		{
+			MethodName: "pauseUser",
+			Handler:    _UserHandling_PauseUser_Handler,
+		},
+		{
+			MethodName: "eraseUser",
+			Handler:    _UserHandling_EraseUser_Handler,
+		},
+		{
+			MethodName: "getDeliveryRun",
+			Handler:    _UserHandling_GetDeliveryRun_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -237,6 +482,11 @@ var UserHandling_ServiceDesc = grpc.ServiceDesc{
 			Handler:       _UserHandling_ListUsers_Handler,
 			ServerStreams: true,
 		},
+		{
+			StreamName:    "importUsers",
+			Handler:       _UserHandling_ImportUsers_Handler,
+			ClientStreams: true,
+		},
 	},
 	Metadata: "proto/users.proto",
 }
@@ -0,0 +1,199 @@
+package uh_server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
+)
+
+/***************************************
+    This file contains the pool of
+   workers which publish daily messages
+   of a delivery run in rate limited
+               batches.
+***************************************/
+
+const (
+	// defaultDeliveryWorkers is the default number of workers publishing daily messages.
+	defaultDeliveryWorkers = 8
+
+	// defaultDeliveryBatchSize is the default number of daily messages published in one batch.
+	defaultDeliveryBatchSize = 50
+)
+
+// SetDeliveryWorkers changes the number of workers which publish daily messages of a delivery run
+// and the number of messages published by a worker in one batch. Both of them must be positive.
+func (s *UserHandlingServer) SetDeliveryWorkers(workers, batchSize int) error {
+	if workers <= 0 || batchSize <= 0 {
+		return fmt.Errorf("Delivery workers and batch size must be positive.")
+	}
+	s.deliveryWorkers = workers
+	s.deliveryBatchSize = batchSize
+	return nil
+}
+
+// SetDeliveryRate changes the maximum number of daily messages per second published during a delivery run.
+// Zero rate means no limit.
+func (s *UserHandlingServer) SetDeliveryRate(perSecond int) error {
+	if perSecond < 0 {
+		return fmt.Errorf("Delivery rate must not be negative.")
+	}
+	s.deliveryRateInterval = 0
+	if perSecond > 0 {
+		s.deliveryRateInterval = time.Second / time.Duration(perSecond)
+	}
+	return nil
+}
+
+// pacer limits the rate of events shared by several goroutines: every event takes
+// its' own interval of time.
+type pacer struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// wait blocks until n events are allowed to happen or ctx is done.
+func (p *pacer) wait(ctx context.Context, n int) error {
+	if p.interval == 0 {
+		return ctx.Err()
+	}
+	p.mu.Lock()
+	now := time.Now()
+	if p.next.Before(now) {
+		p.next = now
+	}
+	at := p.next
+	p.next = p.next.Add(time.Duration(n) * p.interval)
+	p.mu.Unlock()
+	wait := time.Until(at)
+	if wait <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// publishDailyMessages splits users into batches, which are published by the pool of workers with
+// limited rate. When ctx is done, no more batches are published, but batches which are already
+// being published are finished. Returns the numbers of published and failed messages.
+func (s *UserHandlingServer) publishDailyMessages(ctx context.Context, users []data.User, runID, runTraceParent string) (int64, int64) {
+	var published, failed int64
+	batches := make(chan []data.User)
+	rate := &pacer{interval: s.deliveryRateInterval}
+	wg := new(sync.WaitGroup)
+	wg.Add(s.deliveryWorkers)
+	for i := 0; i < s.deliveryWorkers; i++ {
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if rate.wait(ctx, len(batch)) != nil {
+					continue
+				}
+				batchPublished, batchFailed := s.publishDailyBatch(batch, runID, runTraceParent)
+				atomic.AddInt64(&published, int64(batchPublished))
+				atomic.AddInt64(&failed, int64(batchFailed))
+			}
+		}()
+	}
+feed:
+	for start := 0; start < len(users); start += s.deliveryBatchSize {
+		end := start + s.deliveryBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+		select {
+		case batches <- users[start:end]:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(batches)
+	wg.Wait()
+	return published, failed
+}
+
+// publishDailyBatch publishes daily messages for the batch of users at once, then saves the users'
+// checkpoints of delivery run and logs deliveries. Returns the numbers of published and failed messages.
+func (s *UserHandlingServer) publishDailyBatch(users []data.User, runID, runTraceParent string) (int, int) {
+	errs := make([]error, len(users))
+	msgs := make([]*broker.Message, 0, len(users))
+	indexes := make([]int, 0, len(users))
+	for i, user := range users {
+		msg, err := newDailyMessage(user, runID, runTraceParent)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		msgs = append(msgs, msg)
+		indexes = append(indexes, i)
+	}
+	if len(msgs) != 0 {
+		err := s.Publish(msgs...)
+		var batchErr *broker.BatchError
+		if errors.As(err, &batchErr) {
+			for j, msgErr := range batchErr.Errors {
+				errs[indexes[j]] = msgErr
+			}
+		} else if err != nil {
+			for _, i := range indexes {
+				errs[i] = err
+			}
+		}
+	}
+	var published, failed int
+	var sendErr error
+	for i, user := range users {
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+		if err := s.CheckpointDelivery(ctx, runID, user.Nickname, errs[i] == nil); err != nil {
+			s.Error().Msgf("An error occured while executing database operation: %v", err)
+		}
+		if errs[i] != nil {
+			failed++
+			sendErr = errs[i]
+		} else {
+			published++
+			if err := s.LogDelivery(ctx, user.Nickname); err != nil {
+				s.Error().Msgf("An error occured while executing database operation: %v", err)
+			}
+		}
+		cancel()
+	}
+	if sendErr != nil {
+		s.Error().Msgf("An error occured while sending message to MB: %v", sendErr)
+	}
+	return published, failed
+}
+
+// newDailyMessage creates a message with request to deliver the user's daily message of given delivery run
+// in the user's language to the email service. The message is keyed by user's nickname.
+func newDailyMessage(user data.User, runID, runTraceParent string) (*broker.Message, error) {
+	delivery, err := messages.NewDailyDelivery(user.Email, user.Nickname, runID, user.Language)
+	if err != nil {
+		return nil, err
+	}
+	value, err := delivery.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return &broker.Message{
+		Topic:   sc.DailyDeliveryTopic,
+		Key:     user.Nickname,
+		Value:   value,
+		Headers: delivery.Headers(sc.MainServiceName, messages.ChildTraceParent(runTraceParent)),
+	}, nil
+}
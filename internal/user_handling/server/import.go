@@ -0,0 +1,147 @@
+package uh_server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/mail"
+	"time"
+
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	pb "github.com/KSpaceer/go_watermelon/internal/user_handling/proto"
+)
+
+/***************************************
+    This file contains the bulk import
+   of users with throttled sending of
+         confirmation emails.
+***************************************/
+
+const (
+	// defaultConfirmationRate is the default number of confirmation emails per second
+	// requested during the import.
+	defaultConfirmationRate = 10
+
+	// importActor is the actor name of audit records created by the import.
+	importActor = "admin"
+)
+
+// SetConfirmationRate changes the maximum number of confirmation emails per second which
+// are requested by ImportUsers. The rate must be positive.
+func (s *UserHandlingServer) SetConfirmationRate(perSecond int) error {
+	if perSecond <= 0 {
+		return fmt.Errorf("Confirmation rate must be positive.")
+	}
+	s.confirmationInterval = time.Second / time.Duration(perSecond)
+	return nil
+}
+
+// ImportUsers is the part of gRPC service implementation. It receives a stream of users and validates
+// each of them. For valid users it sends authenticating emails with limited rate. If the caller is an
+// administrator and the user's consent is given, the user is inserted directly with an audit record instead.
+// Errors of invalid rows don't interrupt the import and are returned in the report.
+func (s *UserHandlingServer) ImportUsers(stream pb.UserHandling_ImportUsersServer) error {
+	s.Info().Msg("Got a call for ImportUsers method.")
+	ctx := stream.Context()
+	isAdmin := s.checkAdmin(ctx) == nil
+	report := &pb.ImportReport{}
+	seen := make(map[string]bool)
+	nextConfirmation := time.Now()
+	for {
+		imported, err := stream.Recv()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			s.Error().Msgf("An error occured while receiving imported users: %v", err)
+			return err
+		}
+		user := data.User{Nickname: imported.GetUser().GetNickname(), Email: imported.GetUser().GetEmail()}
+		user.Language, err = normalizeLanguage(imported.GetUser().GetLanguage())
+		if err == nil {
+			err = s.validateImportedUser(ctx, user, imported.Consent, isAdmin, seen)
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, &pb.RowError{Row: imported.Row, Message: err.Error()})
+			continue
+		}
+		seen[user.Nickname] = true
+		if imported.Consent {
+			err = s.importWithConsent(ctx, user)
+			if err == nil {
+				report.Imported++
+			}
+		} else {
+			if wait := time.Until(nextConfirmation); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			nextConfirmation = time.Now().Add(s.confirmationInterval)
+			err = s.requestConfirmation(ctx, user)
+			if err == nil {
+				report.ConfirmationsSent++
+			}
+		}
+		if err != nil {
+			report.Errors = append(report.Errors, &pb.RowError{Row: imported.Row, Message: err.Error()})
+		}
+	}
+	s.Info().Msgf("Finished import: %d users imported, %d confirmations sent, %d rows failed.",
+		report.Imported, report.ConfirmationsSent, len(report.Errors))
+	return stream.SendAndClose(report)
+}
+
+// validateImportedUser checks that the user has a nickname which is not used in database or earlier
+// in the import, a valid email and, if consent is given, that the caller is an administrator.
+func (s *UserHandlingServer) validateImportedUser(ctx context.Context, user data.User, consent, isAdmin bool, seen map[string]bool) error {
+	if user.Nickname == "" {
+		return fmt.Errorf("Empty nickname.")
+	}
+	if _, err := mail.ParseAddress(user.Email); err != nil {
+		return fmt.Errorf("Invalid email.")
+	}
+	if consent && !isAdmin {
+		return fmt.Errorf("Consent flag requires admin token.")
+	}
+	if seen[user.Nickname] {
+		return fmt.Errorf("Duplicate nickname in import.")
+	}
+	if ok, err := s.CheckNicknameInDatabase(ctx, user.Nickname); err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return err
+	} else if ok {
+		return fmt.Errorf("User with this nickname already exists.")
+	}
+	return nil
+}
+
+// importWithConsent adds the user to database without confirmation and saves an audit record about it.
+func (s *UserHandlingServer) importWithConsent(ctx context.Context, user data.User) error {
+	if err := s.AddUserToDatabase(ctx, user); err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return err
+	}
+	err := s.AddAuditRecord(ctx, data.AuditRecord{Actor: importActor, Action: data.AuditActionImportWithConsent,
+		Nickname: user.Nickname})
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return err
+	}
+	return nil
+}
+
+// requestConfirmation caches ADD operation for the user and sends an authenticating email.
+func (s *UserHandlingServer) requestConfirmation(ctx context.Context, user data.User) error {
+	key, err := s.SetOperation(ctx, user, data.OperationAdd, nil)
+	if err != nil {
+		s.Error().Msgf("An error occured while accessing cache: %v", err)
+		return err
+	}
+	if err := s.sendAuthEmail(ctx, user.Nickname, user.Email, key, string(data.OperationAdd), user.Language); err != nil {
+		s.Error().Msgf("An error occured while sending message to MB: %v", err)
+		return err
+	}
+	return nil
+}
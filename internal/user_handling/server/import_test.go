@@ -0,0 +1,100 @@
+package uh_server_test
+
+import (
+	"context"
+	"io"
+	"testing"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	pb "github.com/KSpaceer/go_watermelon/internal/user_handling/proto"
+	uh "github.com/KSpaceer/go_watermelon/internal/user_handling/server"
+
+	"github.com/rs/zerolog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/Shopify/sarama"
+	saramamock "github.com/Shopify/sarama/mocks"
+)
+
+type MockImportStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	rows   []*pb.ImportedUser
+	report *pb.ImportReport
+}
+
+func (stream *MockImportStream) Context() context.Context {
+	return stream.ctx
+}
+
+func (stream *MockImportStream) Recv() (*pb.ImportedUser, error) {
+	if len(stream.rows) == 0 {
+		return nil, io.EOF
+	}
+	row := stream.rows[0]
+	stream.rows = stream.rows[1:]
+	return row, nil
+}
+
+func (stream *MockImportStream) SendAndClose(report *pb.ImportReport) error {
+	stream.report = report
+	return nil
+}
+
+func TestImportUsersWithConfirmations(t *testing.T) {
+	mockData := new(MockData)
+	mockProducer := saramamock.NewSyncProducer(t, sarama.NewConfig())
+	uhServer := uh.NewUserHandlingServer(mockData, broker.NewKafkaPublisher(mockProducer))
+	uhServer.Logger = zerolog.Nop()
+	assert.Nil(t, uhServer.SetConfirmationRate(1000))
+	stream := &MockImportStream{ctx: context.Background(), rows: []*pb.ImportedUser{
+		{User: &pb.User{Nickname: "pupa", Email: "buhga@example.com"}, Row: 2},
+		{User: &pb.User{Nickname: "lupa", Email: "notanemail"}, Row: 3},
+		{User: &pb.User{Nickname: "pupa", Email: "pupa@example.com"}, Row: 4},
+		{User: &pb.User{Nickname: "exists", Email: "exists@example.com"}, Row: 5},
+		{User: &pb.User{Nickname: "sneaky", Email: "sneaky@example.com"}, Consent: true, Row: 6},
+	}}
+	mockData.On("CheckNicknameInDatabase", mock.Anything, "pupa").Return(false, nil)
+	mockData.On("CheckNicknameInDatabase", mock.Anything, "exists").Return(true, nil)
+	mockData.On("SetOperation", mock.Anything, data.User{Nickname: "pupa", Email: "buhga@example.com"}, data.OperationAdd, map[string]string(nil)).Return("key", nil)
+	mockProducer.ExpectSendMessageAndSucceed()
+	assert.Nil(t, uhServer.ImportUsers(stream))
+	mockData.AssertExpectations(t)
+	if assert.NotNil(t, stream.report) {
+		assert.Equal(t, int32(0), stream.report.Imported)
+		assert.Equal(t, int32(1), stream.report.ConfirmationsSent)
+		var failedRows []int32
+		for _, rowError := range stream.report.Errors {
+			failedRows = append(failedRows, rowError.Row)
+		}
+		assert.Equal(t, []int32{3, 4, 5, 6}, failedRows)
+	}
+}
+
+func TestImportUsersWithConsent(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	uhServer.SetAdminToken("secret")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret"))
+	testUser := data.User{Nickname: "migrated", Email: "migrated@example.com"}
+	stream := &MockImportStream{ctx: ctx, rows: []*pb.ImportedUser{
+		{User: &pb.User{Nickname: testUser.Nickname, Email: testUser.Email}, Consent: true, Row: 2},
+	}}
+	mockData.On("CheckNicknameInDatabase", ctx, testUser.Nickname).Return(false, nil)
+	mockData.On("AddUserToDatabase", ctx, testUser).Return(nil)
+	mockData.On("AddAuditRecord", ctx, data.AuditRecord{Actor: "admin", Action: data.AuditActionImportWithConsent,
+		Nickname: testUser.Nickname}).Return(nil)
+	assert.Nil(t, uhServer.ImportUsers(stream))
+	mockData.AssertExpectations(t)
+	if assert.NotNil(t, stream.report) {
+		assert.Equal(t, int32(1), stream.report.Imported)
+		assert.Empty(t, stream.report.Errors)
+	}
+}
@@ -0,0 +1,89 @@
+package uh_server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/metadata"
+)
+
+/***************************************
+    This file contains the parsing of
+   users' preferred email languages and
+     Accept-Language header values.
+***************************************/
+
+// acceptLanguageMetadataKey is the gRPC metadata key with Accept-Language header forwarded by the proxy.
+const acceptLanguageMetadataKey = "accept-language"
+
+// languageTagPattern matches BCP 47 language tags like "ru" or "pt-BR".
+var languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,8}(-[a-zA-Z0-9]{1,8})*$`)
+
+// normalizeLanguage returns the lowercase primary subtag of given language tag (e.g. "pt" for "pt-BR"),
+// which is the name of language in email templates. Empty tag means the default language.
+func normalizeLanguage(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", nil
+	} else if !languageTagPattern.MatchString(tag) {
+		return "", fmt.Errorf("Invalid language.")
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	return strings.ToLower(primary), nil
+}
+
+// parseAcceptLanguage returns the normalized language with the highest quality in the value of
+// Accept-Language header or an empty string if there is no valid language.
+func parseAcceptLanguage(header string) string {
+	best, bestQuality := "", 0.0
+	for _, item := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(item, ";")
+		quality := 1.0
+		if params = strings.TrimSpace(params); strings.HasPrefix(params, "q=") {
+			var err error
+			if quality, err = strconv.ParseFloat(strings.TrimPrefix(params, "q="), 64); err != nil {
+				continue
+			}
+		}
+		language, err := normalizeLanguage(tag)
+		if err != nil || language == "" || quality <= bestQuality {
+			continue
+		}
+		best, bestQuality = language, quality
+	}
+	return best
+}
+
+// acceptedLanguage returns the preferred language from Accept-Language metadata of the call.
+func acceptedLanguage(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(acceptLanguageMetadataKey); len(values) > 0 {
+			return parseAcceptLanguage(strings.Join(values, ","))
+		}
+	}
+	return ""
+}
+
+// storedLanguage returns the preferred language of emails saved for user with given nickname or,
+// if it isn't set, the preferred language of the caller.
+func (s *UserHandlingServer) storedLanguage(ctx context.Context, nickname string) (string, error) {
+	language, err := s.GetLanguageByNickname(ctx, nickname)
+	if err != nil {
+		return "", err
+	} else if language == "" {
+		return acceptedLanguage(ctx), nil
+	}
+	return language, nil
+}
+
+// userLanguage returns the normalized language requested for the user or, if it is empty,
+// the preferred language of the caller.
+func userLanguage(ctx context.Context, requested string) (string, error) {
+	if requested != "" {
+		return normalizeLanguage(requested)
+	}
+	return acceptedLanguage(ctx), nil
+}
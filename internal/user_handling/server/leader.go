@@ -0,0 +1,79 @@
+package uh_server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+/***************************************
+    This file contains the leader
+   election of main service replicas,
+    so only one of them sends daily
+   messages and relays outbox events.
+***************************************/
+
+// LeaderLock is a distributed lock which can be held by only one replica of main service at a time
+// (e.g. data.AdvisoryLock).
+type LeaderLock interface {
+	// TryAcquire tries to acquire the lock without waiting (or checks that it is still held)
+	// and returns true if the lock is held by the caller.
+	TryAcquire(ctx context.Context) (bool, error)
+
+	// Release releases the lock, if it is held.
+	Release(ctx context.Context) error
+}
+
+// LeadDailyDelivery runs DailyDelivery and RelayOutboxEvents only while this replica holds the leader lock,
+// so daily messages are sent and outbox events are published by one replica. The lock is
+// tried (or checked, if it is already held) every checkInterval, so if the leader dies or loses
+// connection to the lock, another replica takes over. Changes of leadership are logged with the ID
+// of replica. The lock is released when cancelChan is closed.
+func (s *UserHandlingServer) LeadDailyDelivery(wg *sync.WaitGroup, cancelChan <-chan struct{}, lock LeaderLock,
+	replicaID string, checkInterval time.Duration) {
+	defer wg.Done()
+	var leaderCancel chan struct{}
+	leaderWG := new(sync.WaitGroup)
+	stepDown := func() {
+		close(leaderCancel)
+		leaderWG.Wait()
+		leaderCancel = nil
+	}
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+	s.Info().Msgf("Replica %s is waiting for leadership of daily delivery.", replicaID)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+		isLeader, err := lock.TryAcquire(ctx)
+		cancel()
+		if err != nil {
+			s.Error().Msgf("An error occured while acquiring leader lock: %v", err)
+		}
+		if isLeader && leaderCancel == nil {
+			s.Info().Msgf("Replica %s became the leader of daily delivery.", replicaID)
+			leaderCancel = make(chan struct{})
+			leaderWG.Add(2)
+			go s.DailyDelivery(leaderWG, leaderCancel)
+			go s.RelayOutboxEvents(leaderWG, leaderCancel)
+		} else if !isLeader && leaderCancel != nil {
+			s.Warn().Msgf("Replica %s lost leadership of daily delivery.", replicaID)
+			stepDown()
+		}
+		select {
+		case <-ticker.C:
+		case <-cancelChan:
+			if leaderCancel == nil {
+				return
+			}
+			stepDown()
+			ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+			defer cancel()
+			if err := lock.Release(ctx); err != nil {
+				s.Error().Msgf("An error occured while releasing leader lock: %v", err)
+				return
+			}
+			s.Info().Msgf("Replica %s released leadership of daily delivery.", replicaID)
+			return
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package uh_server_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	uh "github.com/KSpaceer/go_watermelon/internal/user_handling/server"
+
+	"github.com/rs/zerolog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeLock returns scripted results of TryAcquire, repeating the last one after the script is over.
+type fakeLock struct {
+	mu       sync.Mutex
+	results  []bool
+	done     chan struct{}
+	released bool
+}
+
+func (l *fakeLock) TryAcquire(ctx context.Context) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	result := l.results[0]
+	if len(l.results) > 1 {
+		l.results = l.results[1:]
+	} else if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+	return result, nil
+}
+
+func (l *fakeLock) Release(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.released = true
+	return nil
+}
+
+func TestLeadDailyDelivery(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	mockData.On("GetUnfinishedDeliveryRuns", mock.Anything).Return([]string{}, nil)
+	done := make(chan struct{})
+	lock := &fakeLock{results: []bool{false, true, true, false, true}, done: done}
+	cancelChan := make(chan struct{})
+	wg := new(sync.WaitGroup)
+	wg.Add(1)
+	go uhServer.LeadDailyDelivery(wg, cancelChan, lock, "replica-1", time.Millisecond)
+	<-done
+	close(cancelChan)
+	wg.Wait()
+	mockData.AssertNumberOfCalls(t, "GetUnfinishedDeliveryRuns", 2)
+	assert.True(t, lock.released)
+}
@@ -0,0 +1,145 @@
+package uh_server
+
+import (
+	"context"
+	"fmt"
+	"net/mail"
+	"strconv"
+
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	pb "github.com/KSpaceer/go_watermelon/internal/user_handling/proto"
+)
+
+const (
+	// newEmailParam is the parameter of change email operation with the new email address.
+	newEmailParam = "new_email"
+
+	// pausedParam is the parameter of pause operation with the new value of pause flag.
+	pausedParam = "paused"
+)
+
+// operationHandler describes how a confirmed operation of some kind is checked and executed.
+type operationHandler struct {
+	// validate checks that the operation is well-formed before executing it.
+	validate func(opn *data.Operation) error
+
+	// execute performs the operation and returns the response for AuthUser.
+	execute func(s *UserHandlingServer, ctx context.Context, opn *data.Operation) (*pb.Response, error)
+}
+
+// operations is the registry of all kinds of operations which can be confirmed through AuthUser.
+var operations = make(map[data.OperationKind]operationHandler)
+
+// registerOperation adds the handler of given operation kind to registry.
+func registerOperation(kind data.OperationKind, handler operationHandler) {
+	if _, ok := operations[kind]; ok {
+		panic(fmt.Sprintf("operation %s is registered twice", kind))
+	}
+	operations[kind] = handler
+}
+
+func init() {
+	registerOperation(data.OperationAdd, operationHandler{validate: validateUser, execute: executeAdd})
+	registerOperation(data.OperationDelete, operationHandler{validate: validateNickname, execute: executeDelete})
+	registerOperation(data.OperationChangeEmail, operationHandler{validate: validateChangeEmail, execute: executeChangeEmail})
+	registerOperation(data.OperationPause, operationHandler{validate: validatePause, execute: executePause})
+	registerOperation(data.OperationExport, operationHandler{validate: validateNickname, execute: executeExport})
+}
+
+// dispatchOperation finds the handler of the operation in registry, then validates and executes the operation.
+func (s *UserHandlingServer) dispatchOperation(ctx context.Context, opn *data.Operation) (*pb.Response, error) {
+	handler, ok := operations[opn.Method]
+	if !ok {
+		return nil, fmt.Errorf("Wrong key.")
+	} else if opn.Version > data.OperationVersion {
+		return nil, fmt.Errorf("Unsupported operation version %d.", opn.Version)
+	}
+	if err := handler.validate(opn); err != nil {
+		return nil, err
+	}
+	return handler.execute(s, ctx, opn)
+}
+
+// validateNickname checks that the operation has user's nickname.
+func validateNickname(opn *data.Operation) error {
+	if opn.User.Nickname == "" {
+		return fmt.Errorf("Invalid operation: empty nickname.")
+	}
+	return nil
+}
+
+// validateUser checks that the operation has user's nickname and valid email.
+func validateUser(opn *data.Operation) error {
+	if err := validateNickname(opn); err != nil {
+		return err
+	}
+	if _, err := mail.ParseAddress(opn.User.Email); err != nil {
+		return fmt.Errorf("Invalid operation: invalid email.")
+	}
+	return nil
+}
+
+// validateChangeEmail checks that the operation has user's nickname and valid new email.
+func validateChangeEmail(opn *data.Operation) error {
+	if err := validateNickname(opn); err != nil {
+		return err
+	}
+	if _, err := mail.ParseAddress(opn.Params[newEmailParam]); err != nil {
+		return fmt.Errorf("Invalid operation: invalid new email.")
+	}
+	return nil
+}
+
+// validatePause checks that the operation has user's nickname and boolean pause flag.
+func validatePause(opn *data.Operation) error {
+	if err := validateNickname(opn); err != nil {
+		return err
+	}
+	if _, err := strconv.ParseBool(opn.Params[pausedParam]); err != nil {
+		return fmt.Errorf("Invalid operation: invalid pause flag.")
+	}
+	return nil
+}
+
+// executedResponse returns the response of successfully executed operation.
+func executedResponse(opn *data.Operation) *pb.Response {
+	return &pb.Response{Message: fmt.Sprintf("Method %s was executed successfully.", opn.Method)}
+}
+
+// executeAdd adds the user of the operation into database.
+func executeAdd(s *UserHandlingServer, ctx context.Context, opn *data.Operation) (*pb.Response, error) {
+	if err := s.AddUserToDatabase(ctx, opn.User); err != nil {
+		return nil, err
+	}
+	return executedResponse(opn), nil
+}
+
+// executeDelete deletes the user of the operation from database.
+func executeDelete(s *UserHandlingServer, ctx context.Context, opn *data.Operation) (*pb.Response, error) {
+	if err := s.DeleteUserFromDatabase(ctx, opn.User); err != nil {
+		return nil, err
+	}
+	return executedResponse(opn), nil
+}
+
+// executeChangeEmail replaces the email of the user with the new email of the operation.
+func executeChangeEmail(s *UserHandlingServer, ctx context.Context, opn *data.Operation) (*pb.Response, error) {
+	if err := s.ChangeUserEmail(ctx, opn.User.Nickname, opn.Params[newEmailParam]); err != nil {
+		return nil, err
+	}
+	return executedResponse(opn), nil
+}
+
+// executePause pauses or resumes daily delivery for the user of the operation.
+func executePause(s *UserHandlingServer, ctx context.Context, opn *data.Operation) (*pb.Response, error) {
+	paused, _ := strconv.ParseBool(opn.Params[pausedParam])
+	if err := s.SetUserPaused(ctx, opn.User.Nickname, paused); err != nil {
+		return nil, err
+	}
+	return executedResponse(opn), nil
+}
+
+// executeExport returns all data stored about the user of the operation as JSON bundle.
+func executeExport(s *UserHandlingServer, ctx context.Context, opn *data.Operation) (*pb.Response, error) {
+	return s.exportUserData(ctx, opn.User)
+}
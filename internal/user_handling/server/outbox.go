@@ -0,0 +1,104 @@
+package uh_server
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
+)
+
+/***************************************
+    This file contains the relay of
+     domain events from the outbox
+   table to the message broker topic.
+***************************************/
+
+const (
+	// outboxBatchSize limits the number of events published in one relay iteration.
+	outboxBatchSize = 100
+
+	// outboxPollInterval defines how often the outbox is checked for new events.
+	outboxPollInterval time.Duration = time.Second
+
+	// outboxMaxBackoff limits the growth of polling interval after failed iterations.
+	outboxMaxBackoff time.Duration = time.Minute
+)
+
+// PublishOutboxEvents publishes a batch of unpublished outbox events to the message broker and marks
+// published ones in database. Tombstones of erased users are published to the erasure topic and other
+// events to the user events topic. Messages are keyed by user's nickname (or its' hash for tombstones), so events of one user
+// get into the same partition. If an event of some user fails to be published, the following events
+// of this user are left in the outbox to keep their order. Returns the last publishing error.
+func (s *UserHandlingServer) PublishOutboxEvents() error {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	events, err := s.GetUnpublishedEvents(ctx, outboxBatchSize)
+	cancel()
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return err
+	}
+	var publishErr error
+	failedUsers := make(map[string]bool)
+	published := make([]int64, 0, len(events))
+	for _, event := range events {
+		if failedUsers[event.Nickname] {
+			continue
+		}
+		msg := &broker.Message{
+			Topic: outboxTopic(event.Type),
+			Key:   event.Nickname,
+			Value: []byte(event.Payload),
+		}
+		if err := s.Publish(msg); err != nil {
+			s.Error().Msgf("An error occured while sending outbox event %d to MB: %v", event.ID, err)
+			failedUsers[event.Nickname] = true
+			publishErr = err
+			continue
+		}
+		published = append(published, event.ID)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+	if err := s.MarkEventsPublished(ctx, published); err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return err
+	}
+	return publishErr
+}
+
+// outboxTopic returns the topic of outbox events with given type.
+func outboxTopic(eventType string) string {
+	if eventType == data.EventTypeUserErased {
+		return sc.ErasureTopic
+	}
+	return sc.UserEventsTopic
+}
+
+// RelayOutboxEvents periodically publishes outbox events until cancelChan is closed.
+// After a failed iteration the polling interval is doubled (up to outboxMaxBackoff), so
+// failed events are retried with backoff.
+func (s *UserHandlingServer) RelayOutboxEvents(wg *sync.WaitGroup, cancelChan <-chan struct{}) {
+	defer wg.Done()
+	interval := outboxPollInterval
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if err := s.PublishOutboxEvents(); err != nil {
+				interval *= 2
+				if interval > outboxMaxBackoff {
+					interval = outboxMaxBackoff
+				}
+			} else {
+				interval = outboxPollInterval
+			}
+			timer.Reset(interval)
+		case <-cancelChan:
+			return
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package uh_server_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
+	uh "github.com/KSpaceer/go_watermelon/internal/user_handling/server"
+
+	"github.com/rs/zerolog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/Shopify/sarama"
+	saramamock "github.com/Shopify/sarama/mocks"
+)
+
+func TestPublishOutboxEventsSuccess(t *testing.T) {
+	mockData := new(MockData)
+	mockProducer := saramamock.NewSyncProducer(t, sarama.NewConfig())
+	uhServer := uh.NewUserHandlingServer(mockData, broker.NewKafkaPublisher(mockProducer))
+	uhServer.Logger = zerolog.Nop()
+	testEvents := []data.OutboxEvent{
+		{ID: 1, Nickname: "pupa", Type: data.EventTypeUserSubscribed, Payload: `{"type":"user.subscribed"}`},
+		{ID: 2, Nickname: "lupa", Type: data.EventTypeUserSubscribed, Payload: `{"type":"user.subscribed"}`},
+	}
+	mockData.On("GetUnpublishedEvents", mock.Anything, mock.Anything).Return(testEvents, nil)
+	mockData.On("MarkEventsPublished", mock.Anything, []int64{1, 2}).Return(nil)
+	for _, event := range testEvents {
+		expectedKey, expectedValue := event.Nickname, event.Payload
+		msgChecker := func(msg *sarama.ProducerMessage) error {
+			if msg.Topic != sc.UserEventsTopic {
+				return fmt.Errorf("Wrong topic: expected %q but got %q", sc.UserEventsTopic, msg.Topic)
+			} else if msg.Key != sarama.StringEncoder(expectedKey) {
+				return fmt.Errorf("Wrong key: expected %q but got %q", expectedKey, msg.Key)
+			} else if value, _ := msg.Value.Encode(); string(value) != expectedValue {
+				return fmt.Errorf("Wrong value: expected %q but got %q", expectedValue, value)
+			}
+			return nil
+		}
+		mockProducer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(saramamock.MessageChecker(msgChecker))
+	}
+	assert.Nil(t, uhServer.PublishOutboxEvents())
+	mockData.AssertExpectations(t)
+}
+
+func TestPublishOutboxEventsKeepsUserOrder(t *testing.T) {
+	mockData := new(MockData)
+	mockProducer := saramamock.NewSyncProducer(t, sarama.NewConfig())
+	uhServer := uh.NewUserHandlingServer(mockData, broker.NewKafkaPublisher(mockProducer))
+	uhServer.Logger = zerolog.Nop()
+	testEvents := []data.OutboxEvent{
+		{ID: 1, Nickname: "pupa", Type: data.EventTypeUserSubscribed},
+		{ID: 2, Nickname: "lupa", Type: data.EventTypeUserSubscribed},
+		{ID: 3, Nickname: "pupa", Type: data.EventTypeUserUnsubscribed},
+	}
+	mockData.On("GetUnpublishedEvents", mock.Anything, mock.Anything).Return(testEvents, nil)
+	mockData.On("MarkEventsPublished", mock.Anything, []int64{2}).Return(nil)
+	mockProducer.ExpectSendMessageAndFail(fmt.Errorf("FAIL"))
+	mockProducer.ExpectSendMessageAndSucceed()
+	assert.NotNil(t, uhServer.PublishOutboxEvents())
+	mockData.AssertExpectations(t)
+}
+
+func TestPublishOutboxEventsTombstone(t *testing.T) {
+	mockData := new(MockData)
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	testEvents := []data.OutboxEvent{
+		{ID: 1, Nickname: "pupa", Type: data.EventTypeUserUnsubscribed, Payload: `{"type":"user.unsubscribed"}`},
+		{ID: 2, Nickname: "abcdef", Type: data.EventTypeUserErased, Payload: `{"nickname_hash":"abcdef"}`},
+	}
+	mockData.On("GetUnpublishedEvents", mock.Anything, mock.Anything).Return(testEvents, nil)
+	mockData.On("MarkEventsPublished", mock.Anything, []int64{1, 2}).Return(nil)
+	assert.Nil(t, uhServer.PublishOutboxEvents())
+	mockData.AssertExpectations(t)
+	assert.Len(t, memory.Messages(sc.UserEventsTopic), 1)
+	tombstones := memory.Messages(sc.ErasureTopic)
+	if assert.Len(t, tombstones, 1) {
+		assert.Equal(t, "abcdef", tombstones[0].Key)
+		assert.Equal(t, `{"nickname_hash":"abcdef"}`, string(tombstones[0].Value))
+	}
+}
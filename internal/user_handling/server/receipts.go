@@ -0,0 +1,54 @@
+package uh_server
+
+import (
+	"context"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
+)
+
+/***************************************
+    This file contains the consumer of
+    delivery receipts, which are sent
+   by email service after every email.
+***************************************/
+
+// ConsumeReceipts subscribes to the receipts topic and records consumed delivery receipts
+// until ctx is done. Invalid receipts are logged and skipped, while receipts which failed
+// to be recorded are not committed, so they are consumed again.
+func (s *UserHandlingServer) ConsumeReceipts(ctx context.Context, subscriber broker.Subscriber) error {
+	return subscriber.Subscribe(ctx, []string{sc.ReceiptsTopic}, s.handleReceipt)
+}
+
+// handleReceipt decodes the delivery receipt and saves it into database.
+func (s *UserHandlingServer) handleReceipt(ctx context.Context, msg *broker.Message, done func(commit bool)) {
+	receipt, err := messages.DecodeDeliveryReceipt(msg.Value)
+	if err != nil {
+		s.Error().Msgf("Got invalid delivery receipt: %v", err)
+		done(true)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	defer cancel()
+	recorded, err := s.RecordDeliveryReceipt(ctx, data.DeliveryReceipt{
+		ID:           receipt.ID,
+		RequestID:    receipt.RequestID,
+		RequestTopic: receipt.RequestTopic,
+		Nickname:     receipt.Nickname,
+		Sent:         receipt.Outcome == messages.OutcomeSent,
+		SMTPResponse: receipt.SMTPResponse,
+		Attempts:     receipt.Attempts,
+		Time:         receipt.CreatedAt,
+	})
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		done(false)
+		return
+	}
+	if recorded && receipt.Outcome == messages.OutcomeFailed {
+		s.Warn().Msgf("Failed to deliver email %s after %d attempts.", receipt.RequestID, receipt.Attempts)
+	}
+	done(true)
+}
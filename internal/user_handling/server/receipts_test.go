@@ -0,0 +1,63 @@
+package uh_server_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/KSpaceer/go_watermelon/internal/broker"
+	"github.com/KSpaceer/go_watermelon/internal/data"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
+	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
+	uh "github.com/KSpaceer/go_watermelon/internal/user_handling/server"
+
+	"github.com/rs/zerolog"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestConsumeReceipts(t *testing.T) {
+	mockData := new(MockData)
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	sent, err := messages.NewDeliveryReceipt("m1", sc.DailyDeliveryTopic, "pupa", 1, nil)
+	if !assert.Nil(t, err) {
+		return
+	}
+	failed, err := messages.NewDeliveryReceipt("m2", sc.DailyDeliveryTopic, "lupa", 5, errors.New("550 Mailbox unavailable"))
+	if !assert.Nil(t, err) {
+		return
+	}
+	var msgs []*broker.Message
+	for _, receipt := range []*messages.DeliveryReceipt{sent, failed} {
+		value, err := receipt.Encode()
+		if !assert.Nil(t, err) {
+			return
+		}
+		msgs = append(msgs, &broker.Message{Topic: sc.ReceiptsTopic, Key: receipt.Nickname, Value: value})
+	}
+	msgs = append(msgs, &broker.Message{Topic: sc.ReceiptsTopic, Key: "pupa", Value: []byte("{}")})
+	assert.Nil(t, memory.Publish(msgs...))
+
+	recordedAll := make(chan struct{})
+	mockData.On("RecordDeliveryReceipt", mock.Anything, data.DeliveryReceipt{ID: sent.ID, RequestID: "m1",
+		RequestTopic: sc.DailyDeliveryTopic, Nickname: "pupa", Sent: true, Attempts: 1, Time: sent.CreatedAt}).Return(true, nil)
+	mockData.On("RecordDeliveryReceipt", mock.Anything, data.DeliveryReceipt{ID: failed.ID, RequestID: "m2",
+		RequestTopic: sc.DailyDeliveryTopic, Nickname: "lupa", SMTPResponse: "550 Mailbox unavailable", Attempts: 5,
+		Time: failed.CreatedAt}).Return(true, nil).Run(func(mock.Arguments) { close(recordedAll) })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-recordedAll:
+			time.Sleep(10 * time.Millisecond)
+		case <-time.After(time.Second):
+		}
+		cancel()
+	}()
+	assert.Nil(t, uhServer.ConsumeReceipts(ctx, memory))
+	mockData.AssertExpectations(t)
+}
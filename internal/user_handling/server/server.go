@@ -2,49 +2,108 @@ package uh_server
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/mail"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/protobuf/types/known/emptypb"
 
+	"github.com/KSpaceer/go_watermelon/internal/broker"
 	"github.com/KSpaceer/go_watermelon/internal/data"
 	"github.com/KSpaceer/go_watermelon/internal/kafkawriter"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
 	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
 	pb "github.com/KSpaceer/go_watermelon/internal/user_handling/proto"
-	"github.com/Shopify/sarama"
 	"github.com/rs/zerolog"
 )
 
 const (
 	// ctxTimeout is used to make a context with timeout of given time.
 	ctxTimeout time.Duration = 3 * time.Second
+
+	// authorizationMetadataKey is the gRPC metadata key with admin credentials.
+	authorizationMetadataKey = "authorization"
+
+	// bearerPrefix precedes the admin token in authorization metadata.
+	bearerPrefix = "Bearer "
+
+	// runIDLayout is the layout of delivery run IDs (the scheduled time of run in UTC).
+	runIDLayout = "20060102T150405Z"
 )
 
 // UserHandlingServer implements UserHandling gRPC service and also embeds
 // additional entities to it work such as data.Data (database and cache),
-// message broker (Kafka) producer and logger.
+// message broker publisher and logger.
 type UserHandlingServer struct {
 	pb.UnimplementedUserHandlingServer
 	data.Data
-	sarama.SyncProducer
+	broker.Publisher
 	zerolog.Logger
+
+	// adminToken is a secret which must be presented to call administrative methods.
+	// If it is empty, administrative methods are disabled.
+	adminToken string
+
+	// confirmationInterval is the minimal interval between confirmation emails requested by ImportUsers.
+	confirmationInterval time.Duration
+
+	// delivery* fields are the settings of workers publishing daily messages (see delivery.go).
+	// Zero deliveryRateInterval means no rate limit.
+	deliveryWorkers      int
+	deliveryBatchSize    int
+	deliveryRateInterval time.Duration
 }
 
 // NewUserHandlingServer creates a new UserHandlingServer instance using given data.Data and
-// Kafka producer. Also, basing on the producer, it creates a logger which writes simultaneously
+// message broker publisher. Also, basing on the publisher, it creates a logger which writes simultaneously
 // to stderr and message broker.
-func NewUserHandlingServer(dataHandler data.Data, producer sarama.SyncProducer) *UserHandlingServer {
-	logger := zerolog.New(io.MultiWriter(os.Stderr, kafkawriter.New(producer))).With().Timestamp().Logger()
-	return &UserHandlingServer{Data: dataHandler, SyncProducer: producer, Logger: logger}
+func NewUserHandlingServer(dataHandler data.Data, publisher broker.Publisher) *UserHandlingServer {
+	logger := zerolog.New(io.MultiWriter(os.Stderr, kafkawriter.New(publisher, sc.MainServiceName))).With().Timestamp().Logger()
+	return &UserHandlingServer{Data: dataHandler, Publisher: publisher, Logger: logger,
+		confirmationInterval: time.Second / defaultConfirmationRate, deliveryWorkers: defaultDeliveryWorkers,
+		deliveryBatchSize: defaultDeliveryBatchSize}
+}
+
+// SetLogWriter replaces the message broker writer of the logger (e.g. with asynchronous one).
+// Logs are still written to stderr too.
+func (s *UserHandlingServer) SetLogWriter(w io.Writer) {
+	s.Logger = zerolog.New(io.MultiWriter(os.Stderr, w)).With().Timestamp().Logger()
+}
+
+// SetAdminToken sets the token required by administrative methods (e.g. EraseUser).
+func (s *UserHandlingServer) SetAdminToken(token string) {
+	s.adminToken = token
+}
+
+// checkAdmin verifies that the call's metadata contains valid admin token.
+func (s *UserHandlingServer) checkAdmin(ctx context.Context) error {
+	if s.adminToken == "" {
+		return fmt.Errorf("Administrative methods are disabled.")
+	}
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return fmt.Errorf("Permission denied.")
+	}
+	for _, value := range md.Get(authorizationMetadataKey) {
+		token := strings.TrimPrefix(value, bearerPrefix)
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+			return nil
+		}
+	}
+	return fmt.Errorf("Permission denied.")
 }
 
 // AuthUser is the part of gRPC service implementation. It authenticates the user and executes
-// cached operation, which is accessed through given key.
+// cached operation, which is accessed through given key. Operations are dispatched through
+// the registry defined in operations.go.
 func (s *UserHandlingServer) AuthUser(ctx context.Context, key *pb.Key) (*pb.Response, error) {
 	s.Info().Msgf("Got a call for AuthUser method with key %q", key)
 	operation, err := s.GetOperation(ctx, key.Key)
@@ -52,25 +111,43 @@ func (s *UserHandlingServer) AuthUser(ctx context.Context, key *pb.Key) (*pb.Res
 		s.Error().Msgf("An error occured while accessing cache: %v", err)
 		return nil, err
 	}
-	if operation.Method == "ADD" {
-		err = s.AddUserToDatabase(ctx, operation.User)
-	} else if operation.Method == "DELETE" {
-		err = s.DeleteUserFromDatabase(ctx, operation.User)
-	} else {
-		return nil, fmt.Errorf("Wrong key.")
+	response, err := s.dispatchOperation(ctx, operation)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing operation %s: %v", operation.Method, err)
+		return nil, err
 	}
+	s.Info().Msgf("Successfully executed method %s.", operation.Method)
+	return response, nil
+}
+
+// exportUserData collects all data stored about the user and returns it as JSON bundle in response message.
+func (s *UserHandlingServer) exportUserData(ctx context.Context, user data.User) (*pb.Response, error) {
+	userData, err := s.GetUserData(ctx, user.Nickname)
 	if err != nil {
 		s.Error().Msgf("An error occured while executing database operation: %v", err)
 		return nil, err
+	} else if userData == nil {
+		return nil, fmt.Errorf("There is no user with such nickname.")
+	}
+	bundle, err := json.Marshal(userData)
+	if err != nil {
+		s.Error().Msgf("An error occured while encoding user data: %v", err)
+		return nil, err
 	}
-	s.Info().Msgf("Successfully executed method %s for user %s.", operation.Method, operation.User.Nickname)
-	return &pb.Response{Message: fmt.Sprintf("Method %s was executed successfully.", operation.Method)}, nil
+	s.Info().Msg("Successfully exported data of user.")
+	return &pb.Response{Message: string(bundle)}, nil
 }
 
 // AddUser is the part of gRPC service implementation. In case the user with this nickname does not exist,
 // the method sends an authenticating email (with help of the email service) using user's email address.
+// The user's language is saved as the preferred language of emails; if it is empty, the language is taken
+// from Accept-Language header of the request.
 func (s *UserHandlingServer) AddUser(ctx context.Context, user *pb.User) (*pb.Response, error) {
-	s.Info().Msgf("Got a call for AddUser method with nickname %q and email %q", user.Nickname, user.Email)
+	s.Info().Msg("Got a call for AddUser method.")
+	language, err := userLanguage(ctx, user.Language)
+	if err != nil {
+		return nil, err
+	}
 	if ok, err := s.CheckNicknameInDatabase(ctx, user.Nickname); err != nil {
 		s.Error().Msgf("An error occured while executing database operation: %v", err)
 		return nil, err
@@ -80,41 +157,47 @@ func (s *UserHandlingServer) AddUser(ctx context.Context, user *pb.User) (*pb.Re
 	if _, err := mail.ParseAddress(user.Email); err != nil {
 		return nil, fmt.Errorf("Invalid email.")
 	}
-	key, err := s.SetOperation(ctx, data.User{Nickname: user.Nickname, Email: user.Email}, "ADD")
+	key, err := s.SetOperation(ctx, data.User{Nickname: user.Nickname, Email: user.Email, Language: language},
+		data.OperationAdd, nil)
 	if err != nil {
 		s.Error().Msgf("An error occured while accessing cache: %v", err)
 		return nil, err
 	}
-	err = s.sendAuthEmail(user.Email, key, "ADD")
+	err = s.sendAuthEmail(ctx, user.Nickname, user.Email, key, string(data.OperationAdd), language)
 	if err != nil {
 		s.Error().Msgf("An error occured while sending message to MB: %v", err)
 		return nil, err
 	}
-	s.Info().Msgf("Got a request to add user %s. The auth email is sent.", user.Nickname)
+	s.Info().Msg("Got a request to add user. The auth email is sent.")
 	return &pb.Response{Message: "Auth email is sent."}, nil
 }
 
 // DeleteUser is the part of gRPC service implementation. In case the user with this nickname does exist,
 // the method sends an authenticating email (with help of the email service) using user's email address.
 func (s *UserHandlingServer) DeleteUser(ctx context.Context, user *pb.User) (*pb.Response, error) {
-	s.Info().Msgf("Got a call for DeleteUser method with nickname %q and email %q", user.Nickname, user.Email)
+	s.Info().Msg("Got a call for DeleteUser method.")
 	if email, err := s.GetEmailByNickname(ctx, user.Nickname); err != nil {
 		s.Error().Msgf("An error occured while executing database operation: %v", err)
 		return nil, err
 	} else if user.Email = email; email == "" {
 		return nil, fmt.Errorf("There is no user with such nickname.")
 	}
-	key, err := s.SetOperation(ctx, data.User{Nickname: user.Nickname, Email: user.Email}, "DELETE")
+	language, err := s.storedLanguage(ctx, user.Nickname)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	}
+	key, err := s.SetOperation(ctx, data.User{Nickname: user.Nickname, Email: user.Email}, data.OperationDelete, nil)
 	if err != nil {
 		s.Error().Msgf("An error occured while accessing cache: %v", err)
 		return nil, err
 	}
-	err = s.sendAuthEmail(user.Email, key, "DELETE")
+	err = s.sendAuthEmail(ctx, user.Nickname, user.Email, key, string(data.OperationDelete), language)
 	if err != nil {
 		s.Error().Msgf("An error occured while sending message to MB: %v", err)
 		return nil, err
 	}
-	s.Info().Msgf("Got a request to delete user %s. The auth email is sent.", user.Nickname)
+	s.Info().Msg("Got a request to delete user. The auth email is sent.")
 	return &pb.Response{Message: "Auth email is sent."}, nil
 }
 
@@ -129,7 +212,7 @@ func (s *UserHandlingServer) ListUsers(_ *emptypb.Empty, stream pb.UserHandling_
 		return err
 	}
 	for _, user := range usersList {
-		if err := stream.Send(&pb.User{Nickname: user.Nickname, Email: user.Email}); err != nil {
+		if err := stream.Send(&pb.User{Nickname: user.Nickname, Email: user.Email, Language: user.Language}); err != nil {
 			s.Error().Msgf("An error occured while sending the list of users: %v", err)
 			return err
 		}
@@ -138,62 +221,270 @@ func (s *UserHandlingServer) ListUsers(_ *emptypb.Empty, stream pb.UserHandling_
 	return nil
 }
 
-// sendAuthEmail sends message with request to deliver a authenticating email to the email service
-// through message broker.
-func (s *UserHandlingServer) sendAuthEmail(authInfo ...string) error {
-	msg := &sarama.ProducerMessage{
-		Topic: sc.AuthTopic,
-		Value: sarama.StringEncoder(strings.Join(authInfo, " ")),
+// ExportMyData is the part of gRPC service implementation. In case the user with this nickname does exist,
+// the method sends an authenticating email, confirming which the user gets all data stored about them.
+func (s *UserHandlingServer) ExportMyData(ctx context.Context, user *pb.User) (*pb.Response, error) {
+	s.Info().Msg("Got a call for ExportMyData method.")
+	if email, err := s.GetEmailByNickname(ctx, user.Nickname); err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	} else if user.Email = email; email == "" {
+		return nil, fmt.Errorf("There is no user with such nickname.")
+	}
+	language, err := s.storedLanguage(ctx, user.Nickname)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	}
+	key, err := s.SetOperation(ctx, data.User{Nickname: user.Nickname, Email: user.Email}, data.OperationExport, nil)
+	if err != nil {
+		s.Error().Msgf("An error occured while accessing cache: %v", err)
+		return nil, err
 	}
-	_, _, err := s.SendMessage(msg)
-	return err
+	err = s.sendAuthEmail(ctx, user.Nickname, user.Email, key, string(data.OperationExport), language)
+	if err != nil {
+		s.Error().Msgf("An error occured while sending message to MB: %v", err)
+		return nil, err
+	}
+	s.Info().Msg("Got a request to export data of user. The auth email is sent.")
+	return &pb.Response{Message: "Auth email is sent."}, nil
 }
 
-// sendDailyEmail sends message with request to deliver the user's daily message to the email service
-// through message broker.
-func (s *UserHandlingServer) sendDailyEmail(user data.User) error {
-	msg := &sarama.ProducerMessage{
-		Topic: sc.DailyDeliveryTopic,
-		Value: sarama.StringEncoder(user.Email + " " + user.Nickname),
+// ChangeEmail is the part of gRPC service implementation. In case the user with this nickname does exist,
+// the method sends an authenticating email to the current address of the user, so the subscription can be
+// moved to another email only by its' owner.
+func (s *UserHandlingServer) ChangeEmail(ctx context.Context, change *pb.EmailChange) (*pb.Response, error) {
+	s.Info().Msg("Got a call for ChangeEmail method.")
+	if _, err := mail.ParseAddress(change.NewEmail); err != nil {
+		return nil, fmt.Errorf("Invalid email.")
 	}
-	_, _, err := s.SendMessage(msg)
-	return err
+	email, err := s.GetEmailByNickname(ctx, change.Nickname)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	} else if email == "" {
+		return nil, fmt.Errorf("There is no user with such nickname.")
+	}
+	language, err := s.storedLanguage(ctx, change.Nickname)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	}
+	key, err := s.SetOperation(ctx, data.User{Nickname: change.Nickname, Email: email}, data.OperationChangeEmail,
+		map[string]string{newEmailParam: change.NewEmail})
+	if err != nil {
+		s.Error().Msgf("An error occured while accessing cache: %v", err)
+		return nil, err
+	}
+	err = s.sendAuthEmail(ctx, change.Nickname, email, key, string(data.OperationChangeEmail), language)
+	if err != nil {
+		s.Error().Msgf("An error occured while sending message to MB: %v", err)
+		return nil, err
+	}
+	s.Info().Msg("Got a request to change email of user. The auth email is sent.")
+	return &pb.Response{Message: "Auth email is sent."}, nil
+}
+
+// PauseUser is the part of gRPC service implementation. In case the user with this nickname does exist,
+// the method sends an authenticating email, confirming which the user pauses or resumes daily delivery.
+func (s *UserHandlingServer) PauseUser(ctx context.Context, pause *pb.Pause) (*pb.Response, error) {
+	s.Info().Msgf("Got a call for PauseUser method with paused %t", pause.Paused)
+	email, err := s.GetEmailByNickname(ctx, pause.Nickname)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	} else if email == "" {
+		return nil, fmt.Errorf("There is no user with such nickname.")
+	}
+	language, err := s.storedLanguage(ctx, pause.Nickname)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	}
+	key, err := s.SetOperation(ctx, data.User{Nickname: pause.Nickname, Email: email}, data.OperationPause,
+		map[string]string{pausedParam: strconv.FormatBool(pause.Paused)})
+	if err != nil {
+		s.Error().Msgf("An error occured while accessing cache: %v", err)
+		return nil, err
+	}
+	err = s.sendAuthEmail(ctx, pause.Nickname, email, key, string(data.OperationPause), language)
+	if err != nil {
+		s.Error().Msgf("An error occured while sending message to MB: %v", err)
+		return nil, err
+	}
+	s.Info().Msg("Got a request to pause delivery for user. The auth email is sent.")
+	return &pb.Response{Message: "Auth email is sent."}, nil
+}
+
+// EraseUser is the part of gRPC service implementation. It is an administrative method which
+// removes all data of the user from database and cache. Downstream consumers are notified about
+// the erasure by the tombstone, which is written into the outbox together with the erasure.
+func (s *UserHandlingServer) EraseUser(ctx context.Context, user *pb.User) (*pb.Response, error) {
+	s.Info().Msg("Got a call for EraseUser method.")
+	if err := s.checkAdmin(ctx); err != nil {
+		s.Error().Msgf("Unauthorized call for EraseUser method: %v", err)
+		return nil, err
+	}
+	existed, err := s.Data.EraseUser(ctx, user.Nickname)
+	if err != nil {
+		s.Error().Msgf("An error occured while erasing user: %v", err)
+		return nil, err
+	} else if !existed {
+		return nil, fmt.Errorf("There is no user with such nickname.")
+	}
+	s.Info().Msg("Erased user.")
+	return &pb.Response{Message: "User is erased."}, nil
+}
+
+// sendAuthEmail sends message with request to deliver a authenticating email in given language to the email
+// service through message broker. The message is keyed by user's nickname.
+func (s *UserHandlingServer) sendAuthEmail(ctx context.Context, nickname, email, key, method, language string) error {
+	request, err := messages.NewAuthRequest(email, key, method, language)
+	if err != nil {
+		return err
+	}
+	value, err := request.Encode()
+	if err != nil {
+		return err
+	}
+	return s.Publish(&broker.Message{
+		Topic:   sc.AuthTopic,
+		Key:     nickname,
+		Value:   value,
+		Headers: request.Headers(sc.MainServiceName, traceParent(ctx)),
+	})
+}
+
+// traceParent returns trace context for messages produced during the call: a child of caller's
+// "traceparent" metadata or a new trace, if there is no such metadata.
+func traceParent(ctx context.Context) string {
+	parent := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(messages.HeaderTraceParent); len(values) > 0 {
+			parent = values[0]
+		}
+	}
+	return messages.ChildTraceParent(parent)
+}
+
+// DeliveryRunID returns the ID of delivery run scheduled at given time. The ID is deterministic,
+// so a run repeated (e.g. after restart of the service) has the same ID.
+func DeliveryRunID(scheduledAt time.Time) string {
+	return scheduledAt.UTC().Format(runIDLayout)
 }
 
 // SendDailyMessages sends messages to message broker with request of sending email for each user.
-func (s *UserHandlingServer) SendDailyMessagesToAllUsers() {
-	s.Info().Msg("Starting to send daily messages.")
-	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
-	usersList, err := s.GetUsersFromDatabase(ctx)
+// Every message carries the ID of delivery run scheduled at given time, which allows email service
+// to skip duplicates. The progress of run is saved in database with a checkpoint for every user,
+// so a repeated run publishes messages only for users who didn't get them yet. Messages are published
+// in batches by the pool of workers (see delivery.go). If ctx is done before all messages are published,
+// the run is left unfinished and is resumed later.
+func (s *UserHandlingServer) SendDailyMessagesToAllUsers(ctx context.Context, scheduledAt time.Time) {
+	runID := DeliveryRunID(scheduledAt)
+	runTraceParent := messages.ChildTraceParent("")
+	s.Info().Msgf("Starting to send daily messages of run %s (trace %s).", runID, runTraceParent)
+	dbCtx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	usersList, err := s.GetUsersFromDatabase(dbCtx)
+	if err != nil {
+		cancel()
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return
+	}
+	alreadyPublished, err := s.StartDeliveryRun(dbCtx, runID, len(usersList))
 	cancel()
 	if err != nil {
 		s.Error().Msgf("An error occured while executing database operation: %v", err)
 		return
 	}
-	wg := new(sync.WaitGroup)
-	wg.Add(len(usersList))
+	pending := make([]data.User, 0, len(usersList))
 	for _, user := range usersList {
-		go func(user data.User) {
-			defer wg.Done()
-			err := s.sendDailyEmail(user)
-			if err != nil {
-				s.Error().Msgf("An error occured while sending message to MB: %v", err)
-			}
-		}(user)
+		if !alreadyPublished[user.Nickname] {
+			pending = append(pending, user)
+		}
+	}
+	published, failed := s.publishDailyMessages(ctx, pending, runID, runTraceParent)
+	if ctx.Err() != nil {
+		s.Warn().Msgf("Run %s is interrupted: %d messages published, %d failed, %d left.", runID, published, failed,
+			int64(len(pending))-published-failed)
+		return
+	}
+	dbCtx, cancel = context.WithTimeout(ctx, ctxTimeout)
+	err = s.FinishDeliveryRun(dbCtx, runID)
+	cancel()
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return
+	}
+	s.Info().Msgf("Finished run %s: %d messages published, %d failed, %d published before. Next delivery will be in %s",
+		runID, published, failed, len(alreadyPublished), deliveryInterval)
+}
+
+// ResumeDeliveryRuns repeats delivery runs which were interrupted (e.g. by restart of the service).
+// Users who already got the message of a run are skipped.
+func (s *UserHandlingServer) ResumeDeliveryRuns(ctx context.Context) {
+	dbCtx, cancel := context.WithTimeout(ctx, ctxTimeout)
+	runIDs, err := s.GetUnfinishedDeliveryRuns(dbCtx)
+	cancel()
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return
+	}
+	for _, runID := range runIDs {
+		if ctx.Err() != nil {
+			return
+		}
+		scheduledAt, err := time.Parse(runIDLayout, runID)
+		if err != nil {
+			s.Error().Msgf("Invalid ID of delivery run %q: %v", runID, err)
+			continue
+		}
+		s.Info().Msgf("Resuming interrupted delivery run %s.", runID)
+		s.SendDailyMessagesToAllUsers(ctx, scheduledAt)
+	}
+}
+
+// GetDeliveryRun is the part of gRPC service implementation. It is an administrative method which
+// returns the progress of delivery run with given ID.
+func (s *UserHandlingServer) GetDeliveryRun(ctx context.Context, request *pb.DeliveryRunRequest) (*pb.DeliveryRun, error) {
+	s.Info().Msgf("Got a call for GetDeliveryRun method with run ID %q", request.RunId)
+	if err := s.checkAdmin(ctx); err != nil {
+		s.Error().Msgf("Unauthorized call for GetDeliveryRun method: %v", err)
+		return nil, err
+	}
+	run, err := s.Data.GetDeliveryRun(ctx, request.RunId)
+	if err != nil {
+		s.Error().Msgf("An error occured while executing database operation: %v", err)
+		return nil, err
+	} else if run == nil {
+		return nil, fmt.Errorf("There is no delivery run with such ID.")
 	}
-	wg.Wait()
-	s.Info().Msgf("Finished sending messages. Next delivery will be in %s", deliveryInterval)
+	response := &pb.DeliveryRun{RunId: run.ID, StartedAt: run.StartedAt.UTC().Format(time.RFC3339),
+		Total: int32(run.Total), Published: int32(run.Published), Failed: int32(run.Failed)}
+	if !run.FinishedAt.IsZero() {
+		response.FinishedAt = run.FinishedAt.UTC().Format(time.RFC3339)
+	}
+	return response, nil
 }
 
-// DailyDelivery waits for the time of delivery, then sends messages to all users with
-// constant period of time. delivery* variables are defines in delivery_time.go.
+// DailyDelivery resumes interrupted delivery runs and waits for the time of delivery, then sends
+// messages to all users with constant period of time. delivery* variables are defines in delivery_time.go.
 func (s *UserHandlingServer) DailyDelivery(wg *sync.WaitGroup, cancelChan <-chan struct{}) {
 	defer wg.Done()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-cancelChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	s.ResumeDeliveryRuns(ctx)
 	curTime := time.Now()
 	deliveryTime := time.Date(curTime.Year(), curTime.Month(), curTime.Day(), deliveryHour,
 		deliveryMinute, deliverySecond, 0, time.UTC)
 	for deliveryTime.Before(curTime) {
-		deliveryTime.Add(deliveryInterval)
+		deliveryTime = deliveryTime.Add(deliveryInterval)
 	}
 	willDeliverIn := deliveryTime.Sub(curTime)
 	waitTimer := time.NewTimer(willDeliverIn)
@@ -207,13 +498,14 @@ outer:
 			return
 		}
 	}
-	s.SendDailyMessagesToAllUsers()
+	s.SendDailyMessagesToAllUsers(ctx, deliveryTime)
 	ticker := time.NewTicker(deliveryInterval)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-ticker.C:
-			s.SendDailyMessagesToAllUsers()
+			deliveryTime = deliveryTime.Add(deliveryInterval)
+			s.SendDailyMessagesToAllUsers(ctx, deliveryTime)
 		case <-cancelChan:
 			return
 		}
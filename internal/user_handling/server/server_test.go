@@ -2,14 +2,14 @@ package uh_server_test
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
-	"math/rand"
-	"strings"
 	"testing"
 	"time"
 
+	"github.com/KSpaceer/go_watermelon/internal/broker"
 	"github.com/KSpaceer/go_watermelon/internal/data"
-	"github.com/KSpaceer/go_watermelon/internal/kafkawriter"
+	"github.com/KSpaceer/go_watermelon/internal/messages"
 	sc "github.com/KSpaceer/go_watermelon/internal/shared_consts"
 	pb "github.com/KSpaceer/go_watermelon/internal/user_handling/proto"
 	uh "github.com/KSpaceer/go_watermelon/internal/user_handling/server"
@@ -20,6 +20,7 @@ import (
 	"github.com/stretchr/testify/mock"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 
 	"github.com/Shopify/sarama"
 	saramamock "github.com/Shopify/sarama/mocks"
@@ -38,8 +39,8 @@ func (d *MockData) GetOperation(ctx context.Context, key string) (*data.Operatio
 	return args.Get(0).(*data.Operation), args.Error(1)
 }
 
-func (d *MockData) SetOperation(ctx context.Context, user data.User, method string) (string, error) {
-	args := d.Called(ctx, user, method)
+func (d *MockData) SetOperation(ctx context.Context, user data.User, method data.OperationKind, params map[string]string) (string, error) {
+	args := d.Called(ctx, user, method, params)
 	return args.String(0), args.Error(1)
 }
 
@@ -48,6 +49,11 @@ func (d *MockData) GetEmailByNickname(ctx context.Context, nickname string) (str
 	return args.String(0), args.Error(1)
 }
 
+func (d *MockData) GetLanguageByNickname(ctx context.Context, nickname string) (string, error) {
+	args := d.Called(ctx, nickname)
+	return args.String(0), args.Error(1)
+}
+
 func (d *MockData) CheckNicknameInDatabase(ctx context.Context, nickname string) (bool, error) {
 	args := d.Called(ctx, nickname)
 	return args.Bool(0), args.Error(1)
@@ -68,13 +74,104 @@ func (d *MockData) GetUsersFromDatabase(ctx context.Context) ([]data.User, error
 	return args.Get(0).([]data.User), args.Error(1)
 }
 
+func (d *MockData) LogDelivery(ctx context.Context, nickname string) error {
+	args := d.Called(ctx, nickname)
+	return args.Error(0)
+}
+
+func (d *MockData) GetUserData(ctx context.Context, nickname string) (*data.UserData, error) {
+	args := d.Called(ctx, nickname)
+	return args.Get(0).(*data.UserData), args.Error(1)
+}
+
+func (d *MockData) EraseUser(ctx context.Context, nickname string) (bool, error) {
+	args := d.Called(ctx, nickname)
+	return args.Bool(0), args.Error(1)
+}
+
+func (d *MockData) GetUnpublishedEvents(ctx context.Context, limit int) ([]data.OutboxEvent, error) {
+	args := d.Called(ctx, limit)
+	return args.Get(0).([]data.OutboxEvent), args.Error(1)
+}
+
+func (d *MockData) MarkEventsPublished(ctx context.Context, ids []int64) error {
+	args := d.Called(ctx, ids)
+	return args.Error(0)
+}
+
+func (d *MockData) AddAuditRecord(ctx context.Context, record data.AuditRecord) error {
+	args := d.Called(ctx, record)
+	return args.Error(0)
+}
+
+func (d *MockData) ChangeUserEmail(ctx context.Context, nickname, newEmail string) error {
+	args := d.Called(ctx, nickname, newEmail)
+	return args.Error(0)
+}
+
+func (d *MockData) SetUserPaused(ctx context.Context, nickname string, paused bool) error {
+	args := d.Called(ctx, nickname, paused)
+	return args.Error(0)
+}
+
+func (d *MockData) StartDeliveryRun(ctx context.Context, runID string, total int) (map[string]bool, error) {
+	args := d.Called(ctx, runID, total)
+	return args.Get(0).(map[string]bool), args.Error(1)
+}
+
+func (d *MockData) CheckpointDelivery(ctx context.Context, runID, nickname string, published bool) error {
+	args := d.Called(ctx, runID, nickname, published)
+	return args.Error(0)
+}
+
+func (d *MockData) FinishDeliveryRun(ctx context.Context, runID string) error {
+	args := d.Called(ctx, runID)
+	return args.Error(0)
+}
+
+func (d *MockData) GetDeliveryRun(ctx context.Context, runID string) (*data.DeliveryRun, error) {
+	args := d.Called(ctx, runID)
+	return args.Get(0).(*data.DeliveryRun), args.Error(1)
+}
+
+func (d *MockData) GetUnfinishedDeliveryRuns(ctx context.Context) ([]string, error) {
+	args := d.Called(ctx)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (d *MockData) RecordDeliveryReceipt(ctx context.Context, receipt data.DeliveryReceipt) (bool, error) {
+	args := d.Called(ctx, receipt)
+	return args.Bool(0), args.Error(1)
+}
+
+// checkAuthRequest decodes the auth request message and compares its' fields with expected ones.
+func checkAuthRequest(value []byte, email, key, method string) error {
+	msg, err := messages.DecodeAuthRequest(value)
+	if err != nil {
+		return err
+	}
+	if msg.Email != email || msg.Key != key || msg.Method != method {
+		return fmt.Errorf("Wrong auth request: expected %q %q %q but got %q %q %q", email, key, method, msg.Email, msg.Key, msg.Method)
+	}
+	return nil
+}
+
+// readHeaders returns values of produced message's headers by their names.
+func readHeaders(msg *sarama.ProducerMessage) map[string]string {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		headers[string(header.Key)] = string(header.Value)
+	}
+	return headers
+}
+
 func TestAuthUserAddMethod(t *testing.T) {
 	mockData := new(MockData)
 	uhServer := uh.NewUserHandlingServer(mockData, nil)
 	uhServer.Logger = zerolog.Nop()
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
-	testOperation := &data.Operation{User: data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"}, Method: "ADD"}
+	testOperation := &data.Operation{User: data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"}, Method: data.OperationAdd}
 	testKey := &pb.Key{Key: "KEF9cGJnPB7Ghhc-vFhouCEL7pCvOz7BjZW0ebLNBOa9qkHaVwdsrByXI002DKDyxkuk1p5_rRDCHTiKrtOtq7HHiphjnFo0Aj2srl7156uxc5_fvl9YjUcpuyabUKvHptiF--LY3_oNXmnQD44A-t3PUUIbi3QePLWo1eTCLZw"}
 	mockData.On("GetOperation", ctx, testKey.Key).Return(testOperation, nil)
 	mockData.On("AddUserToDatabase", ctx, testOperation.User).Return(nil)
@@ -92,7 +189,7 @@ func TestAuthUserDeleteMethod(t *testing.T) {
 	uhServer.Logger = zerolog.Nop()
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
-	testOperation := &data.Operation{User: data.User{Nickname: "MelonEnjoyer", Email: "melonsarebetter@gmail.com"}, Method: "DELETE"}
+	testOperation := &data.Operation{User: data.User{Nickname: "MelonEnjoyer", Email: "melonsarebetter@gmail.com"}, Method: data.OperationDelete}
 	testKey := &pb.Key{Key: "hdAp8Gj8BLBqD3L03L6fseVtzJRJdTMr16B9_C5dYPcV0mojUbU3uw7aLODP82MuSqCOpkdfGWjt_7qaNapL-MafNr-jC5LZL19XgTyzW5cSj5grG9IdyVlzfCdpHzddpfsBv-51GKKCzmTQB3d6RAt6mTJwQ_AYsgOtBUr7nrc"}
 	mockData.On("GetOperation", ctx, testKey.Key).Return(testOperation, nil)
 	mockData.On("DeleteUserFromDatabase", ctx, testOperation.User).Return(nil)
@@ -119,6 +216,105 @@ func TestAuthUserWrongKey(t *testing.T) {
 	assert.Nil(t, response)
 }
 
+func TestAuthUserChangeEmailMethod(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	testOperation := &data.Operation{User: data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"},
+		Method: data.OperationChangeEmail, Params: map[string]string{"new_email": "arbuz@example.com"}, Version: data.OperationVersion}
+	testKey := &pb.Key{Key: "changekey"}
+	mockData.On("GetOperation", ctx, testKey.Key).Return(testOperation, nil)
+	mockData.On("ChangeUserEmail", ctx, "arbuz", "arbuz@example.com").Return(nil)
+	response, err := uhServer.AuthUser(ctx, testKey)
+	testResponse := &pb.Response{Message: "Method CHANGE_EMAIL was executed successfully."}
+	if assert.Nil(t, err) {
+		mockData.AssertExpectations(t)
+		assert.Equal(t, testResponse, response)
+	}
+}
+
+func TestAuthUserPauseInvalidParams(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	testOperation := &data.Operation{User: data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"},
+		Method: data.OperationPause, Params: map[string]string{"paused": "maybe"}, Version: data.OperationVersion}
+	testKey := &pb.Key{Key: "pausekey"}
+	mockData.On("GetOperation", ctx, testKey.Key).Return(testOperation, nil)
+	response, err := uhServer.AuthUser(ctx, testKey)
+	mockData.AssertExpectations(t)
+	mockData.AssertNotCalled(t, "SetUserPaused", mock.Anything, mock.Anything, mock.Anything)
+	assert.NotNil(t, err)
+	assert.Nil(t, response)
+}
+
+func TestAuthUserUnsupportedVersion(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	testOperation := &data.Operation{User: data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"},
+		Method: data.OperationAdd, Version: data.OperationVersion + 1}
+	testKey := &pb.Key{Key: "futurekey"}
+	mockData.On("GetOperation", ctx, testKey.Key).Return(testOperation, nil)
+	response, err := uhServer.AuthUser(ctx, testKey)
+	mockData.AssertNotCalled(t, "AddUserToDatabase", mock.Anything, mock.Anything)
+	assert.NotNil(t, err)
+	assert.Nil(t, response)
+}
+
+func TestChangeEmail(t *testing.T) {
+	mockData := new(MockData)
+	producer := saramamock.NewSyncProducer(t, nil)
+	uhServer := uh.NewUserHandlingServer(mockData, broker.NewKafkaPublisher(producer))
+	uhServer.Logger = zerolog.Nop()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	testKey := "changekey"
+	mockData.On("GetEmailByNickname", ctx, "arbuz").Return("arbuz@gmail.com", nil)
+	mockData.On("GetLanguageByNickname", ctx, "arbuz").Return("", nil)
+	mockData.On("SetOperation", ctx, data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"}, data.OperationChangeEmail,
+		map[string]string{"new_email": "arbuz@example.com"}).Return(testKey, nil)
+	producer.ExpectSendMessageWithCheckerFunctionAndSucceed(func(val []byte) error {
+		return checkAuthRequest(val, "arbuz@gmail.com", testKey, "CHANGE_EMAIL")
+	})
+	response, err := uhServer.ChangeEmail(ctx, &pb.EmailChange{Nickname: "arbuz", NewEmail: "arbuz@example.com"})
+	if assert.Nil(t, err) {
+		mockData.AssertExpectations(t)
+		assert.Equal(t, &pb.Response{Message: "Auth email is sent."}, response)
+	}
+}
+
+func TestPauseUserWithMemoryBroker(t *testing.T) {
+	mockData := new(MockData)
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	testKey := "pausekey"
+	mockData.On("GetEmailByNickname", ctx, "arbuz").Return("arbuz@gmail.com", nil)
+	mockData.On("GetLanguageByNickname", ctx, "arbuz").Return("", nil)
+	mockData.On("SetOperation", ctx, data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"}, data.OperationPause,
+		map[string]string{"paused": "true"}).Return(testKey, nil)
+	_, err := uhServer.PauseUser(ctx, &pb.Pause{Nickname: "arbuz", Paused: true})
+	if !assert.Nil(t, err) {
+		return
+	}
+	mockData.AssertExpectations(t)
+	published := memory.Messages(sc.AuthTopic)
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, "arbuz", published[0].Key)
+		assert.Nil(t, checkAuthRequest(published[0].Value, "arbuz@gmail.com", testKey, "PAUSE"))
+		assert.Equal(t, sc.MainServiceName, published[0].Headers[messages.HeaderProducer])
+	}
+	assert.NotEmpty(t, memory.Messages(sc.LogsTopic))
+}
+
 type MockStream struct {
 	grpc.ServerStream
 	mock.Mock
@@ -148,22 +344,32 @@ func TestListUsers(t *testing.T) {
 func TestAddUserNotExists(t *testing.T) {
 	mockProducer := saramamock.NewSyncProducer(t, sarama.NewConfig())
 	mockData := new(MockData)
-	uhServer := uh.NewUserHandlingServer(mockData, mockProducer)
+	uhServer := uh.NewUserHandlingServer(mockData, broker.NewKafkaPublisher(mockProducer))
 	uhServer.Logger = zerolog.Nop()
 	testUser := &pb.User{Nickname: "ThomasShelby", Email: "peaky_blinders@gmail.com"}
 	testKey := "NTAAOcXYBLLKj+SxtQ/cuKiBcxV/cCQENqv1IzMUGQ7HTvwokQu734r9lCvHIffD6seUcARz65hN8Ij9wU1+YwHp5YtdByEBUqm/HS4o+734vJNTtVE5BIjzHP0uflvPaCqgw3me06C2FNlRNsI5d6xOSmBM7MA8tqr0Tgb+ZjA="
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	mockData.On("CheckNicknameInDatabase", ctx, testUser.Nickname).Return(false, nil)
-	mockData.On("SetOperation", ctx, data.User{Nickname: testUser.Nickname, Email: testUser.Email}, "ADD").Return(testKey, nil)
+	mockData.On("SetOperation", ctx, data.User{Nickname: testUser.Nickname, Email: testUser.Email}, data.OperationAdd, map[string]string(nil)).Return(testKey, nil)
 	msgChecker := func(msg *sarama.ProducerMessage) error {
-		var err error
 		if msg.Topic != sc.AuthTopic {
-			err = fmt.Errorf("Wrong topic: expected %q but got %q", sc.AuthTopic, msg.Topic)
-		} else if expected := sarama.StringEncoder(strings.Join([]string{testUser.Email, testKey, "ADD"}, " ")); msg.Value != expected {
-			err = fmt.Errorf("Wrong value: expected %q but got %q", expected, msg.Value)
+			return fmt.Errorf("Wrong topic: expected %q but got %q", sc.AuthTopic, msg.Topic)
 		}
-		return err
+		value, err := msg.Value.Encode()
+		if err != nil {
+			return err
+		} else if err = checkAuthRequest(value, testUser.Email, testKey, "ADD"); err != nil {
+			return err
+		}
+		if key, _ := msg.Key.Encode(); string(key) != testUser.Nickname {
+			return fmt.Errorf("Wrong key: expected %q but got %q", testUser.Nickname, key)
+		}
+		headers := readHeaders(msg)
+		if headers[messages.HeaderProducer] != sc.MainServiceName || headers[messages.HeaderTraceParent] == "" {
+			return fmt.Errorf("Wrong headers: %v", headers)
+		}
+		return nil
 	}
 	mockProducer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(saramamock.MessageChecker(msgChecker))
 	testResponse := &pb.Response{Message: "Auth email is sent."}
@@ -205,20 +411,23 @@ func TestAddUserInvalidEmail(t *testing.T) {
 func TestDeleteUserExists(t *testing.T) {
 	mockProducer := saramamock.NewSyncProducer(t, sarama.NewConfig())
 	mockData := new(MockData)
-	uhServer := uh.NewUserHandlingServer(mockData, mockProducer)
+	uhServer := uh.NewUserHandlingServer(mockData, broker.NewKafkaPublisher(mockProducer))
 	uhServer.Logger = zerolog.Nop()
 	testUser := &pb.User{Nickname: "MelonEnjoyer", Email: "melonsarebetter@gmail.com"}
 	testKey := "S6FqubLd0KzKUebq9kG6t8Zv2JkKDCl43xkcDnXR68i1uFRKoWP6y6tT4DiMbVUR5qzKPHXKXA8jaZtv1O1hACtgNfd9sKP/zfum4UKMCEdiL6P+aNf7hbK78Pwi7hDx78SU8u1euxLpt/yraaYzO/2vt6QAN7+4yVja/5g3SQ0="
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 	mockData.On("GetEmailByNickname", ctx, testUser.Nickname).Return(testUser.Email, nil)
-	mockData.On("SetOperation", ctx, data.User{Nickname: testUser.Nickname, Email: testUser.Email}, "DELETE").Return(testKey, nil)
+	mockData.On("GetLanguageByNickname", ctx, testUser.Nickname).Return("", nil)
+	mockData.On("SetOperation", ctx, data.User{Nickname: testUser.Nickname, Email: testUser.Email}, data.OperationDelete, map[string]string(nil)).Return(testKey, nil)
 	msgChecker := func(msg *sarama.ProducerMessage) error {
 		var err error
 		if msg.Topic != sc.AuthTopic {
 			err = fmt.Errorf("Wrong topic: expected %q but got %q", sc.AuthTopic, msg.Topic)
-		} else if expected := sarama.StringEncoder(strings.Join([]string{testUser.Email, testKey, "DELETE"}, " ")); msg.Value != expected {
-			err = fmt.Errorf("Wrong value: expected %q but got %q", expected, msg.Value)
+		} else if value, encErr := msg.Value.Encode(); encErr != nil {
+			err = encErr
+		} else {
+			err = checkAuthRequest(value, testUser.Email, testKey, "DELETE")
 		}
 		return err
 	}
@@ -247,26 +456,257 @@ func TestDeleteUserNotExists(t *testing.T) {
 
 func TestDailyMessagesToAllUsers(t *testing.T) {
 	mockData := new(MockData)
-	mockProducer := saramamock.NewSyncProducer(t, sarama.NewConfig())
-	uhServer := uh.NewUserHandlingServer(mockData, mockProducer)
-	uhServer.Logger = zerolog.New(kafkawriter.New(mockProducer))
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	assert.Nil(t, uhServer.SetDeliveryWorkers(2, 2))
+	testUsers := []data.User{{Nickname: "pupa", Email: "buhga@example.com"}, {Nickname: "lupa", Email: "lteria@gmail.com"},
+		{Nickname: "arbuz", Email: "arbuz@example.com"}}
+	mockData.On("GetUsersFromDatabase", mock.Anything).Return(testUsers, nil)
+	mockData.On("StartDeliveryRun", mock.Anything, "20221001T120000Z", len(testUsers)).Return(map[string]bool{}, nil)
+	mockData.On("CheckpointDelivery", mock.Anything, "20221001T120000Z", mock.Anything, true).Return(nil)
+	mockData.On("FinishDeliveryRun", mock.Anything, "20221001T120000Z").Return(nil)
+	mockData.On("LogDelivery", mock.Anything, mock.Anything).Return(nil)
+	uhServer.SendDailyMessagesToAllUsers(context.Background(), time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC))
+	mockData.AssertExpectations(t)
+	mockData.AssertNumberOfCalls(t, "LogDelivery", len(testUsers))
+	mockData.AssertNumberOfCalls(t, "CheckpointDelivery", len(testUsers))
+	assert.Len(t, memory.Messages(sc.DailyDeliveryTopic), len(testUsers))
+}
+
+// failingPublisher fails the second message of every batch.
+type failingPublisher struct {
+	broker.Publisher
+}
+
+func (p failingPublisher) Publish(msgs ...*broker.Message) error {
+	if len(msgs) < 2 {
+		return nil
+	}
+	return &broker.BatchError{Errors: map[int]error{1: fmt.Errorf("FAIL")}}
+}
+
+func TestDailyMessagesBatchFailure(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, failingPublisher{})
+	uhServer.Logger = zerolog.Nop()
+	assert.Nil(t, uhServer.SetDeliveryWorkers(1, 2))
 	testUsers := []data.User{{Nickname: "pupa", Email: "buhga@example.com"}, {Nickname: "lupa", Email: "lteria@gmail.com"}}
 	mockData.On("GetUsersFromDatabase", mock.Anything).Return(testUsers, nil)
-	rand.Seed(time.Now().UnixNano())
-	expectedFailCount := 0
-	mockProducer.ExpectSendMessageAndSucceed() // logging
-	for i := 0; i < len(testUsers); i++ {
-		if rand.Intn(5) == 0 {
-			mockProducer.ExpectSendMessageAndFail(fmt.Errorf("FAIL"))
-			expectedFailCount++
-		} else {
-			mockProducer.ExpectSendMessageAndSucceed()
+	mockData.On("StartDeliveryRun", mock.Anything, "20221001T120000Z", len(testUsers)).Return(map[string]bool{}, nil)
+	mockData.On("CheckpointDelivery", mock.Anything, "20221001T120000Z", "pupa", true).Return(nil)
+	mockData.On("CheckpointDelivery", mock.Anything, "20221001T120000Z", "lupa", false).Return(nil)
+	mockData.On("LogDelivery", mock.Anything, "pupa").Return(nil)
+	mockData.On("FinishDeliveryRun", mock.Anything, "20221001T120000Z").Return(nil)
+	uhServer.SendDailyMessagesToAllUsers(context.Background(), time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC))
+	mockData.AssertExpectations(t)
+	mockData.AssertNumberOfCalls(t, "LogDelivery", 1)
+}
+
+func TestDailyMessagesCancelled(t *testing.T) {
+	mockData := new(MockData)
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	assert.Nil(t, uhServer.SetDeliveryRate(1))
+	testUsers := []data.User{{Nickname: "pupa", Email: "buhga@example.com"}, {Nickname: "lupa", Email: "lteria@gmail.com"}}
+	mockData.On("GetUsersFromDatabase", mock.Anything).Return(testUsers, nil)
+	mockData.On("StartDeliveryRun", mock.Anything, "20221001T120000Z", len(testUsers)).Return(map[string]bool{}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	uhServer.SendDailyMessagesToAllUsers(ctx, time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC))
+	mockData.AssertNotCalled(t, "FinishDeliveryRun", mock.Anything, mock.Anything)
+	assert.Empty(t, memory.Messages(sc.DailyDeliveryTopic))
+}
+
+func TestSetDeliveryWorkers(t *testing.T) {
+	uhServer := uh.NewUserHandlingServer(new(MockData), nil)
+	assert.NotNil(t, uhServer.SetDeliveryWorkers(0, 10))
+	assert.NotNil(t, uhServer.SetDeliveryWorkers(4, 0))
+	assert.NotNil(t, uhServer.SetDeliveryRate(-1))
+	assert.Nil(t, uhServer.SetDeliveryRate(0))
+}
+
+func TestResumeDeliveryRuns(t *testing.T) {
+	mockData := new(MockData)
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	testUsers := []data.User{{Nickname: "pupa", Email: "buhga@example.com"}, {Nickname: "lupa", Email: "lteria@gmail.com"}}
+	mockData.On("GetUnfinishedDeliveryRuns", mock.Anything).Return([]string{"20221001T120000Z"}, nil)
+	mockData.On("GetUsersFromDatabase", mock.Anything).Return(testUsers, nil)
+	mockData.On("StartDeliveryRun", mock.Anything, "20221001T120000Z", len(testUsers)).Return(map[string]bool{"pupa": true}, nil)
+	mockData.On("CheckpointDelivery", mock.Anything, "20221001T120000Z", "lupa", true).Return(nil)
+	mockData.On("LogDelivery", mock.Anything, "lupa").Return(nil)
+	mockData.On("FinishDeliveryRun", mock.Anything, "20221001T120000Z").Return(nil)
+	uhServer.ResumeDeliveryRuns(context.Background())
+	mockData.AssertExpectations(t)
+	published := memory.Messages(sc.DailyDeliveryTopic)
+	if assert.Len(t, published, 1) {
+		assert.Equal(t, "lupa", published[0].Key)
+	}
+}
+
+func TestGetDeliveryRun(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	uhServer.SetAdminToken("secret")
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer secret"))
+	testRun := &data.DeliveryRun{ID: "20221001T120000Z", StartedAt: time.Date(2022, 10, 1, 12, 0, 1, 0, time.UTC),
+		Total: 3, Published: 2, Failed: 1}
+	mockData.On("GetDeliveryRun", ctx, testRun.ID).Return(testRun, nil)
+	run, err := uhServer.GetDeliveryRun(ctx, &pb.DeliveryRunRequest{RunId: testRun.ID})
+	if assert.Nil(t, err) {
+		assert.Equal(t, "2022-10-01T12:00:01Z", run.StartedAt)
+		assert.Empty(t, run.FinishedAt)
+		assert.Equal(t, []int32{3, 2, 1}, []int32{run.Total, run.Published, run.Failed})
+	}
+	_, err = uhServer.GetDeliveryRun(context.Background(), &pb.DeliveryRunRequest{RunId: testRun.ID})
+	assert.NotNil(t, err)
+}
+
+func TestDeliveryRunID(t *testing.T) {
+	scheduledAt := time.Date(2022, 10, 1, 15, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	assert.Equal(t, "20221001T120000Z", uh.DeliveryRunID(scheduledAt))
+	assert.Equal(t, uh.DeliveryRunID(scheduledAt), uh.DeliveryRunID(scheduledAt.UTC()))
+}
+
+func TestAuthUserExportMethod(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	testOperation := &data.Operation{User: data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"}, Method: data.OperationExport}
+	testKey := &pb.Key{Key: "exportkey"}
+	testUserData := &data.UserData{
+		User:       testOperation.User,
+		History:    []data.HistoryRecord{{Event: data.EventSubscribed, Time: time.Date(2022, 10, 1, 12, 0, 0, 0, time.UTC)}},
+		Deliveries: []data.HistoryRecord{{Event: data.EventDailyPublished, Time: time.Date(2022, 10, 2, 12, 0, 0, 0, time.UTC)}},
+	}
+	mockData.On("GetOperation", ctx, testKey.Key).Return(testOperation, nil)
+	mockData.On("GetUserData", ctx, testOperation.User.Nickname).Return(testUserData, nil)
+	response, err := uhServer.AuthUser(ctx, testKey)
+	if assert.Nil(t, err) {
+		mockData.AssertExpectations(t)
+		var gotUserData data.UserData
+		if assert.Nil(t, json.Unmarshal([]byte(response.Message), &gotUserData)) {
+			assert.Equal(t, *testUserData, gotUserData)
 		}
 	}
-	for i := 0; i < expectedFailCount; i++ {
-		mockProducer.ExpectSendMessageAndSucceed() // logging errors
+}
+
+func TestExportMyData(t *testing.T) {
+	mockProducer := saramamock.NewSyncProducer(t, sarama.NewConfig())
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, broker.NewKafkaPublisher(mockProducer))
+	uhServer.Logger = zerolog.Nop()
+	testUser := &pb.User{Nickname: "MelonEnjoyer", Email: "melonsarebetter@gmail.com"}
+	testKey := "exportkey"
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	mockData.On("GetEmailByNickname", ctx, testUser.Nickname).Return(testUser.Email, nil)
+	mockData.On("GetLanguageByNickname", ctx, testUser.Nickname).Return("", nil)
+	mockData.On("SetOperation", ctx, data.User{Nickname: testUser.Nickname, Email: testUser.Email}, data.OperationExport, map[string]string(nil)).Return(testKey, nil)
+	mockProducer.ExpectSendMessageAndSucceed()
+	response, err := uhServer.ExportMyData(ctx, &pb.User{Nickname: testUser.Nickname})
+	if assert.Nil(t, err) {
+		mockData.AssertExpectations(t)
+		assert.Equal(t, &pb.Response{Message: "Auth email is sent."}, response)
+	}
+}
+
+func TestEraseUserAuthorized(t *testing.T) {
+	memory := broker.NewMemory()
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	uhServer.SetAdminToken("secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer secret"))
+	mockData.On("EraseUser", ctx, "Old").Return(true, nil)
+	response, err := uhServer.EraseUser(ctx, &pb.User{Nickname: "Old"})
+	if assert.Nil(t, err) {
+		mockData.AssertExpectations(t)
+		assert.Equal(t, &pb.Response{Message: "User is erased."}, response)
+	}
+	assert.Empty(t, memory.Messages(sc.ErasureTopic))
+}
+
+func TestEraseUserUnauthorized(t *testing.T) {
+	mockData := new(MockData)
+	uhServer := uh.NewUserHandlingServer(mockData, nil)
+	uhServer.Logger = zerolog.Nop()
+	uhServer.SetAdminToken("secret")
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer wrong"))
+	response, err := uhServer.EraseUser(ctx, &pb.User{Nickname: "Old"})
+	mockData.AssertExpectations(t)
+	assert.Nil(t, response)
+	assert.NotNil(t, err)
+}
+
+func TestAddUserLanguage(t *testing.T) {
+	mockData := new(MockData)
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	testUser := &pb.User{Nickname: "arbuz", Email: "arbuz@gmail.com"}
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("accept-language", "de;q=0.5, ru-RU,en;q=0.8"))
+	mockData.On("CheckNicknameInDatabase", ctx, testUser.Nickname).Return(false, nil)
+	mockData.On("SetOperation", ctx, data.User{Nickname: "arbuz", Email: "arbuz@gmail.com", Language: "ru"}, data.OperationAdd,
+		map[string]string(nil)).Return("key", nil)
+	_, err := uhServer.AddUser(ctx, testUser)
+	assert.Nil(t, err)
+
+	testUser.Language = "pt-BR"
+	mockData.On("SetOperation", ctx, data.User{Nickname: "arbuz", Email: "arbuz@gmail.com", Language: "pt"}, data.OperationAdd,
+		map[string]string(nil)).Return("key", nil)
+	_, err = uhServer.AddUser(ctx, testUser)
+	assert.Nil(t, err)
+	mockData.AssertExpectations(t)
+	published := memory.Messages(sc.AuthTopic)
+	if assert.Len(t, published, 2) {
+		for i, expected := range []string{"ru", "pt"} {
+			request, err := messages.DecodeAuthRequest(published[i].Value)
+			if assert.Nil(t, err) {
+				assert.Equal(t, expected, request.Language)
+			}
+		}
 	}
-	mockProducer.ExpectSendMessageAndSucceed() // logging
-	uhServer.SendDailyMessagesToAllUsers()
+
+	testUser.Language = "not a language"
+	_, err = uhServer.AddUser(ctx, testUser)
+	assert.NotNil(t, err)
+}
+
+func TestPauseUserStoredLanguage(t *testing.T) {
+	mockData := new(MockData)
+	memory := broker.NewMemory()
+	uhServer := uh.NewUserHandlingServer(mockData, memory)
+	uhServer.Logger = zerolog.Nop()
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("accept-language", "de"))
+	mockData.On("GetEmailByNickname", ctx, "arbuz").Return("arbuz@gmail.com", nil)
+	mockData.On("GetLanguageByNickname", ctx, "arbuz").Return("ru", nil).Once()
+	mockData.On("SetOperation", ctx, data.User{Nickname: "arbuz", Email: "arbuz@gmail.com"}, data.OperationPause,
+		map[string]string{"paused": "true"}).Return("key", nil)
+	_, err := uhServer.PauseUser(ctx, &pb.Pause{Nickname: "arbuz", Paused: true})
+	assert.Nil(t, err)
+
+	mockData.On("GetLanguageByNickname", ctx, "arbuz").Return("", nil).Once()
+	_, err = uhServer.PauseUser(ctx, &pb.Pause{Nickname: "arbuz", Paused: true})
+	assert.Nil(t, err)
 	mockData.AssertExpectations(t)
+	published := memory.Messages(sc.AuthTopic)
+	if assert.Len(t, published, 2) {
+		for i, expected := range []string{"ru", "de"} {
+			request, err := messages.DecodeAuthRequest(published[i].Value)
+			if assert.Nil(t, err) {
+				assert.Equal(t, expected, request.Language)
+			}
+		}
+	}
 }